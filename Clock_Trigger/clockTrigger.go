@@ -1,13 +1,48 @@
-package Clock_Trigger
+package main
 
 import (
+	"log"
 	"net/http"
+	"os"
 	"time"
 )
 
+// Calls the webhooks trigger of the API on regular basis
+// PARAGLIDING_URL is the root of the deployed API, eg: https://igcinfo-imt2681.herokuapp.com/paragliding
+// TRIGGER_INTERVAL is how often the check is made, defaults to 10m
+// The service must run with CLOCK_INTERVAL=0 while this trigger runs, or each notification is sent twice
 func main() {
 
-	for range time.Tick(10 * time.Minute) {
-		http.Get("https://igcinfo-imt2681.herokuapp.com/paragliding/admin/api/webhooks")
+	apiURL := os.Getenv("PARAGLIDING_URL")
+	if apiURL == "" {
+		log.Fatal("PARAGLIDING_URL is required")
+	}
+
+	interval := 10 * time.Minute
+	if env := os.Getenv("TRIGGER_INTERVAL"); env != "" {
+		parsed, err := time.ParseDuration(env)
+		if err != nil || parsed <= 0 {
+			log.Fatal("Invalid TRIGGER_INTERVAL: ", env)
+		}
+		interval = parsed
+	}
+
+	client := &http.Client{Timeout: time.Minute}
+
+	for range time.Tick(interval) {
+		req, err := http.NewRequest(http.MethodGet, apiURL+"/admin/api/webhooks", nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if user := os.Getenv("ADMIN_USER"); user != "" {
+			req.SetBasicAuth(user, os.Getenv("ADMIN_PASSWORD"))
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Println("Error calling the trigger, ", err)
+			continue
+		}
+		resp.Body.Close()
 	}
 }
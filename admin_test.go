@@ -1,16 +1,23 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 ////Admin tests
 
 func Test_adminAPITracksCount(t *testing.T) {
 	// instantiate mock HTTP server (just for the purpose of testing
-	ts := httptest.NewServer(http.HandlerFunc(adminAPITracksCount))
+	ts := httptest.NewServer(http.HandlerFunc(newTestServer().adminAPITracksCount))
 	defer ts.Close()
 
 	//create a request to our mock HTTP server
@@ -52,7 +59,7 @@ func Test_adminAPITracksCount(t *testing.T) {
 
 func Test_adminAPITracks(t *testing.T) {
 	// instantiate mock HTTP server (just for the purpose of testing
-	ts := httptest.NewServer(http.HandlerFunc(adminAPITracks))
+	ts := httptest.NewServer(http.HandlerFunc(newTestServer().adminAPITracks))
 	defer ts.Close()
 
 	//create a request to our mock HTTP server
@@ -91,3 +98,147 @@ func Test_adminAPITracks(t *testing.T) {
 	}
 
 }
+
+func Test_adminAPIConfig(t *testing.T) {
+	s := newTestServer()
+	s.cfg.AdminUser = "admin"
+	s.cfg.AdminPassword = "secret"
+
+	ts := httptest.NewServer(http.HandlerFunc(s.adminOnly(s.adminAPIConfig)))
+	defer ts.Close()
+
+	//create a request to our mock HTTP server
+	client := &http.Client{}
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Errorf("Error constructing the GET request, %s", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Errorf("Error executing the GET request, %s", err)
+	}
+
+	//without credentials the admin API is not accessible
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected StatusUnauthorized %d, received %d. ", http.StatusUnauthorized, resp.StatusCode)
+		return
+	}
+
+	req.SetBasicAuth("admin", "secret")
+
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Errorf("Error executing the GET request, %s", err)
+	}
+
+	cfg := Config{}
+	json.NewDecoder(resp.Body).Decode(&cfg)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected StatusOK %d, received %d. ", http.StatusOK, resp.StatusCode)
+		return
+	}
+	if cfg.AdminPassword != "REDACTED" {
+		t.Errorf("Expected the admin password to be redacted, received %s", cfg.AdminPassword)
+	}
+}
+
+func Test_adminAPIImport(t *testing.T) {
+	calls := make(chan string, 10)
+
+	// mock webhook receiver, it should be called once for the archive
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		calls <- r.PostForm.Get("content")
+	}))
+	defer hook.Close()
+
+	s := newTestServer()
+	s.webhooks.AddWebhook(context.Background(), Webhook{WebhookURL: hook.URL, MinTriggerValue: 1, WebhookID: "1"})
+
+	ts := httptest.NewServer(http.HandlerFunc(s.adminAPIImport))
+	defer ts.Close()
+
+	data, err := ioutil.ReadFile("testdata/sample.igc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive := &bytes.Buffer{}
+	zw := zip.NewWriter(archive)
+	files := map[string][]byte{
+		"flights/sample.igc": data,
+		"flights/other.IGC":  bytes.Replace(data, []byte("Jane Doe"), []byte("John Doe"), 1),
+		"copies/sample.igc":  data,
+		"flights/broken.igc": []byte(""),
+		"flights/notes.txt":  []byte("not a track"),
+	}
+	for _, name := range []string{"flights/sample.igc", "flights/other.IGC", "copies/sample.igc", "flights/broken.igc", "flights/notes.txt"} {
+		fw, _ := zw.Create(name)
+		fw.Write(files[name])
+	}
+	zw.Close()
+
+	resp, err := http.Post(ts.URL, "application/zip", archive)
+	if err != nil {
+		t.Fatalf("Error executing the POST request, %s", err)
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var report []importResult
+	json.NewDecoder(resp.Body).Decode(&report)
+
+	if assert.Len(t, report, 4, "The .txt file should be skipped") {
+		assert.NotEmpty(t, report[0].ID)
+		assert.NotEmpty(t, report[1].ID)
+		assert.Equal(t, report[0].ID, report[2].DuplicateOf)
+		assert.NotEmpty(t, report[3].Error)
+	}
+
+	track, _ := s.tracks.GetTrack(context.Background(), report[0].ID)
+	assert.Equal(t, "sample.igc", track.FileName)
+
+	if err := s.waitDeliveries(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, calls, 1, "The webhook should be called once for the archive")
+
+	// Not a ZIP archive
+	resp, _ = http.Post(ts.URL, "application/zip", bytes.NewReader(data))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func Test_adminAPIImport_DuplicateRace(t *testing.T) {
+	s := newTestServer()
+	api := httptest.NewServer(newRouter(s))
+	defer api.Close()
+	existing := postTrackFile(t, api, "sample.igc")
+	s.tracks = &staleHashStore{TrackStore: s.tracks}
+
+	ts := httptest.NewServer(http.HandlerFunc(s.adminAPIImport))
+	defer ts.Close()
+
+	data, err := ioutil.ReadFile("testdata/sample.igc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := &bytes.Buffer{}
+	zw := zip.NewWriter(archive)
+	fw, _ := zw.Create("sample.igc")
+	fw.Write(data)
+	zw.Close()
+
+	resp, err := http.Post(ts.URL, "application/zip", archive)
+	if err != nil {
+		t.Fatalf("Error executing the POST request, %s", err)
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var report []importResult
+	json.NewDecoder(resp.Body).Decode(&report)
+	if assert.Len(t, report, 1) {
+		assert.Equal(t, existing, report[0].DuplicateOf)
+	}
+}
@@ -2,11 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	igc "github.com/marni/goigc"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -73,7 +78,7 @@ func Test_handlerAPI_NotImplemented(t *testing.T) {
 func Test_handlerTrack_NotImplemented(t *testing.T) {
 
 	// instantiate mock HTTP server (just for the purpose of testing
-	ts := httptest.NewServer(http.HandlerFunc(handlerTrack))
+	ts := httptest.NewServer(http.HandlerFunc(newTestServer().handlerTrack))
 	defer ts.Close()
 
 	//create a request to our mock HTTP server
@@ -100,7 +105,7 @@ func Test_handlerTrack_NotImplemented(t *testing.T) {
 func Test_handlerId_NotImplemented(t *testing.T) {
 
 	// instantiate mock HTTP server (just for the purpose of testing
-	ts := httptest.NewServer(http.HandlerFunc(handlerID))
+	ts := httptest.NewServer(http.HandlerFunc(newTestServer().handlerID))
 	defer ts.Close()
 
 	//create a request to our mock HTTP server
@@ -127,7 +132,7 @@ func Test_handlerId_NotImplemented(t *testing.T) {
 func Test_handlerField_NotImplemented(t *testing.T) {
 
 	// instantiate mock HTTP server (just for the purpose of testing
-	ts := httptest.NewServer(http.HandlerFunc(handlerField))
+	ts := httptest.NewServer(http.HandlerFunc(newTestServer().handlerField))
 	defer ts.Close()
 
 	//create a request to our mock HTTP server
@@ -177,7 +182,7 @@ func Test_handlerAPI_MalformedURL(t *testing.T) {
 
 func Test_handlerTrack_MalformedURL(t *testing.T) {
 
-	ts := httptest.NewServer(http.HandlerFunc(handlerTrack))
+	ts := httptest.NewServer(http.HandlerFunc(newTestServer().handlerTrack))
 	defer ts.Close()
 
 	testCases := []string{
@@ -201,7 +206,7 @@ func Test_handlerTrack_MalformedURL(t *testing.T) {
 
 func Test_handlerId_MalformedURL(t *testing.T) {
 
-	ts := httptest.NewServer(http.HandlerFunc(handlerID))
+	ts := httptest.NewServer(http.HandlerFunc(newTestServer().handlerID))
 	defer ts.Close()
 
 	testCases := []string{
@@ -225,7 +230,7 @@ func Test_handlerId_MalformedURL(t *testing.T) {
 
 func Test_handlerField_MalformedURL(t *testing.T) {
 
-	ts := httptest.NewServer(http.HandlerFunc(handlerField))
+	ts := httptest.NewServer(http.HandlerFunc(newTestServer().handlerField))
 	defer ts.Close()
 
 	testCases := []string{
@@ -249,7 +254,7 @@ func Test_handlerField_MalformedURL(t *testing.T) {
 
 func Test_handlerTrack_Post(t *testing.T) {
 
-	ts := httptest.NewServer(http.HandlerFunc(handlerTrack))
+	ts := httptest.NewServer(http.HandlerFunc(newTestServer().handlerTrack))
 	defer ts.Close()
 
 	//create a request to our mock HTTP server
@@ -270,16 +275,13 @@ func Test_handlerTrack_Post(t *testing.T) {
 		t.Errorf("Error executing the POST request, %s", err)
 	}
 
-	if resp.StatusCode == 400 {
-		assert.Equal(t, 400, resp.StatusCode, "OK response is expected")
-	} else {
-		assert.Equal(t, 200, resp.StatusCode, "OK response is expected")
-	}
+	// The file is fetched in the background
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode, "Accepted response is expected")
 
 }
 func Test_handlerTrack_Post_Empty(t *testing.T) {
 
-	ts := httptest.NewServer(http.HandlerFunc(handlerTrack))
+	ts := httptest.NewServer(http.HandlerFunc(newTestServer().handlerTrack))
 	defer ts.Close()
 
 	//create a request to our mock HTTP server
@@ -304,22 +306,142 @@ func Test_handlerTrack_Post_Empty(t *testing.T) {
 
 }
 
+func Test_handlerTrack_Post_Upload(t *testing.T) {
+
+	s := newTestServer()
+	ts := httptest.NewServer(http.HandlerFunc(s.handlerTrack))
+	defer ts.Close()
+
+	data, err := ioutil.ReadFile("testdata/sample.igc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Uploading the file as a multipart form
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, _ := form.CreateFormFile("file", "sample.igc")
+	part.Write(data)
+	form.Close()
+
+	resp, err := http.Post(ts.URL, form.FormDataContentType(), body)
+	if err != nil {
+		t.Fatalf("Error executing the POST request, %s", err)
+	}
+	assert.Equal(t, 200, resp.StatusCode, "OK response is expected")
+
+	var created map[string]string
+	json.NewDecoder(resp.Body).Decode(&created)
+
+	track, err := s.tracks.GetTrack(context.Background(), created["id"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Jane Doe", track.Pilot)
+	assert.Equal(t, "sample.igc", track.FileName)
+
+	stored, err := s.files.GetFile(context.Background(), igcFiles, track.UniqueID)
+	assert.Nil(t, err)
+	assert.Equal(t, data, stored, "The original file should be kept")
+
+	// Uploading another flight as the raw body
+	other := bytes.Replace(data, []byte("Jane Doe"), []byte("John Doe"), 1)
+	resp, err = http.Post(ts.URL, igcContentType, bytes.NewReader(other))
+	if err != nil {
+		t.Fatalf("Error executing the POST request, %s", err)
+	}
+	assert.Equal(t, 200, resp.StatusCode, "OK response is expected")
+
+	count, _ := s.tracks.CountTracks(context.Background())
+	assert.Equal(t, int64(2), count)
+}
+
+func Test_handlerTrack_Post_Duplicate(t *testing.T) {
+
+	s := newTestServer()
+	ts := httptest.NewServer(http.HandlerFunc(s.handlerTrack))
+	defer ts.Close()
+
+	data, err := ioutil.ReadFile("testdata/sample.igc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(ts.URL, igcContentType, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error executing the POST request, %s", err)
+	}
+	var created map[string]string
+	json.NewDecoder(resp.Body).Decode(&created)
+
+	// The same flight with Windows line endings and a trailing blank line
+	crlf := append(bytes.Replace(data, []byte("\n"), []byte("\r\n"), -1), "\r\n"...)
+	resp, err = http.Post(ts.URL, igcContentType, bytes.NewReader(crlf))
+	if err != nil {
+		t.Fatalf("Error executing the POST request, %s", err)
+	}
+	assert.Equal(t, http.StatusConflict, resp.StatusCode, "Conflict is expected")
+
+	var conflict map[string]string
+	json.NewDecoder(resp.Body).Decode(&conflict)
+	assert.Equal(t, created["id"], conflict["id"], "The ID of the existing track is expected")
+
+	count, _ := s.tracks.CountTracks(context.Background())
+	assert.Equal(t, int64(1), count)
+
+	// A duplicate that passed the check of the handler, the store refuses it and its files are not kept
+	track, _ := parseIGC(data)
+	_, err = s.storeTrack(context.Background(), track, data, "", "")
+	assert.Equal(t, errDuplicateContent, err)
+	files := s.files.(*memoryStore).files
+	assert.Len(t, files[igcFiles], 1)
+	assert.Len(t, files[trackPoints], 1)
+}
+
+func Test_handlerTrack_Post_UploadInvalid(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(newTestServer().handlerTrack))
+	defer ts.Close()
+
+	// An empty raw body
+	resp, err := http.Post(ts.URL, igcContentType, bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("Error executing the POST request, %s", err)
+	}
+	assert.Equal(t, 400, resp.StatusCode, "Bad Request is expected")
+
+	// A multipart form without the file field
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	form.WriteField("name", "sample.igc")
+	form.Close()
+
+	resp, err = http.Post(ts.URL, form.FormDataContentType(), body)
+	if err != nil {
+		t.Fatalf("Error executing the POST request, %s", err)
+	}
+	assert.Equal(t, 400, resp.StatusCode, "Bad Request is expected")
+}
+
 /////Mongo tests
 func Test_mongoConnect(t *testing.T) {
-	if conn := mongoConnect(); conn == nil {
+	if store := mongoTestStore(t); store.client == nil {
 		t.Error("No connection")
 	}
 }
 
 func Test_urlInMong(t *testing.T) {
-	urlExists := urlInMongo(`Some random URL`, mongoConnect().Database("igcfiles").Collection("tracks"))
-	if urlExists {
+	_, err := mongoTestStore(t).GetTrackByURL(context.Background(), `Some random URL`)
+	if err != errNotFound {
 		t.Error("Track should not exist")
 	}
 }
 
 func Test_getAllTrack(t *testing.T) {
-	allTracks := getAllTracks(mongoConnect())
+	allTracks, err := mongoTestStore(t).GetAllTracks(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
 
 	if len(allTracks) < 0 {
 		t.Error("It should be bigger")
@@ -327,7 +449,10 @@ func Test_getAllTrack(t *testing.T) {
 }
 
 func Test_getAllWebhooks(t *testing.T) {
-	allWebhooks := getAllWebhooks(mongoConnect())
+	allWebhooks, err := mongoTestStore(t).GetAllWebhooks(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
 
 	if len(allWebhooks) < 0 {
 		t.Error("It should be bigger")
@@ -335,7 +460,7 @@ func Test_getAllWebhooks(t *testing.T) {
 }
 
 func Test_getTrack(t *testing.T) {
-	track := getTrack(mongoConnect(), `url`)
+	track, _ := mongoTestStore(t).GetTrackByURL(context.Background(), `url`)
 
 	if track.URL != "" {
 		t.Error("It should be empty")
@@ -343,5 +468,107 @@ func Test_getTrack(t *testing.T) {
 }
 
 func Test_deleteWebhook(t *testing.T) {
-	deleteWebhook(mongoConnect(), `noWebhook`)
+	err := mongoTestStore(t).DeleteWebhook(context.Background(), `noWebhook`)
+	if err != errNotFound {
+		t.Error("Webhook should not exist")
+	}
+}
+
+func Test_handlerPoints(t *testing.T) {
+
+	s := newTestServer()
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+
+	trackID := postTrackFile(t, ts, "sample.igc")
+
+	testCases := []struct {
+		query  string
+		status int
+		count  int
+	}{
+		{"", 200, 6},
+		{"?from=2018-07-02T10:01:00Z&to=2018-07-02T10:03:00Z", 200, 3},
+		{"?step=2", 200, 3},
+		{"?max=4", 200, 3},
+		{"?step=0", 400, 0},
+		{"?from=yesterday", 400, 0},
+	}
+
+	for _, tc := range testCases {
+		resp, err := http.Get(ts.URL + "/paragliding/api/track/" + trackID + "/points" + tc.query)
+		if err != nil {
+			t.Fatalf("Error making the GET request, %s", err)
+		}
+		assert.Equal(t, tc.status, resp.StatusCode, tc.query)
+
+		if tc.status == 200 {
+			var fixes []fix
+			json.NewDecoder(resp.Body).Decode(&fixes)
+			assert.Equal(t, tc.count, len(fixes), tc.query)
+		}
+	}
+
+	resp, _ := http.Get(ts.URL + "/paragliding/api/track/" + trackID + "/points")
+	var fixes []fix
+	json.NewDecoder(resp.Body).Decode(&fixes)
+	assert.Equal(t, int64(1200), fixes[0].PressureAltitude)
+	assert.InDelta(t, 45.8833, fixes[0].Lat, 0.0001)
+	assert.Equal(t, "2018-07-02T10:00:00Z", fixes[0].Time.Format(time.RFC3339))
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/999999/points")
+	assert.Equal(t, 404, resp.StatusCode)
+}
+
+func Test_trackFixes_Midnight(t *testing.T) {
+	track, err := igc.Parse("HFDTE311218\nB2359590000000N00000000EA0000000000\nB0000010000000N00000000EA0000000000\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixes := trackFixes(track)
+	assert.Equal(t, "2019-01-01T00:00:01Z", fixes[1].Time.Format(time.RFC3339))
+}
+
+func Test_handlerStats(t *testing.T) {
+
+	s := newTestServer()
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+
+	trackID := postTrackFile(t, ts, "sample.igc")
+
+	resp, err := http.Get(ts.URL + "/paragliding/api/track/" + trackID + "/stats")
+	if err != nil {
+		t.Fatalf("Error making the GET request, %s", err)
+	}
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var stats flightStats
+	json.NewDecoder(resp.Body).Decode(&stats)
+	assert.Equal(t, "2018-07-02T10:00:00Z", stats.Takeoff.Format(time.RFC3339))
+	assert.Equal(t, int64(300), stats.Airtime)
+	assert.Equal(t, int64(1350), stats.MaxGNSSAltitude)
+	assert.Equal(t, int64(1200), stats.MinGNSSAltitude)
+	assert.Equal(t, int64(1300), stats.MaxPressureAltitude)
+	assert.Equal(t, int64(100), stats.AltitudeGain)
+	assert.InDelta(t, 50.0/60, stats.MaxClimb, 0.001)
+	assert.InDelta(t, -70.0/60, stats.MaxSink, 0.001)
+	assert.True(t, stats.MaxSpeed > 0 && stats.AvgSpeed > 0)
+
+	// Over two minutes the best climb is 100 m
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/" + trackID + "/stats?window=2m")
+	json.NewDecoder(resp.Body).Decode(&stats)
+	assert.InDelta(t, 100.0/120, stats.MaxClimb, 0.001)
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/" + trackID + "/stats?window=soon")
+	assert.Equal(t, 400, resp.StatusCode)
+
+	// The statistics are fields of the track too
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/" + trackID + "/altitude_gain")
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "100", string(body))
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/" + trackID + "/unknown_field")
+	assert.Equal(t, 404, resp.StatusCode)
 }
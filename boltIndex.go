@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"sort"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// *** BOLT TRACK INDEXES *** //
+
+// The tracks are indexed in a nested bucket of indexBucket per field of trackFields and per site,
+// keyed by the encoded value of the field then the key of the track, with empty values
+// The keys are in the order of the values, then in the order the tracks were added,
+// so the pages of the track list are read by seeking a cursor instead of reading every track
+
+// siteFields are the site fields of the exact filters, indexed with trackFields
+var siteFields = map[string]trackField{
+	"takeoff_site": {text: func(t tracks) string { return t.TakeoffSite }},
+	"landing_site": {text: func(t tracks) string { return t.LandingSite }},
+}
+
+// encodeText encodes a text value, the 0 ends it so a value is not a prefix of a longer one
+func encodeText(value string) []byte {
+	return append([]byte(value), 0)
+}
+
+// encodeNumber encodes a number so the byte order is the order of the numbers, negative ones included
+func encodeNumber(value float64) []byte {
+	bits := math.Float64bits(value)
+	if value >= 0 {
+		bits |= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return itob(bits)
+}
+
+// indexValue is the encoded value of the field of the track
+func (f trackField) indexValue(t tracks) []byte {
+	if f.text != nil {
+		return encodeText(f.text(t))
+	}
+	return encodeNumber(f.number(t))
+}
+
+// putTrackIndexes indexes the track stored at key in every index
+func putTrackIndexes(tx *bolt.Tx, key []byte, track tracks) error {
+	for _, fields := range []map[string]trackField{trackFields, siteFields} {
+		for name, field := range fields {
+			bkt, err := tx.Bucket(indexBucket).CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+			if err := bkt.Put(append(field.indexValue(track), key...), []byte{}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rebuildTrackIndexes indexes again every track
+func rebuildTrackIndexes(tx *bolt.Tx) error {
+	if err := tx.DeleteBucket(indexBucket); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	if _, err := tx.CreateBucket(indexBucket); err != nil {
+		return err
+	}
+
+	return tx.Bucket(trackBucket).ForEach(func(k, v []byte) error {
+		track := tracks{}
+		if err := json.Unmarshal(v, &track); err != nil {
+			return err
+		}
+		return putTrackIndexes(tx, k, track)
+	})
+}
+
+// trackScan is the part of an index the tracks of a query are read from
+type trackScan struct {
+	index   string // name of the index, empty for the tracks bucket
+	from    []byte // first key, nil from the start of the index
+	to      []byte // first key left out, nil to the end of the index
+	ordered bool   // the keys are in the order of the page, or they are sorted by track key first
+}
+
+// planScan picks the index of the query: the sort field, or else an exact filter,
+// or else a range of dates or of a min_ or max_ filter, or else the tracks bucket
+// The other filters are checked on the tracks read
+func planScan(q trackQuery) trackScan {
+	if q.Sort != "" {
+		return trackScan{index: q.Sort, ordered: true}
+	}
+
+	// The tracks with the same value are in the order they were added
+	exact := []struct{ name, value string }{
+		{"pilot", q.Pilot}, {"glider", q.Glider}, {"glider_id", q.GliderID},
+		{"takeoff_site", q.TakeoffSite}, {"landing_site", q.LandingSite},
+	}
+	for _, val := range exact {
+		if val.value != "" {
+			return trackScan{index: val.name, from: encodeText(val.value), to: append([]byte(val.value), 1), ordered: true}
+		}
+	}
+
+	if q.DateFrom != "" || q.DateBefore != "" {
+		scan := trackScan{index: "date"}
+		if q.DateFrom != "" {
+			scan.from = []byte(q.DateFrom)
+		}
+		if q.DateBefore != "" {
+			scan.to = []byte(q.DateBefore)
+		}
+		return scan
+	}
+
+	if len(q.Bounds) > 0 {
+		bound := q.Bounds[0]
+		if bound.Max {
+			return trackScan{index: bound.Field, to: encodeNumber(math.Nextafter(bound.Value, math.Inf(1)))}
+		}
+		return trackScan{index: bound.Field, from: encodeNumber(bound.Value)}
+	}
+
+	return trackScan{ordered: true}
+}
+
+// inRange tells if the key is in the scan
+func (scan trackScan) inRange(k []byte) bool {
+	return (scan.from == nil || bytes.Compare(k, scan.from) >= 0) && (scan.to == nil || bytes.Compare(k, scan.to) < 0)
+}
+
+// trackKey returns the key of the track of an index key, the last 8 bytes
+func trackKey(k []byte) []byte {
+	return k[len(k)-8:]
+}
+
+// trackKeys returns an iterator over the keys of the tracks of the scan in the order of the query,
+// starting after the track stored at after (nil from the first track), that returns nil at the end
+func (scan trackScan) trackKeys(tx *bolt.Tx, q trackQuery, after []byte) (func() []byte, error) {
+	bkt := tx.Bucket(trackBucket)
+	if scan.index != "" {
+		bkt = tx.Bucket(indexBucket).Bucket([]byte(scan.index))
+		if bkt == nil {
+			return func() []byte { return nil }, nil
+		}
+	}
+	c := bkt.Cursor()
+
+	if !scan.ordered {
+		return scan.sortedKeys(c, q, after), nil
+	}
+
+	// The index key of the track the page starts after
+	var afterKey []byte
+	switch {
+	case after == nil:
+	case scan.index == "":
+		afterKey = after
+	case scan.index == q.Sort:
+		track := tracks{}
+		if err := json.Unmarshal(tx.Bucket(trackBucket).Get(after), &track); err != nil {
+			return nil, err
+		}
+		afterKey = append(trackFields[q.Sort].indexValue(track), after...)
+	default:
+		afterKey = append(append([]byte{}, scan.from...), after...)
+	}
+
+	var k []byte
+	if !q.Desc {
+		switch {
+		case afterKey != nil:
+			if k, _ = c.Seek(afterKey); bytes.Equal(k, afterKey) {
+				k, _ = c.Next()
+			}
+		case scan.from != nil:
+			k, _ = c.Seek(scan.from)
+		default:
+			k, _ = c.First()
+		}
+		return func() []byte {
+			if k == nil || !scan.inRange(k) {
+				return nil
+			}
+			key := trackKey(k)
+			k, _ = c.Next()
+			return key
+		}, nil
+	}
+
+	// Backwards from the last key before end
+	// The ties of a descending sort are read by value, so the last value starts after the whole group of the after track
+	end := scan.to
+	grouped := scan.index != "" && scan.index == q.Sort
+	switch {
+	case afterKey != nil && grouped:
+		end = append(append([]byte{}, afterKey[:len(afterKey)-8]...), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	case afterKey != nil:
+		end = afterKey
+	}
+	if end == nil {
+		k, _ = c.Last()
+	} else if k, _ = c.Seek(end); k == nil {
+		k, _ = c.Last()
+	} else {
+		k, _ = c.Prev()
+	}
+
+	if !grouped {
+		return func() []byte {
+			if k == nil || !scan.inRange(k) {
+				return nil
+			}
+			key := trackKey(k)
+			k, _ = c.Prev()
+			return key
+		}, nil
+	}
+
+	// The tracks with the same value are given in the order they were added, like the other stores do
+	pending := [][]byte{}
+	return func() []byte {
+		for len(pending) == 0 {
+			if k == nil || !scan.inRange(k) {
+				return nil
+			}
+			value := append([]byte{}, k[:len(k)-8]...)
+			afterGroup := afterKey != nil && bytes.Equal(value, afterKey[:len(afterKey)-8])
+			for ; k != nil && scan.inRange(k) && bytes.Equal(k[:len(k)-8], value); k, _ = c.Prev() {
+				if !afterGroup || bytes.Compare(k, afterKey) > 0 {
+					pending = append(pending, trackKey(k))
+				}
+			}
+			for i, j := 0, len(pending)-1; i < j; i, j = i+1, j-1 {
+				pending[i], pending[j] = pending[j], pending[i]
+			}
+		}
+		key := pending[0]
+		pending = pending[1:]
+		return key
+	}, nil
+}
+
+// sortedKeys reads the keys of the tracks in the range of the scan, and returns them in the order
+// the tracks were added (or the reverse), after the track stored at after
+func (scan trackScan) sortedKeys(c *bolt.Cursor, q trackQuery, after []byte) func() []byte {
+	keys := [][]byte{}
+	k, _ := c.First()
+	if scan.from != nil {
+		k, _ = c.Seek(scan.from)
+	}
+	for ; k != nil && scan.inRange(k); k, _ = c.Next() {
+		key := trackKey(k)
+		if after == nil || (!q.Desc && bytes.Compare(key, after) > 0) || (q.Desc && bytes.Compare(key, after) < 0) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return (bytes.Compare(keys[i], keys[j]) < 0) != q.Desc })
+
+	return func() []byte {
+		if len(keys) == 0 {
+			return nil
+		}
+		key := keys[0]
+		keys = keys[1:]
+		return key
+	}
+}
+
+// findIndexed reads the page of the query from the index planned for it
+func (b *boltStore) findIndexed(q trackQuery) ([]tracks, error) {
+	resTracks := []tracks{}
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var after []byte
+		if q.After != "" {
+			if after = lookupKey(tx, "tracks.id", q.After); after == nil {
+				after = lookupKey(tx, "tracks.legacy_id", q.After)
+			}
+			if after == nil {
+				return errNotFound
+			}
+		}
+
+		next, err := planScan(q).trackKeys(tx, q, after)
+		if err != nil {
+			return err
+		}
+		for key := next(); key != nil && (q.Limit == 0 || len(resTracks) < q.Limit); key = next() {
+			track := tracks{}
+			if err := json.Unmarshal(tx.Bucket(trackBucket).Get(key), &track); err != nil {
+				return err
+			}
+			if q.matches(track) {
+				resTracks = append(resTracks, track)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resTracks, nil
+}
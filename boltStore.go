@@ -0,0 +1,870 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	trackBucket   = []byte("tracks")
+	webhookBucket = []byte("webhooks")
+	counterBucket = []byte("counters")
+	fileBucket    = []byte("files") // one nested bucket per FileStore bucket
+	jobBucket     = []byte("jobs")  // keyed by job ID
+	taskBucket    = []byte("tasks")
+	lookupBucket  = []byte("lookups") // one nested bucket per looked up field
+	indexBucket   = []byte("indexes") // one nested bucket per indexed track field
+)
+
+// eachTrackBatch is the number of tracks read at once by EachTrack
+const eachTrackBatch = 100
+
+// boltStore keeps tracks and webhooks in a single local file,
+// so the service can run on a single node without network access
+// Documents are JSON encoded and keyed by a sequence number so they keep their insertion order
+// The fields of the tracks are indexed in buckets to seek the pages of the track list,
+// and their geometries in memory by R-trees of their keys, built when the file is opened
+type boltStore struct {
+	db *bolt.DB
+
+	geoMu    sync.RWMutex
+	geoIndex map[string]*rtree // by name of geoFields
+}
+
+// newBoltStore opens (or creates) the database file at path
+func newBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		// The files written before the lookups or the indexes existed are indexed once
+		indexed := tx.Bucket(lookupBucket) != nil
+		sorted := tx.Bucket(indexBucket) != nil
+		for _, name := range [][]byte{trackBucket, webhookBucket, counterBucket, fileBucket, jobBucket, taskBucket, lookupBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if !sorted {
+			if err := rebuildTrackIndexes(tx); err != nil {
+				return err
+			}
+		}
+		if indexed {
+			return nil
+		}
+		if err := rebuildLookups(tx, trackBucket, decodeTrackLookups); err != nil {
+			return err
+		}
+		if err := rebuildLookups(tx, webhookBucket, decodeWebhookLookups); err != nil {
+			return err
+		}
+		return rebuildLookups(tx, taskBucket, decodeTaskLookups)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	b := &boltStore{db: db}
+	if err = b.buildGeoIndex(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// Close releases the database file
+func (b *boltStore) Close(ctx context.Context) error {
+	return b.db.Close()
+}
+
+// itob returns the 8-byte big endian representation of v, used as key
+func itob(v uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, v)
+	return key
+}
+
+// *** LOOKUPS *** //
+
+// The unique fields of the documents are indexed in a nested bucket of lookupBucket per field,
+// from the value of the field to the key of the document, written in the same transaction as the document
+// so the duplicates are refused and the documents found without a scan
+
+// uniqueField is the value of a looked up field of a document
+type uniqueField struct {
+	name  string // name of the nested bucket, eg: "tracks.id"
+	value string // empty values are not indexed
+	err   error  // returned when the value is already taken, nil if the value can be shared
+}
+
+// trackLookups are the looked up fields of a track
+func trackLookups(track tracks) []uniqueField {
+	return []uniqueField{
+		{"tracks.id", track.UniqueID, errDuplicateID},
+		{"tracks.legacy_id", track.LegacyID, nil},
+		{"tracks.url", track.URL, nil},
+		{"tracks.hash", track.ContentHash, errDuplicateContent},
+	}
+}
+
+// webhookLookups are the looked up fields of a webhook
+func webhookLookups(webhook Webhook) []uniqueField {
+	return []uniqueField{
+		{"webhooks.id", webhook.WebhookID, errDuplicateID},
+		{"webhooks.legacy_id", webhook.LegacyID, nil},
+		{"webhooks.url", webhook.WebhookURL, nil},
+	}
+}
+
+// taskLookups are the looked up fields of a task
+func taskLookups(task compTask) []uniqueField {
+	return []uniqueField{{"tasks.id", task.TaskID, errDuplicateID}}
+}
+
+// lookupKey returns the key of the document with the value of the field, or nil
+func lookupKey(tx *bolt.Tx, name string, value string) []byte {
+	bkt := tx.Bucket(lookupBucket).Bucket([]byte(name))
+	if bkt == nil || value == "" {
+		return nil
+	}
+	return bkt.Get([]byte(value))
+}
+
+// putLookups indexes the fields of the document stored at key,
+// a value already indexed keeps pointing to the first document that had it, as a scan would find it
+func putLookups(tx *bolt.Tx, key []byte, fields []uniqueField) error {
+	for _, val := range fields {
+		if val.value == "" {
+			continue
+		}
+		bkt, err := tx.Bucket(lookupBucket).CreateBucketIfNotExists([]byte(val.name))
+		if err != nil {
+			return err
+		}
+		if bkt.Get([]byte(val.value)) != nil {
+			continue
+		}
+		if err := bkt.Put([]byte(val.value), key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteLookups removes the fields of the document stored at key
+func deleteLookups(tx *bolt.Tx, key []byte, fields []uniqueField) error {
+	for _, val := range fields {
+		bkt := tx.Bucket(lookupBucket).Bucket([]byte(val.name))
+		if bkt == nil || val.value == "" || !bytes.Equal(bkt.Get([]byte(val.value)), key) {
+			continue
+		}
+		if err := bkt.Delete([]byte(val.value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearLookups removes the nested buckets of the fields
+func clearLookups(tx *bolt.Tx, fields []uniqueField) error {
+	for _, val := range fields {
+		err := tx.Bucket(lookupBucket).DeleteBucket([]byte(val.name))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildLookups indexes again every document of the bucket, fields returns the looked up fields of a stored value
+func rebuildLookups(tx *bolt.Tx, bucket []byte, fields func(data []byte) ([]uniqueField, error)) error {
+	empty, err := fields([]byte("{}"))
+	if err != nil {
+		return err
+	}
+	if err := clearLookups(tx, empty); err != nil {
+		return err
+	}
+
+	return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+		docFields, err := fields(v)
+		if err != nil {
+			return err
+		}
+		return putLookups(tx, k, docFields)
+	})
+}
+
+// decodeTrackLookups, decodeWebhookLookups and decodeTaskLookups read the looked up fields of a stored value
+func decodeTrackLookups(data []byte) ([]uniqueField, error) {
+	track := tracks{}
+	err := json.Unmarshal(data, &track)
+	return trackLookups(track), err
+}
+
+func decodeWebhookLookups(data []byte) ([]uniqueField, error) {
+	webhook := Webhook{}
+	err := json.Unmarshal(data, &webhook)
+	return webhookLookups(webhook), err
+}
+
+func decodeTaskLookups(data []byte) ([]uniqueField, error) {
+	task := compTask{}
+	err := json.Unmarshal(data, &task)
+	return taskLookups(task), err
+}
+
+// getByLookup decodes in v the document of the bucket found by the first field with the value
+func (b *boltStore) getByLookup(bucket []byte, names []string, value string, v interface{}) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		for _, name := range names {
+			if key := lookupKey(tx, name, value); key != nil {
+				if data := tx.Bucket(bucket).Get(key); data != nil {
+					return json.Unmarshal(data, v)
+				}
+			}
+		}
+		return errNotFound
+	})
+}
+
+// insertUnique appends the JSON encoded value in the bucket and returns its key,
+// unless a unique field already has its value, then it returns the error of the field (like errDuplicateID)
+func (b *boltStore) insertUnique(bucket []byte, value interface{}, fields []uniqueField) (uint64, error) {
+	var seq uint64
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		seq, err = insertUniqueTx(tx, bucket, value, fields)
+		return err
+	})
+	return seq, err
+}
+
+// insertUniqueTx inserts like insertUnique inside the transaction tx
+func insertUniqueTx(tx *bolt.Tx, bucket []byte, value interface{}, fields []uniqueField) (uint64, error) {
+	for _, val := range fields {
+		if val.err != nil && lookupKey(tx, val.name, val.value) != nil {
+			return 0, val.err
+		}
+	}
+
+	bkt := tx.Bucket(bucket)
+	seq, err := bkt.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return 0, err
+	}
+	if err := bkt.Put(itob(seq), data); err != nil {
+		return 0, err
+	}
+	return seq, putLookups(tx, itob(seq), fields)
+}
+
+// *** TRACKS *** //
+
+func (b *boltStore) AddTrack(ctx context.Context, track tracks) error {
+	var seq uint64
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if seq, err = insertUniqueTx(tx, trackBucket, track, trackLookups(track)); err != nil {
+			return err
+		}
+		return putTrackIndexes(tx, itob(seq), track)
+	})
+	if err != nil {
+		return err
+	}
+
+	b.indexGeo(seq, track)
+	return nil
+}
+
+func (b *boltStore) GetTrack(ctx context.Context, id string) (tracks, error) {
+	track := tracks{}
+	err := b.getByLookup(trackBucket, []string{"tracks.id", "tracks.legacy_id"}, id, &track)
+	return track, err
+}
+
+func (b *boltStore) GetTrackByURL(ctx context.Context, url string) (tracks, error) {
+	track := tracks{}
+	err := b.getByLookup(trackBucket, []string{"tracks.url"}, url, &track)
+	return track, err
+}
+
+func (b *boltStore) GetTrackByHash(ctx context.Context, hash string) (tracks, error) {
+	track := tracks{}
+	err := b.getByLookup(trackBucket, []string{"tracks.hash"}, hash, &track)
+	return track, err
+}
+
+func (b *boltStore) GetAllTracks(ctx context.Context) ([]tracks, error) {
+	resTracks := []tracks{}
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(trackBucket).ForEach(func(k, v []byte) error {
+			track := tracks{}
+			if err := json.Unmarshal(v, &track); err != nil {
+				return err
+			}
+			resTracks = append(resTracks, track)
+			return nil
+		})
+	})
+
+	return resTracks, err
+}
+
+// EachTrack reads the tracks by batches, fn is called outside of the read transaction
+// so it can use the store, even to write in it
+func (b *boltStore) EachTrack(ctx context.Context, fn func(tracks) error) error {
+	var after []byte
+	for {
+		batch := []tracks{}
+		err := b.db.View(func(tx *bolt.Tx) error {
+			c := tx.Bucket(trackBucket).Cursor()
+			k, v := c.First()
+			if after != nil {
+				// The key of the last track of the previous batch, then the next one
+				if k, v = c.Seek(after); k != nil && bytes.Equal(k, after) {
+					k, v = c.Next()
+				}
+			}
+			for ; k != nil && len(batch) < eachTrackBatch; k, v = c.Next() {
+				track := tracks{}
+				if err := json.Unmarshal(v, &track); err != nil {
+					return err
+				}
+				batch = append(batch, track)
+				after = append([]byte{}, k...)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, val := range batch {
+			if err := fn(val); err != nil {
+				return err
+			}
+		}
+		if len(batch) < eachTrackBatch {
+			return nil
+		}
+	}
+}
+
+// FindTracks reads the tracks found in the R-tree for the spatial queries,
+// and seeks the page in the index of the sort field or of a filter otherwise
+func (b *boltStore) FindTracks(ctx context.Context, q trackQuery) ([]tracks, error) {
+	if q.BBox == nil && q.Near == nil {
+		return b.findIndexed(q)
+	}
+
+	box := q.BBox
+	if q.Near != nil {
+		bounds := q.Near.bounds()
+		box = &bounds
+	}
+	keys := []uint64{}
+	b.geoMu.RLock()
+	b.geoIndex[q.GeoOn].Search(*box, func(key uint64) { keys = append(keys, key) })
+	b.geoMu.RUnlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	// The candidates in the order they were added, the boxes are only around their geometry
+	candidates := []tracks{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(trackBucket)
+		for _, key := range keys {
+			data := bkt.Get(itob(key))
+			if data == nil {
+				continue
+			}
+			track := tracks{}
+			if err := json.Unmarshal(data, &track); err != nil {
+				return err
+			}
+			candidates = append(candidates, track)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return selectTracks(candidates, q)
+}
+
+// buildGeoIndex indexes the geometry of every track
+func (b *boltStore) buildGeoIndex() error {
+	b.geoMu.Lock()
+	b.geoIndex = map[string]*rtree{}
+	for _, field := range geoFields {
+		b.geoIndex[field] = &rtree{}
+	}
+	b.geoMu.Unlock()
+
+	return b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(trackBucket).ForEach(func(k, v []byte) error {
+			track := tracks{}
+			if err := json.Unmarshal(v, &track); err != nil {
+				return err
+			}
+			b.indexGeo(binary.BigEndian.Uint64(k), track)
+			return nil
+		})
+	})
+}
+
+// indexGeo adds the geometry of the track stored at key to the R-trees
+func (b *boltStore) indexGeo(key uint64, track tracks) {
+	if track.Geo == nil {
+		return
+	}
+	b.geoMu.Lock()
+	defer b.geoMu.Unlock()
+	for _, field := range geoFields {
+		b.geoIndex[field].Insert(track.Geo.bounds(field), key)
+	}
+}
+
+func (b *boltStore) CountTracks(ctx context.Context) (int64, error) {
+	var count int64
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		count = int64(tx.Bucket(trackBucket).Stats().KeyN)
+		return nil
+	})
+
+	return count, err
+}
+
+func (b *boltStore) DeleteAllTracks(ctx context.Context) (int64, error) {
+	var count int64
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		count = int64(tx.Bucket(trackBucket).Stats().KeyN)
+
+		if err := tx.DeleteBucket(trackBucket); err != nil {
+			return err
+		}
+		if err := clearLookups(tx, trackLookups(tracks{})); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket(trackBucket); err != nil {
+			return err
+		}
+		return rebuildTrackIndexes(tx)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, b.buildGeoIndex()
+}
+
+// *** WEBHOOKS *** //
+
+func (b *boltStore) AddWebhook(ctx context.Context, webhook Webhook) error {
+	_, err := b.insertUnique(webhookBucket, webhook, webhookLookups(webhook))
+	return err
+}
+
+// eachWebhook calls fn with the key and value of every webhook,
+// the iteration stops as soon as fn returns true
+func (b *boltStore) eachWebhook(tx *bolt.Tx, fn func(k []byte, webhook Webhook) (bool, error)) error {
+	c := tx.Bucket(webhookBucket).Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		webhook := Webhook{}
+		if err := json.Unmarshal(v, &webhook); err != nil {
+			return err
+		}
+		stop, err := fn(k, webhook)
+		if err != nil || stop {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *boltStore) UpdateWebhook(ctx context.Context, webhook Webhook) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		key := lookupKey(tx, "webhooks.url", webhook.WebhookURL)
+		if key == nil {
+			return errNotFound
+		}
+
+		val := Webhook{}
+		if err := json.Unmarshal(tx.Bucket(webhookBucket).Get(key), &val); err != nil {
+			return err
+		}
+		val.MinTriggerValue = webhook.MinTriggerValue
+		data, err := json.Marshal(val)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(webhookBucket).Put(key, data)
+	})
+}
+
+func (b *boltStore) GetWebhook(ctx context.Context, id string) (Webhook, error) {
+	webhook := Webhook{}
+	err := b.getByLookup(webhookBucket, []string{"webhooks.id", "webhooks.legacy_id"}, id, &webhook)
+	return webhook, err
+}
+
+func (b *boltStore) GetWebhookByURL(ctx context.Context, url string) (Webhook, error) {
+	webhook := Webhook{}
+	err := b.getByLookup(webhookBucket, []string{"webhooks.url"}, url, &webhook)
+	return webhook, err
+}
+
+func (b *boltStore) GetAllWebhooks(ctx context.Context) ([]Webhook, error) {
+	resWebhooks := []Webhook{}
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return b.eachWebhook(tx, func(k []byte, val Webhook) (bool, error) {
+			resWebhooks = append(resWebhooks, val)
+			return false, nil
+		})
+	})
+
+	return resWebhooks, err
+}
+
+func (b *boltStore) DeleteWebhook(ctx context.Context, id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		key := lookupKey(tx, "webhooks.id", id)
+		if key == nil {
+			key = lookupKey(tx, "webhooks.legacy_id", id)
+		}
+		if key == nil {
+			return errNotFound
+		}
+
+		// The key is only valid until the lookups are changed
+		key = append([]byte(nil), key...)
+		fields, err := decodeWebhookLookups(tx.Bucket(webhookBucket).Get(key))
+		if err != nil {
+			return err
+		}
+		if err := deleteLookups(tx, key, fields); err != nil {
+			return err
+		}
+		return tx.Bucket(webhookBucket).Delete(key)
+	})
+}
+
+// *** FILES *** //
+
+func (b *boltStore) PutFile(ctx context.Context, bucket string, id string, data []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.Bucket(fileBucket).CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return bkt.Put([]byte(id), data)
+	})
+}
+
+func (b *boltStore) GetFile(ctx context.Context, bucket string, id string) ([]byte, error) {
+	var data []byte
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(fileBucket).Bucket([]byte(bucket))
+		if bkt == nil {
+			return errNotFound
+		}
+		value := bkt.Get([]byte(id))
+		if value == nil {
+			return errNotFound
+		}
+		// The value is only valid during the transaction
+		data = append([]byte(nil), value...)
+		return nil
+	})
+
+	return data, err
+}
+
+func (b *boltStore) DeleteFile(ctx context.Context, bucket string, id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(fileBucket).Bucket([]byte(bucket))
+		if bkt == nil {
+			return nil
+		}
+		return bkt.Delete([]byte(id))
+	})
+}
+
+func (b *boltStore) DeleteFiles(ctx context.Context, bucket string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(fileBucket).DeleteBucket([]byte(bucket))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// *** JOBS *** //
+
+// Jobs are only looked up by ID, so they are keyed by it instead of a sequence number
+
+func (b *boltStore) AddJob(ctx context.Context, job ingestJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobBucket).Put([]byte(job.JobID), data)
+	})
+}
+
+func (b *boltStore) UpdateJob(ctx context.Context, job ingestJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(jobBucket)
+		if bkt.Get([]byte(job.JobID)) == nil {
+			return errNotFound
+		}
+		return bkt.Put([]byte(job.JobID), data)
+	})
+}
+
+func (b *boltStore) GetJob(ctx context.Context, id string) (ingestJob, error) {
+	resJob := ingestJob{}
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(jobBucket).Get([]byte(id))
+		if data == nil {
+			return errNotFound
+		}
+		return json.Unmarshal(data, &resJob)
+	})
+	return resJob, err
+}
+
+func (b *boltStore) GetPendingJobs(ctx context.Context) ([]ingestJob, error) {
+	resJobs := []ingestJob{}
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobBucket).ForEach(func(k, v []byte) error {
+			job := ingestJob{}
+			if err := json.Unmarshal(v, &job); err != nil {
+				return err
+			}
+			if !job.finished() {
+				resJobs = append(resJobs, job)
+			}
+			return nil
+		})
+	})
+	return resJobs, err
+}
+
+// *** TASKS *** //
+
+func (b *boltStore) AddTask(ctx context.Context, task compTask) error {
+	_, err := b.insertUnique(taskBucket, task, taskLookups(task))
+	return err
+}
+
+// eachTask calls fn with the key and value of every task,
+// the iteration stops as soon as fn returns true
+func (b *boltStore) eachTask(tx *bolt.Tx, fn func(k []byte, task compTask) (bool, error)) error {
+	c := tx.Bucket(taskBucket).Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		task := compTask{}
+		if err := json.Unmarshal(v, &task); err != nil {
+			return err
+		}
+		stop, err := fn(k, task)
+		if stop || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *boltStore) GetTask(ctx context.Context, id string) (compTask, error) {
+	task := compTask{}
+	err := b.getByLookup(taskBucket, []string{"tasks.id"}, id, &task)
+	return task, err
+}
+
+func (b *boltStore) UpdateTask(ctx context.Context, task compTask) error {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		key := lookupKey(tx, "tasks.id", task.TaskID)
+		if key == nil {
+			return errNotFound
+		}
+		return tx.Bucket(taskBucket).Put(key, data)
+	})
+}
+
+func (b *boltStore) GetAllTasks(ctx context.Context) ([]compTask, error) {
+	resTasks := []compTask{}
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return b.eachTask(tx, func(k []byte, val compTask) (bool, error) {
+			resTasks = append(resTasks, val)
+			return false, nil
+		})
+	})
+
+	return resTasks, err
+}
+
+func (b *boltStore) DeleteTask(ctx context.Context, id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		key := lookupKey(tx, "tasks.id", id)
+		if key == nil {
+			return errNotFound
+		}
+
+		// The key is only valid until the lookups are changed
+		key = append([]byte(nil), key...)
+		if err := deleteLookups(tx, key, taskLookups(compTask{TaskID: id})); err != nil {
+			return err
+		}
+		return tx.Bucket(taskBucket).Delete(key)
+	})
+}
+
+// *** IDS *** //
+
+// nextCounter increments the named counter inside the transaction
+func nextCounter(tx *bolt.Tx, name string) (int64, error) {
+	bkt := tx.Bucket(counterBucket)
+
+	var counter uint64
+	if data := bkt.Get([]byte(name)); data != nil {
+		counter = binary.BigEndian.Uint64(data)
+	}
+	counter++
+
+	return int64(counter), bkt.Put([]byte(name), itob(counter))
+}
+
+func (b *boltStore) NextCounter(ctx context.Context, name string) (int64, error) {
+	var counter int64
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		counter, err = nextCounter(tx, name)
+		return err
+	})
+
+	return counter, err
+}
+
+// migrateBucket rewrites the old random IDs of the documents in the bucket,
+// fix returns the new value of a document if it has to be migrated, or nil
+func migrateBucket(tx *bolt.Tx, bucket []byte, fix func(data []byte) ([]byte, error)) (int, error) {
+	bkt := tx.Bucket(bucket)
+	updates := map[string][]byte{}
+
+	err := bkt.ForEach(func(k, v []byte) error {
+		data, err := fix(v)
+		if data != nil {
+			updates[string(k)] = data
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// The values are changed after the iteration so the cursor stays valid
+	for k, data := range updates {
+		if err := bkt.Put([]byte(k), data); err != nil {
+			return 0, err
+		}
+	}
+	return len(updates), nil
+}
+
+func (b *boltStore) MigrateIDs(ctx context.Context) (int, error) {
+	migrated := 0
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		n, err := migrateBucket(tx, trackBucket, func(data []byte) ([]byte, error) {
+			track := tracks{}
+			if err := json.Unmarshal(data, &track); err != nil {
+				return nil, err
+			}
+			if track.LegacyID != "" || !isLegacyID(track.UniqueID) {
+				return nil, nil
+			}
+
+			counter, err := nextCounter(tx, "tracks")
+			if err != nil {
+				return nil, err
+			}
+			track.LegacyID = track.UniqueID
+			track.UniqueID = counterID(counter)
+			return json.Marshal(track)
+		})
+		if err != nil {
+			return err
+		}
+		migrated += n
+
+		n, err = migrateBucket(tx, webhookBucket, func(data []byte) ([]byte, error) {
+			webhook := Webhook{}
+			if err := json.Unmarshal(data, &webhook); err != nil {
+				return nil, err
+			}
+			if webhook.LegacyID != "" || !isLegacyID(webhook.WebhookID) {
+				return nil, nil
+			}
+
+			counter, err := nextCounter(tx, "webhooks")
+			if err != nil {
+				return nil, err
+			}
+			webhook.LegacyID = webhook.WebhookID
+			webhook.WebhookID = counterID(counter)
+			return json.Marshal(webhook)
+		})
+		if err != nil {
+			return err
+		}
+		migrated += n
+
+		// The lookups of the old IDs are replaced by the new IDs and the legacy IDs
+		if migrated == 0 {
+			return nil
+		}
+		if err := rebuildLookups(tx, trackBucket, decodeTrackLookups); err != nil {
+			return err
+		}
+		return rebuildLookups(tx, webhookBucket, decodeWebhookLookups)
+	})
+
+	return migrated, err
+}
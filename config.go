@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// *** CONFIGURATION *** //
+
+// duration is a time.Duration written as "10s" or "10m" in the config file
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// Config holds every setting of the service
+// The values are read from the config file in CONFIG_FILE (optional) and then from environment variables
+type Config struct {
+	Port           string   `json:"port"`            // PORT
+	Storage        string   `json:"storage"`         // STORAGE: mongodb, bolt or memory
+	DBURI          string   `json:"db_uri"`          // MONGODB_URI
+	DBName         string   `json:"db_name"`         // MONGODB_DB
+	DBTimeout      duration `json:"db_timeout"`      // DB_TIMEOUT, deadline of every database call
+	BoltPath       string   `json:"bolt_path"`       // BOLT_PATH
+	PageSize       int      `json:"page_size"`       // TICKER_PAGE_SIZE, max number of tracks returned by the ticker
+	WebhookTimeout duration `json:"webhook_timeout"` // WEBHOOK_TIMEOUT, how long to wait for a webhook to answer
+	FetchTimeout   duration `json:"fetch_timeout"`   // FETCH_TIMEOUT, how long to wait for an IGC file sent by URL
+	IngestWorkers  int      `json:"ingest_workers"`  // INGEST_WORKERS, number of IGC files fetched at the same time
+	StatsWindow    duration `json:"stats_window"`    // STATS_WINDOW, window of the max climb, sink and speed of a flight
+	ScoringRules   string   `json:"scoring_rules"`   // SCORING_RULES: a name of the rule sets, the default scoring system
+	ClockInterval  duration `json:"clock_interval"`  // CLOCK_INTERVAL, 0 disables the clock trigger inside the service
+	ShutdownWait   duration `json:"shutdown_wait"`   // SHUTDOWN_WAIT, how long to drain requests and webhooks on SIGTERM
+	AdminUser      string   `json:"admin_user"`      // ADMIN_USER
+	AdminPassword  string   `json:"admin_password"`  // ADMIN_PASSWORD, the admin API is open if no credentials are set
+	SitesFile      string   `json:"sites_file"`      // SITES_FILE, JSON file of the launch and landing sites
+
+	// SCORING_RULE_SETS, a JSON array: scoring systems added to xcontest and olc, or replacing them by name
+	ScoringRuleSets []scoringRules `json:"scoring_rule_sets"`
+}
+
+// defaultConfig returns the settings used when nothing else is configured
+func defaultConfig() Config {
+	return Config{
+		Port:           "8080",
+		Storage:        "mongodb",
+		DBName:         "igcfiles",
+		BoltPath:       "paragliding.db",
+		PageSize:       5,
+		IngestWorkers:  4,
+		DBTimeout:      duration(5 * time.Second),
+		WebhookTimeout: duration(10 * time.Second),
+		FetchTimeout:   duration(30 * time.Second),
+		StatsWindow:    duration(10 * time.Second),
+		ScoringRules:   "xcontest",
+		ShutdownWait:   duration(25 * time.Second),
+	}
+}
+
+// loadConfig reads the configuration and validates it
+func loadConfig() (Config, error) {
+	cfg := defaultConfig()
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return cfg, err
+		}
+		defer file.Close()
+
+		if err := json.NewDecoder(file).Decode(&cfg); err != nil {
+			return cfg, fmt.Errorf("reading %s: %s", path, err)
+		}
+	}
+
+	if err := cfg.readEnv(); err != nil {
+		return cfg, err
+	}
+
+	return cfg, cfg.validate()
+}
+
+// readEnv overrides the settings with the environment variables that are set
+func (cfg *Config) readEnv() error {
+	stringVars := map[string]*string{
+		"PORT":           &cfg.Port,
+		"STORAGE":        &cfg.Storage,
+		"MONGODB_URI":    &cfg.DBURI,
+		"MONGODB_DB":     &cfg.DBName,
+		"BOLT_PATH":      &cfg.BoltPath,
+		"SCORING_RULES":  &cfg.ScoringRules,
+		"ADMIN_USER":     &cfg.AdminUser,
+		"ADMIN_PASSWORD": &cfg.AdminPassword,
+		"SITES_FILE":     &cfg.SitesFile,
+	}
+	for name, val := range stringVars {
+		if env, ok := os.LookupEnv(name); ok {
+			*val = env
+		}
+	}
+
+	intVars := map[string]*int{
+		"TICKER_PAGE_SIZE": &cfg.PageSize,
+		"INGEST_WORKERS":   &cfg.IngestWorkers,
+	}
+	for name, val := range intVars {
+		if env, ok := os.LookupEnv(name); ok {
+			parsed, err := strconv.Atoi(env)
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+			*val = parsed
+		}
+	}
+
+	if env, ok := os.LookupEnv("SCORING_RULE_SETS"); ok {
+		cfg.ScoringRuleSets = nil
+		if err := json.Unmarshal([]byte(env), &cfg.ScoringRuleSets); err != nil {
+			return fmt.Errorf("SCORING_RULE_SETS: %s", err)
+		}
+	}
+
+	durationVars := map[string]*duration{
+		"DB_TIMEOUT":      &cfg.DBTimeout,
+		"WEBHOOK_TIMEOUT": &cfg.WebhookTimeout,
+		"FETCH_TIMEOUT":   &cfg.FetchTimeout,
+		"STATS_WINDOW":    &cfg.StatsWindow,
+		"CLOCK_INTERVAL":  &cfg.ClockInterval,
+		"SHUTDOWN_WAIT":   &cfg.ShutdownWait,
+	}
+	for name, val := range durationVars {
+		if env, ok := os.LookupEnv(name); ok {
+			parsed, err := time.ParseDuration(env)
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+			*val = duration(parsed)
+		}
+	}
+
+	return nil
+}
+
+// validate checks that the service can start with these settings
+func (cfg Config) validate() error {
+	if _, err := strconv.Atoi(cfg.Port); err != nil {
+		return fmt.Errorf("invalid port %q", cfg.Port)
+	}
+
+	switch cfg.Storage {
+	case "mongodb":
+		if cfg.DBURI == "" {
+			return fmt.Errorf("MONGODB_URI is required with the mongodb storage")
+		}
+		if cfg.DBName == "" {
+			return fmt.Errorf("MONGODB_DB is required with the mongodb storage")
+		}
+	case "bolt":
+		if cfg.BoltPath == "" {
+			return fmt.Errorf("BOLT_PATH is required with the bolt storage")
+		}
+	case "memory":
+	default:
+		return fmt.Errorf("unknown storage %q", cfg.Storage)
+	}
+
+	if cfg.PageSize < 1 {
+		return fmt.Errorf("page size must be at least 1, got %d", cfg.PageSize)
+	}
+	if cfg.IngestWorkers < 1 {
+		return fmt.Errorf("ingest workers must be at least 1, got %d", cfg.IngestWorkers)
+	}
+	if cfg.DBTimeout <= 0 || cfg.WebhookTimeout <= 0 || cfg.FetchTimeout <= 0 || cfg.ShutdownWait <= 0 {
+		return fmt.Errorf("database, webhook, fetch and shutdown timeouts must be positive")
+	}
+	if cfg.StatsWindow < duration(time.Second) {
+		return fmt.Errorf("stats window must be at least 1s")
+	}
+	for _, val := range cfg.ScoringRuleSets {
+		if val.Name == "" {
+			return fmt.Errorf("every scoring rule set needs a name")
+		}
+		if err := val.validate(); err != nil {
+			return fmt.Errorf("scoring rules %s: %s", val.Name, err)
+		}
+	}
+	if _, ok := cfg.ruleSets()[cfg.ScoringRules]; !ok {
+		return fmt.Errorf("unknown scoring rules %q", cfg.ScoringRules)
+	}
+	if cfg.ClockInterval < 0 {
+		return fmt.Errorf("clock interval can't be negative")
+	}
+	if (cfg.AdminUser == "") != (cfg.AdminPassword == "") {
+		return fmt.Errorf("ADMIN_USER and ADMIN_PASSWORD must be set together")
+	}
+
+	return nil
+}
+
+// ruleSets returns the built-in scoring systems with the configured ones, by name
+func (cfg Config) ruleSets() map[string]scoringRules {
+	sets := map[string]scoringRules{}
+	for name, val := range scoringRuleSets {
+		sets[name] = val
+	}
+	for _, val := range cfg.ScoringRuleSets {
+		sets[val.Name] = val
+	}
+	return sets
+}
+
+// redacted returns a copy of the settings that is safe to show, without passwords
+func (cfg Config) redacted() Config {
+	if cfg.DBURI != "" {
+		u, err := url.Parse(cfg.DBURI)
+		if err != nil {
+			cfg.DBURI = "REDACTED"
+		} else if _, hasPassword := u.User.Password(); hasPassword {
+			u.User = url.UserPassword(u.User.Username(), "REDACTED")
+			cfg.DBURI = u.String()
+		}
+	}
+	if cfg.AdminPassword != "" {
+		cfg.AdminPassword = "REDACTED"
+	}
+	return cfg
+}
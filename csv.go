@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// *** CSV EXPORT *** //
+
+const csvContentType = "text/csv"
+
+// catalogueColumns are the metadata columns of the track catalogue, the statistics come after them
+var catalogueColumns = []string{"id", "pilot", "glider", "glider_id", "H_date", "length", "track_src_url", "file_name", "time_recorded"}
+
+// statsColumns are the statistics of the track catalogue, named as in statsField
+var statsColumns = []string{"takeoff", "landing", "airtime", "max_gnss_altitude", "min_gnss_altitude",
+	"max_pressure_altitude", "min_pressure_altitude", "altitude_gain", "max_climb", "max_sink",
+	"avg_speed", "max_speed", "distance", "circling_percent", "avg_thermal_climb", "flights"}
+
+// fixColumns are the columns of the fixes of a track
+var fixColumns = []string{"time", "lat", "lon", "pressure_altitude", "gnss_altitude", "ground"}
+
+// catalogueRow returns the metadata and the stored statistics of the track
+// The statistics are left empty for the tracks added before they were kept, the fixes are not read while streaming
+func catalogueRow(track tracks) []string {
+	row := []string{track.UniqueID, track.Pilot, track.Glider, track.GliderID, track.Hdate,
+		FloatToString(track.TrackLength), track.URL, track.FileName, track.TimeRecorded.UTC().Format(time.RFC3339)}
+
+	if track.Stats.Takeoff.IsZero() {
+		return append(row, make([]string, len(statsColumns))...)
+	}
+	for _, field := range statsColumns {
+		value, _ := statsField(track.Stats, field)
+		row = append(row, value)
+	}
+	return row
+}
+
+// writeCatalogueCSV sends one row for every track of the query, with the Link header of the next page like the track list
+// Without any filter, sort or page every track is streamed from the store,
+// an error once the rows are sent can't change the status, the export is cut and the error logged
+func (s *server) writeCatalogueCSV(w http.ResponseWriter, r *http.Request, q trackQuery) {
+	query := r.URL.Query()
+	query.Del("format")
+	if len(query) > 0 {
+		resTracks, ok := s.findPage(w, r, q)
+		if !ok {
+			return
+		}
+		cw := startCatalogueCSV(w)
+		for _, val := range resTracks {
+			cw.Write(catalogueRow(val))
+		}
+		cw.Flush()
+		return
+	}
+
+	cw := startCatalogueCSV(w)
+
+	err := s.tracks.EachTrack(r.Context(), func(track tracks) error {
+		cw.Write(catalogueRow(track))
+		return cw.Error()
+	})
+	cw.Flush()
+	if err != nil {
+		log.Printf("CSV export of the tracks: %s", err)
+	}
+}
+
+// startCatalogueCSV sets the headers of the catalogue and writes its first row
+func startCatalogueCSV(w http.ResponseWriter) *csv.Writer {
+	w.Header().Set("Content-Type", csvContentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="tracks.csv"`)
+
+	cw := csv.NewWriter(w)
+	cw.Write(append(append([]string{}, catalogueColumns...), statsColumns...))
+	return cw
+}
+
+// writeFixesCSV writes one row for every fix of the track
+func writeFixesCSV(w io.Writer, track tracks, fixes []fix) error {
+	cw := csv.NewWriter(w)
+	cw.Write(fixColumns)
+	for _, val := range fixes {
+		cw.Write([]string{
+			val.Time.UTC().Format(time.RFC3339),
+			strconv.FormatFloat(val.Lat, 'f', -1, 64),
+			strconv.FormatFloat(val.Lon, 'f', -1, 64),
+			strconv.FormatInt(val.PressureAltitude, 10),
+			strconv.FormatInt(val.GNSSAltitude, 10),
+			strconv.FormatBool(val.Ground),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// brokenFileStore fails to read every file
+type brokenFileStore struct {
+	FileStore
+}
+
+func (brokenFileStore) GetFile(ctx context.Context, bucket, id string) ([]byte, error) {
+	return nil, errors.New("disk failure")
+}
+
+func Test_handlerTrack_CSV(t *testing.T) {
+
+	s := newTestServer()
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+
+	ids := []string{postTrackFile(t, ts, "sample.igc"), postTrackFile(t, ts, "sample.gpx")}
+
+	// A track added before the statistics were kept has none, the files are not read to compute them
+	s.tracks.AddTrack(context.Background(), tracks{UniqueID: "5", Pilot: "Old pilot", TimeRecorded: time.Now()})
+	s.files = brokenFileStore{s.files}
+
+	resp, _ := http.Get(ts.URL + "/paragliding/api/track?format=csv")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, csvContentType, resp.Header.Get("Content-Type"))
+
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	if !assert.Nil(t, err) || !assert.Len(t, rows, 4) {
+		return
+	}
+	assert.Equal(t, "id", rows[0][0])
+	assert.Equal(t, "flights", rows[0][len(rows[0])-1])
+	assert.Equal(t, []string{ids[0], "Jane Doe", "Ozone Rush 5", "OZ-1234"}, rows[1][:4])
+	assert.Equal(t, []string{ids[1], "John Smith"}, rows[2][:2])
+	assert.Equal(t, "2018-07-02T10:00:00Z", rows[1][len(catalogueColumns)])
+	assert.Equal(t, "Old pilot", rows[3][1])
+	assert.Equal(t, "", rows[3][len(catalogueColumns)])
+
+	// The filters, sort and pages of the list apply to the catalogue
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track?format=csv&pilot=John+Smith")
+	rows, _ = csv.NewReader(resp.Body).ReadAll()
+	if assert.Len(t, rows, 2) {
+		assert.Equal(t, ids[1], rows[1][0])
+	}
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track?format=csv&sort=-id&limit=1")
+	rows, _ = csv.NewReader(resp.Body).ReadAll()
+	if assert.Len(t, rows, 2) {
+		assert.Equal(t, "5", rows[1][0])
+	}
+	assert.Equal(t, `</paragliding/api/track?after=5&format=csv&limit=1&sort=-id>; rel="next"`, resp.Header.Get("Link"))
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track?format=csv&sort=url")
+	assert.Equal(t, 400, resp.StatusCode)
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track?format=xml")
+	assert.Equal(t, 400, resp.StatusCode)
+
+	// The JSON list of IDs is unchanged
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track?format=json")
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, idList(ids[0], ids[1], "5"), string(body))
+}
+
+func Test_handlerExport_CSV(t *testing.T) {
+
+	s := newTestServer()
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+
+	trackID := postTrackFile(t, ts, "sample.igc")
+
+	resp, _ := http.Get(ts.URL + "/paragliding/api/track/" + trackID + ".csv")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, csvContentType, resp.Header.Get("Content-Type"))
+
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	if assert.Nil(t, err) && assert.Len(t, rows, 7) {
+		assert.Equal(t, fixColumns, rows[0])
+		assert.Equal(t, "2018-07-02T10:00:00Z", rows[1][0])
+		assert.Equal(t, []string{"1200", "1250"}, rows[1][3:5])
+	}
+}
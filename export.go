@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// *** TRACK EXPORT *** //
+
+// trackExporter writes a track in a file format
+type trackExporter struct {
+	contentType string
+	write       func(w io.Writer, track tracks, fixes []fix) error
+}
+
+// trackExporters are the export formats, by file extension
+var trackExporters = map[string]trackExporter{
+	"csv":     {contentType: csvContentType, write: writeFixesCSV},
+	"geojson": {contentType: geoJSONContentType, write: writeGeoJSON},
+	"gpx":     {contentType: gpxContentType, write: writeGPX},
+	"kml":     {contentType: kmlContentType, write: writeKML},
+	"kmz":     {contentType: kmzContentType, write: writeKMZ},
+}
+
+// acceptedExport returns the export format asked for in the Accept header, if any
+func acceptedExport(r *http.Request) (string, bool) {
+	for _, val := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(val))
+		if err != nil {
+			continue
+		}
+		for format, exporter := range trackExporters {
+			if exporter.contentType == mediaType {
+				return format, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Handles path: GET /api/track/<id>.<format>
+// Returns the track in the format of the extension
+func (s *server) handlerExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "501 - Method not implemented", http.StatusNotImplemented)
+		return
+	}
+	s.exportTrack(w, r, mux.Vars(r)["format"])
+}
+
+// exportTrack sends the track with the ID in the URL in the given format
+func (s *server) exportTrack(w http.ResponseWriter, r *http.Request, format string) {
+	exporter, ok := trackExporters[format]
+	if !ok {
+		http.Error(w, "404 - Unknown export format "+format, http.StatusNotFound)
+		return
+	}
+
+	track, fixes, ok := s.requestFixes(w, r)
+	if !ok {
+		return
+	}
+
+	// Written to a buffer first, so an error is still sent as an error and not as a broken file
+	buf := &bytes.Buffer{}
+	if err := exporter.write(buf, track, fixes); err != nil {
+		serverError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", exporter.contentType)
+	buf.WriteTo(w)
+}
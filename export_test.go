@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_exportTrack_Error(t *testing.T) {
+
+	s := newTestServer()
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+
+	// An exporter that fails halfway through the file
+	trackExporters["broken"] = trackExporter{contentType: "text/plain", write: func(w io.Writer, track tracks, fixes []fix) error {
+		fmt.Fprint(w, "first half")
+		return fmt.Errorf("no second half")
+	}}
+	defer delete(trackExporters, "broken")
+
+	trackID := postTrackFile(t, ts, "sample.igc")
+
+	resp, _ := http.Get(ts.URL + "/paragliding/api/track/" + trackID + ".broken")
+	assert.Equal(t, 500, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.NotContains(t, string(body), "first half")
+}
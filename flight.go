@@ -0,0 +1,123 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// *** TAKEOFF AND LANDING DETECTION *** //
+
+const (
+	// detectionWindow is the time around each fix used to tell if the glider is flying
+	detectionWindow = 30 * time.Second
+	// flyingSpeed is the ground speed, in km/h, above which the glider is flying
+	flyingSpeed = 10.0
+	// flyingAltitudeDeviation is the standard deviation of the altitude, in m, above which
+	// the glider is flying even without moving, like when soaring a ridge in strong wind
+	flyingAltitudeDeviation = 5.0
+	// minFlight is the shortest flight kept, shorter ones are noise on the ground
+	minFlight = time.Minute
+	// minGround is the shortest stop on the ground between two flights, shorter ones are noise in the air
+	minGround = time.Minute
+)
+
+// flightSegment is a flight in a track, from the fix Start to the fix End included
+type flightSegment struct {
+	Start int
+	End   int
+}
+
+// isFlying tells if the glider is flying at the fix i, from the ground speed and
+// the altitude deviation of the fixes around it
+func isFlying(fixes []fix, i int) bool {
+	lo, hi := i, i
+	for lo > 0 && (lo == i || fixes[i].Time.Sub(fixes[lo-1].Time) <= detectionWindow/2) {
+		lo--
+	}
+	for hi < len(fixes)-1 && (hi == i || fixes[hi+1].Time.Sub(fixes[i].Time) <= detectionWindow/2) {
+		hi++
+	}
+
+	if hours := fixes[hi].Time.Sub(fixes[lo].Time).Hours(); hours > 0 {
+		if fixDistance(fixes[lo], fixes[hi])/hours > flyingSpeed {
+			return true
+		}
+	}
+
+	// The pressure altitude is less noisy than the GNSS altitude on the ground
+	useGNSS := fixes[i].PressureAltitude == 0
+	mean := 0.0
+	for j := lo; j <= hi; j++ {
+		mean += float64(fixAltitude(fixes[j], useGNSS))
+	}
+	mean /= float64(hi - lo + 1)
+	variance := 0.0
+	for j := lo; j <= hi; j++ {
+		variance += math.Pow(float64(fixAltitude(fixes[j], useGNSS))-mean, 2)
+	}
+	variance /= float64(hi - lo + 1)
+
+	return math.Sqrt(variance) > flyingAltitudeDeviation
+}
+
+// detectFlights returns the flights in the fixes, in order
+// If no flight is found, the logger probably only recorded in the air, and the whole track is one flight
+func detectFlights(fixes []fix) []flightSegment {
+	if len(fixes) == 0 {
+		return nil
+	}
+
+	// Runs of flying fixes, joined when the stop between them is too short
+	runs := []flightSegment{}
+	for i := range fixes {
+		if !isFlying(fixes, i) {
+			continue
+		}
+		last := len(runs) - 1
+		if last >= 0 && fixes[i].Time.Sub(fixes[runs[last].End].Time) < minGround {
+			runs[last].End = i
+		} else {
+			runs = append(runs, flightSegment{Start: i, End: i})
+		}
+	}
+
+	flights := []flightSegment{}
+	for _, val := range runs {
+		if fixes[val.End].Time.Sub(fixes[val.Start].Time) >= minFlight {
+			flights = append(flights, val)
+		}
+	}
+
+	if len(flights) == 0 {
+		return []flightSegment{{Start: 0, End: len(fixes) - 1}}
+	}
+	return flights
+}
+
+// flagGround marks the fixes that are not part of a flight
+func flagGround(fixes []fix) {
+	for i := range fixes {
+		fixes[i].Ground = true
+	}
+	for _, val := range detectFlights(fixes) {
+		for i := val.Start; i <= val.End; i++ {
+			fixes[i].Ground = false
+		}
+	}
+}
+
+// flagged returns the flights marked in the fixes by flagGround
+func flagged(fixes []fix) []flightSegment {
+	flights := []flightSegment{}
+	for i, val := range fixes {
+		if val.Ground {
+			continue
+		}
+		if i > 0 && !fixes[i-1].Ground {
+			flights[len(flights)-1].End = i
+		} else {
+			flights = append(flights, flightSegment{Start: i, End: i})
+		}
+	}
+	return flights
+}
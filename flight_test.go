@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// leg is a part of a simulated track, at a constant ground speed in km/h
+type leg struct {
+	minutes int
+	speed   float64
+}
+
+// simulatedFixes returns a fix every 10 seconds, moving north at the speed of each leg
+func simulatedFixes(start time.Time, legs []leg) []fix {
+	fixes := []fix{}
+	t, lat := start, 45.0
+	for _, leg := range legs {
+		for i := 0; i < leg.minutes*6; i++ {
+			fixes = append(fixes, fix{Time: t, Lat: lat, Lon: 6.0, PressureAltitude: 1000, GNSSAltitude: 1000})
+			t = t.Add(10 * time.Second)
+			// One degree of latitude is about 111 km
+			lat += leg.speed / 360 / 111
+		}
+	}
+	return fixes
+}
+
+func Test_detectFlights(t *testing.T) {
+	start := time.Date(2018, 7, 2, 10, 0, 0, 0, time.UTC)
+
+	// On launch, a first flight, a relaunch, and packing in the landing field
+	fixes := simulatedFixes(start, []leg{{5, 0}, {10, 30}, {5, 0}, {5, 30}, {3, 0}})
+
+	flights := detectFlights(fixes)
+	if assert.Len(t, flights, 2) {
+		assert.InDelta(t, 5*time.Minute, fixes[flights[0].Start].Time.Sub(start), float64(30*time.Second))
+		assert.InDelta(t, 15*time.Minute, fixes[flights[0].End].Time.Sub(start), float64(30*time.Second))
+		assert.InDelta(t, 20*time.Minute, fixes[flights[1].Start].Time.Sub(start), float64(30*time.Second))
+	}
+
+	flagGround(fixes)
+	assert.True(t, fixes[0].Ground)
+	assert.False(t, fixes[len(fixes)/3].Ground)
+
+	stats := computeStats(fixes, 10*time.Second)
+	assert.Len(t, stats.Flights, 2)
+	// 10 and 5 minutes at 30 km/h, without the time on the ground
+	assert.InDelta(t, 7.5, stats.Distance, 0.3)
+	assert.InDelta(t, 15*60, stats.Airtime, 60)
+	assert.InDelta(t, 30, stats.AvgSpeed, 2)
+}
+
+func Test_detectFlights_Soaring(t *testing.T) {
+	start := time.Date(2018, 7, 2, 10, 0, 0, 0, time.UTC)
+
+	// Hanging in front of a ridge in strong wind, not moving but going up and down
+	fixes := simulatedFixes(start, []leg{{5, 0}})
+	for i := range fixes {
+		fixes[i].PressureAltitude += int64(i%12) * 5
+	}
+
+	flights := detectFlights(fixes)
+	if assert.Len(t, flights, 1) {
+		assert.Equal(t, 0, flights[0].Start)
+	}
+}
+
+func Test_detectFlights_NoFlight(t *testing.T) {
+	// Too short to tell, the whole track is kept
+	fixes := simulatedFixes(time.Now(), []leg{{1, 0}})
+
+	assert.Equal(t, []flightSegment{{Start: 0, End: len(fixes) - 1}}, detectFlights(fixes))
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// *** GAP COMPETITION SCORING *** //
+
+// gapParams are the nominal values of a task day, they set how much the day is worth
+// and how its points are shared between distance, time, leading and arrival
+type gapParams struct {
+	NominalDistance float64  `json:"nominal_distance"` // in km, the distance most pilots should fly
+	MinimumDistance float64  `json:"minimum_distance"` // in km, every pilot is scored at least this distance
+	NominalTime     duration `json:"nominal_time"`     // speed section time of the winner on a good day
+	NominalGoal     float64  `json:"nominal_goal"`     // share of the pilots expected in goal
+	LeadingRatio    float64  `json:"leading_ratio"`    // share of the points not given for distance that go to leading, 0 disables them
+	ArrivalRatio    float64  `json:"arrival_ratio"`    // share of the points not given for distance that go to arrival, 0 disables them
+}
+
+// defaultGAP returns the parameters used when a task doesn't set them
+// The leading and arrival ratios are the 1.4/8 and 1/8 of the hang gliding GAP
+func defaultGAP() gapParams {
+	return gapParams{
+		NominalDistance: 35,
+		MinimumDistance: 5,
+		NominalTime:     duration(90 * time.Minute),
+		NominalGoal:     0.2,
+		LeadingRatio:    1.4 / 8,
+		ArrivalRatio:    1.0 / 8,
+	}
+}
+
+// checkGAP validates the parameters of a task
+func checkGAP(p gapParams) error {
+	if p.MinimumDistance < 0 || p.NominalDistance <= p.MinimumDistance {
+		return fmt.Errorf("the nominal distance must be above the minimum distance")
+	}
+	if p.NominalTime <= 0 {
+		return fmt.Errorf("the nominal time must be positive")
+	}
+	if p.NominalGoal <= 0 || p.NominalGoal > 1 {
+		return fmt.Errorf("the nominal goal must be between 0 and 1")
+	}
+	if p.LeadingRatio < 0 || p.ArrivalRatio < 0 || p.LeadingRatio+p.ArrivalRatio > 1 {
+		return fmt.Errorf("the leading and arrival ratios must be positive and add up to 1 at most")
+	}
+	return nil
+}
+
+// pilotFlight is the track of one pilot of the day, validated against the task
+type pilotFlight struct {
+	Track  tracks
+	Fixes  []fix
+	Result taskResult
+}
+
+// pilotScore is the line of a pilot in the results, points are rounded to one decimal
+type pilotScore struct {
+	Rank             int     `json:"rank"`
+	TrackID          string  `json:"track_id"`
+	Pilot            string  `json:"pilot"`
+	Glider           string  `json:"glider"`
+	Distance         float64 `json:"distance"` // in km
+	Goal             bool    `json:"goal"`
+	SpeedSectionTime int64   `json:"speed_section_time,omitempty"` // in seconds
+	DistancePoints   float64 `json:"distance_points"`
+	TimePoints       float64 `json:"time_points"`
+	LeadingPoints    float64 `json:"leading_points"`
+	ArrivalPoints    float64 `json:"arrival_points"`
+	Total            float64 `json:"total"`
+}
+
+// dayResults are the results of a task day, with the figures the points come from
+type dayResults struct {
+	TaskID          string       `json:"task_id"`
+	TaskDistance    float64      `json:"task_distance"` // in km through the centers of the turnpoints
+	Pilots          int          `json:"pilots"`
+	PilotsInGoal    int          `json:"pilots_in_goal"`
+	BestDistance    float64      `json:"best_distance"`
+	DayQuality      float64      `json:"day_quality"` // distance validity times time validity
+	AvailablePoints float64      `json:"available_points"`
+	DistanceWeight  float64      `json:"distance_weight"`
+	TimeWeight      float64      `json:"time_weight"`
+	LeadingWeight   float64      `json:"leading_weight"`
+	ArrivalWeight   float64      `json:"arrival_weight"`
+	Results         []pilotScore `json:"results"`
+}
+
+// nextTurnpoint returns the first turnpoint not reached yet at the given time
+func nextTurnpoint(result taskResult, at time.Time) int {
+	for key, val := range result.Turnpoints {
+		if !val.Reached || val.Time.After(at) {
+			return key
+		}
+	}
+	return len(result.Turnpoints)
+}
+
+// leadingCoefficient is the area under the shortest distance left to the ESS over time, from the start
+// of the pilot to the ESS, or to the end of the day for pilots who landed before it
+// Pilots who lead the gaggle leave it behind them early, and get a smaller coefficient
+func leadingCoefficient(t compTask, flight pilotFlight, end time.Time) float64 {
+	sss, ess := t.turnpointIndex(tpSSS), t.essIndex()
+	speedSection := t.routeDistance(sss, ess)
+	if flight.Result.StartTime == nil || speedSection == 0 {
+		return 0
+	}
+	start := *flight.Result.StartTime
+
+	bestLeft := speedSection
+	last := start
+	area := 0.0
+	for _, val := range flight.Fixes {
+		if val.Ground || val.Time.Before(start) {
+			continue
+		}
+		if flight.Result.ESSTime != nil && val.Time.After(*flight.Result.ESSTime) {
+			break
+		}
+		area += val.Time.Sub(last).Seconds() * bestLeft * bestLeft
+		bestLeft = math.Min(bestLeft, t.distanceLeft(val, nextTurnpoint(flight.Result, val.Time), ess))
+		last = val.Time
+	}
+	if flight.Result.ESSTime == nil && end.After(last) {
+		area += end.Sub(last).Seconds() * bestLeft * bestLeft
+	}
+	return area / (1800 * speedSection * speedSection)
+}
+
+// roundPoints rounds the points to one decimal
+func roundPoints(points float64) float64 {
+	return math.Round(points*10) / 10
+}
+
+// scoreDay computes the GAP results of the pilots who flew the task
+// The day is worth 1000 points times its quality, shared between distance, time, leading and arrival
+// by weights that depend on the number of pilots in goal. Only the pilots in goal get time and arrival points
+func scoreDay(t compTask, flights []pilotFlight) dayResults {
+	// Tasks created before the scoring have no parameters
+	p := t.GAP
+	if p == (gapParams{}) {
+		p = defaultGAP()
+	}
+	day := dayResults{TaskID: t.TaskID, TaskDistance: t.routeDistance(0, len(t.Turnpoints)-1), Pilots: len(flights), Results: []pilotScore{}}
+	if len(flights) == 0 {
+		return day
+	}
+
+	distances := make([]float64, len(flights))
+	bestTime := int64(0)
+	var end time.Time
+	for key, val := range flights {
+		distances[key] = math.Max(val.Result.Distance, p.MinimumDistance)
+		day.BestDistance = math.Max(day.BestDistance, distances[key])
+		if val.Result.Goal {
+			day.PilotsInGoal++
+			if bestTime == 0 || val.Result.SpeedSectionTime < bestTime {
+				bestTime = val.Result.SpeedSectionTime
+			}
+		}
+		if val.Result.ESSTime != nil && val.Result.ESSTime.After(end) {
+			end = *val.Result.ESSTime
+		}
+		if n := len(val.Fixes); n > 0 && val.Fixes[n-1].Time.After(end) {
+			end = val.Fixes[n-1].Time
+		}
+	}
+
+	// Distance validity: how far the pilots flew compared to the nominal distance
+	sumDistance := 0.0
+	for _, val := range distances {
+		sumDistance += val - p.MinimumDistance
+	}
+	nominalArea := ((p.NominalGoal+1)*(p.NominalDistance-p.MinimumDistance) + math.Max(0, p.NominalGoal*(day.BestDistance-p.NominalDistance))) / 2
+	distanceValidity := math.Min(1, sumDistance/(float64(len(flights))*nominalArea))
+
+	// Time validity: how long the winner flew compared to the nominal time
+	x := day.BestDistance / p.NominalDistance
+	if day.PilotsInGoal > 0 {
+		x = float64(bestTime) / time.Duration(p.NominalTime).Seconds()
+	}
+	x = math.Min(1, x)
+	timeValidity := math.Max(0, math.Min(1, -0.271+2.912*x-2.098*x*x+0.457*x*x*x))
+
+	day.DayQuality = distanceValidity * timeValidity
+	day.AvailablePoints = 1000 * day.DayQuality
+
+	// Weights: the more pilots in goal, the less the distance is worth
+	if day.PilotsInGoal > 0 {
+		gr := float64(day.PilotsInGoal) / float64(len(flights))
+		day.DistanceWeight = 0.9 - 1.665*gr + 1.713*gr*gr - 0.587*gr*gr*gr
+		day.LeadingWeight = (1 - day.DistanceWeight) * p.LeadingRatio
+		day.ArrivalWeight = (1 - day.DistanceWeight) * p.ArrivalRatio
+		day.TimeWeight = 1 - day.DistanceWeight - day.LeadingWeight - day.ArrivalWeight
+	} else {
+		if p.LeadingRatio > 0 && day.TaskDistance > 0 {
+			day.LeadingWeight = day.BestDistance / day.TaskDistance * 0.1
+		}
+		day.DistanceWeight = 1 - day.LeadingWeight
+	}
+
+	leading := make([]float64, len(flights))
+	minLeading := 0.0
+	for key, val := range flights {
+		leading[key] = leadingCoefficient(t, val, end)
+		if val.Result.StartTime != nil && (minLeading == 0 || leading[key] < minLeading) {
+			minLeading = leading[key]
+		}
+	}
+
+	// The pilots in goal in the order they reached the ESS
+	arrivals := []int{}
+	for key, val := range flights {
+		if val.Result.Goal {
+			arrivals = append(arrivals, key)
+		}
+	}
+	sort.SliceStable(arrivals, func(i, j int) bool {
+		return flights[arrivals[i]].Result.ESSTime.Before(*flights[arrivals[j]].Result.ESSTime)
+	})
+	arrivalRank := map[int]int{}
+	for rank, key := range arrivals {
+		arrivalRank[key] = rank
+	}
+
+	for key, val := range flights {
+		score := pilotScore{
+			TrackID:  val.Track.UniqueID,
+			Pilot:    val.Track.Pilot,
+			Glider:   val.Track.Glider,
+			Distance: val.Result.Distance,
+			Goal:     val.Result.Goal,
+		}
+
+		// No distance points when no pilot left the takeoff, with a minimum distance of 0
+		if day.BestDistance > 0 {
+			score.DistancePoints = distances[key] / day.BestDistance * day.DistanceWeight * day.AvailablePoints
+		}
+
+		if val.Result.Goal {
+			score.SpeedSectionTime = val.Result.SpeedSectionTime
+
+			hours, bestHours := float64(val.Result.SpeedSectionTime)/3600, float64(bestTime)/3600
+			speedFraction := 1.0
+			if bestHours > 0 {
+				speedFraction = math.Max(0, 1-math.Pow((hours-bestHours)/math.Sqrt(bestHours), 5.0/6))
+			}
+			score.TimePoints = speedFraction * day.TimeWeight * day.AvailablePoints
+
+			ac := 1 - float64(arrivalRank[key])/float64(day.PilotsInGoal)
+			score.ArrivalPoints = (0.2 + 0.037*ac + 0.13*ac*ac + 0.633*ac*ac*ac) * day.ArrivalWeight * day.AvailablePoints
+		}
+
+		if val.Result.StartTime != nil {
+			leadingFraction := 1.0
+			if minLeading > 0 {
+				leadingFraction = math.Max(0, 1-math.Pow((leading[key]-minLeading)/math.Sqrt(minLeading), 2.0/3))
+			} else if leading[key] > 0 {
+				leadingFraction = 0
+			}
+			score.LeadingPoints = leadingFraction * day.LeadingWeight * day.AvailablePoints
+		}
+
+		score.DistancePoints = roundPoints(score.DistancePoints)
+		score.TimePoints = roundPoints(score.TimePoints)
+		score.LeadingPoints = roundPoints(score.LeadingPoints)
+		score.ArrivalPoints = roundPoints(score.ArrivalPoints)
+		score.Total = roundPoints(score.DistancePoints + score.TimePoints + score.LeadingPoints + score.ArrivalPoints)
+		day.Results = append(day.Results, score)
+	}
+
+	// Pilots with the same total share the same rank
+	sort.SliceStable(day.Results, func(i, j int) bool { return day.Results[i].Total > day.Results[j].Total })
+	for key := range day.Results {
+		day.Results[key].Rank = key + 1
+		if key > 0 && day.Results[key].Total == day.Results[key-1].Total {
+			day.Results[key].Rank = day.Results[key-1].Rank
+		}
+	}
+	return day
+}
+
+// checkTrackIDs returns the IDs of the tracks, or an error naming the first one that doesn't exist
+// Old random IDs are replaced by the current ones
+func (s *server) checkTrackIDs(ctx context.Context, ids []string) ([]string, error) {
+	resIDs := []string{}
+	for _, id := range ids {
+		track, err := s.tracks.GetTrack(ctx, id)
+		if err == errNotFound {
+			return nil, fmt.Errorf("the track %s doesn't exist", id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		resIDs = append(resIDs, track.UniqueID)
+	}
+	return resIDs, nil
+}
+
+// Handles path: POST /api/task/<id>/tracks
+// Adds the tracks in {"tracks": [...]} to the task day and returns the task
+func (s *server) handlerTaskTracks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "501 - Method not implemented", http.StatusNotImplemented)
+		return
+	}
+
+	body := struct {
+		Tracks []string `json:"tracks"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "400 - Bad Request, invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The whole task is written back, the concurrent changes would be lost
+	s.taskMu.Lock()
+	defer s.taskMu.Unlock()
+
+	resTask, ok := s.requestTask(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	ids, err := s.checkTrackIDs(r.Context(), body.Tracks)
+	if err != nil {
+		http.Error(w, "400 - Bad Request, "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, id := range ids {
+		if !containsString(resTask.TrackIDs, id) {
+			resTask.TrackIDs = append(resTask.TrackIDs, id)
+		}
+	}
+	if err = s.tasks.UpdateTask(r.Context(), resTask); err != nil {
+		serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resTask)
+}
+
+// Handles path: DELETE /api/task/<id>/tracks/<track_id>
+// Removes the track from the task day and returns the task
+func (s *server) handlerTaskTrack(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "501 - Method not implemented", http.StatusNotImplemented)
+		return
+	}
+
+	s.taskMu.Lock()
+	defer s.taskMu.Unlock()
+
+	resTask, ok := s.requestTask(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+
+	trackID := mux.Vars(r)["track_id"]
+	if !containsString(resTask.TrackIDs, trackID) {
+		http.Error(w, "404 - The track is not in this task", http.StatusNotFound)
+		return
+	}
+	trackIDs := []string{}
+	for _, val := range resTask.TrackIDs {
+		if val != trackID {
+			trackIDs = append(trackIDs, val)
+		}
+	}
+	resTask.TrackIDs = trackIDs
+
+	if err := s.tasks.UpdateTask(r.Context(), resTask); err != nil {
+		serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resTask)
+}
+
+// containsString tells if the value is in the list
+func containsString(list []string, value string) bool {
+	for _, val := range list {
+		if val == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Handles path: GET /api/task/<id>/results
+// Returns the GAP results of the task day, as CSV with ?format=csv
+// Tracks deleted since they were added to the day are left out
+func (s *server) handlerTaskResults(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "501 - Method not implemented", http.StatusNotImplemented)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, "400 - Bad Request, format must be json or csv", http.StatusBadRequest)
+		return
+	}
+
+	resTask, ok := s.requestTask(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+
+	flights := []pilotFlight{}
+	for _, id := range resTask.TrackIDs {
+		track, err := s.tracks.GetTrack(r.Context(), id)
+		if err == errNotFound {
+			continue
+		}
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
+		fixes, err := s.loadFixes(r.Context(), track.UniqueID)
+		if err == errNotFound {
+			continue
+		}
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
+		flights = append(flights, pilotFlight{Track: track, Fixes: fixes, Result: validateTask(resTask, fixes)})
+	}
+
+	day := scoreDay(resTask, flights)
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		writeResultsCSV(w, day)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(day)
+}
+
+// writeResultsCSV writes the results table, one line per pilot
+func writeResultsCSV(w http.ResponseWriter, day dayResults) {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"rank", "track_id", "pilot", "glider", "distance", "goal", "speed_section_time",
+		"distance_points", "time_points", "leading_points", "arrival_points", "total"})
+
+	points := func(val float64) string {
+		return strconv.FormatFloat(val, 'f', 1, 64)
+	}
+	for _, val := range day.Results {
+		cw.Write([]string{
+			strconv.Itoa(val.Rank),
+			val.TrackID,
+			val.Pilot,
+			val.Glider,
+			strconv.FormatFloat(val.Distance, 'f', 2, 64),
+			strconv.FormatBool(val.Goal),
+			strconv.FormatInt(val.SpeedSectionTime, 10),
+			points(val.DistancePoints),
+			points(val.TimePoints),
+			points(val.LeadingPoints),
+			points(val.ArrivalPoints),
+			points(val.Total),
+		})
+	}
+	cw.Flush()
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// slowed returns the fixes flown factor times slower
+func slowed(fixes []fix, factor float64) []fix {
+	resFixes := []fix{}
+	for _, val := range fixes {
+		val.Time = fixes[0].Time.Add(time.Duration(float64(val.Time.Sub(fixes[0].Time)) * factor))
+		resFixes = append(resFixes, val)
+	}
+	return resFixes
+}
+
+func Test_scoreDay(t *testing.T) {
+	task := triangleTask()
+	route := routeFixes([][2]float64{pointA, pointB, pointC, pointA})
+
+	flights := []pilotFlight{
+		{Track: tracks{UniqueID: "1000", Pilot: "Slow"}, Fixes: slowed(route, 1.25)},
+		{Track: tracks{UniqueID: "1001", Pilot: "Fast"}, Fixes: route},
+		{Track: tracks{UniqueID: "1002", Pilot: "Landed"}, Fixes: routeFixes([][2]float64{pointA, pointB, pointC})},
+	}
+	for key := range flights {
+		flights[key].Result = validateTask(task, flights[key].Fixes)
+	}
+
+	day := scoreDay(task, flights)
+	assert.Equal(t, 3, day.Pilots)
+	assert.Equal(t, 2, day.PilotsInGoal)
+	assert.InDelta(t, 60, day.TaskDistance, 0.5)
+	assert.True(t, day.DayQuality > 0.9, "day quality %f", day.DayQuality)
+	assert.InDelta(t, 1, day.DistanceWeight+day.TimeWeight+day.LeadingWeight+day.ArrivalWeight, 0.0001)
+	if !assert.Len(t, day.Results, 3) {
+		return
+	}
+
+	fast, slow, landed := day.Results[0], day.Results[1], day.Results[2]
+	assert.Equal(t, []string{"Fast", "Slow", "Landed"}, []string{fast.Pilot, slow.Pilot, landed.Pilot})
+	assert.Equal(t, []int{1, 2, 3}, []int{fast.Rank, slow.Rank, landed.Rank})
+
+	// Both pilots in goal flew the whole task, the fastest gets every time, leading and arrival point
+	assert.Equal(t, fast.DistancePoints, slow.DistancePoints)
+	assert.InDelta(t, day.TimeWeight*day.AvailablePoints, fast.TimePoints, 0.1)
+	assert.InDelta(t, day.LeadingWeight*day.AvailablePoints, fast.LeadingPoints, 0.1)
+	assert.InDelta(t, day.ArrivalWeight*day.AvailablePoints, fast.ArrivalPoints, 0.1)
+	assert.True(t, slow.TimePoints < fast.TimePoints)
+	assert.True(t, slow.LeadingPoints < fast.LeadingPoints)
+	assert.True(t, slow.ArrivalPoints < fast.ArrivalPoints)
+
+	// The pilot who landed only gets distance and leading points
+	assert.InDelta(t, 40, landed.Distance, 1)
+	assert.InDelta(t, fast.DistancePoints*landed.Distance/fast.Distance, landed.DistancePoints, 0.2)
+	assert.Equal(t, float64(0), landed.TimePoints)
+	assert.Equal(t, float64(0), landed.ArrivalPoints)
+	assert.InDelta(t, landed.DistancePoints+landed.LeadingPoints, landed.Total, 0.11)
+}
+
+func Test_scoreDay_NoGoal(t *testing.T) {
+	task := triangleTask()
+	task.GAP.LeadingRatio = 0
+
+	flights := []pilotFlight{
+		{Track: tracks{UniqueID: "1000"}, Fixes: routeFixes([][2]float64{pointA, pointB, pointC})},
+		{Track: tracks{UniqueID: "1001"}, Fixes: routeFixes([][2]float64{pointA, pointB})},
+	}
+	for key := range flights {
+		flights[key].Result = validateTask(task, flights[key].Fixes)
+	}
+
+	// Every point is for distance
+	day := scoreDay(task, flights)
+	assert.Equal(t, 0, day.PilotsInGoal)
+	assert.Equal(t, float64(1), day.DistanceWeight)
+	assert.InDelta(t, day.AvailablePoints, day.Results[0].Total, 0.1)
+	assert.InDelta(t, day.AvailablePoints*day.Results[1].Distance/day.Results[0].Distance, day.Results[1].Total, 0.2)
+}
+
+func Test_scoreDay_NoDistance(t *testing.T) {
+	task := triangleTask()
+	task.GAP.MinimumDistance = 0
+
+	// Both pilots stayed on takeoff
+	takeoff := fix{Time: time.Date(2018, 7, 2, 12, 0, 0, 0, time.UTC), Lat: pointA[0], Lon: pointA[1]}
+	flights := []pilotFlight{}
+	for _, id := range []string{"1000", "1001"} {
+		fixes := []fix{}
+		for i := 0; i < 10; i++ {
+			val := takeoff
+			val.Time = takeoff.Time.Add(time.Duration(i) * 5 * time.Second)
+			fixes = append(fixes, val)
+		}
+		flights = append(flights, pilotFlight{Track: tracks{UniqueID: id}, Fixes: fixes, Result: validateTask(task, fixes)})
+	}
+
+	day := scoreDay(task, flights)
+	assert.Equal(t, float64(0), day.BestDistance)
+	for _, val := range day.Results {
+		assert.Equal(t, float64(0), val.DistancePoints, val.TrackID)
+		assert.Equal(t, float64(0), val.Total, val.TrackID)
+	}
+	_, err := json.Marshal(day)
+	assert.Nil(t, err)
+}
+
+func Test_handlerTaskResults(t *testing.T) {
+
+	s := newTestServer()
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+
+	trackID := postTrackFile(t, ts, "sample.igc")
+
+	// Unknown tracks are refused
+	body := `{"name": "Club task", "tracks": ["999999"], "turnpoints": [
+		{"name": "Start", "lat": 45.88333, "lon": 6.25, "radius": 500, "type": "sss"},
+		{"name": "Goal", "lat": 45.925, "lon": 6.29167, "radius": 500}
+	]}`
+	resp, _ := http.Post(ts.URL+"/paragliding/api/task", "application/json", strings.NewReader(body))
+	assert.Equal(t, 400, resp.StatusCode)
+
+	// A short task: the nominal distance and time are changed, the other parameters keep their default
+	body = strings.Replace(body, `"tracks": ["999999"]`, `"gap": {"nominal_distance": 6, "minimum_distance": 1, "nominal_time": "5m"}`, 1)
+	resp, _ = http.Post(ts.URL+"/paragliding/api/task", "application/json", strings.NewReader(body))
+	assert.Equal(t, 200, resp.StatusCode)
+	var created map[string]string
+	json.NewDecoder(resp.Body).Decode(&created)
+	taskID := created["id"]
+
+	resp, _ = http.Post(ts.URL+"/paragliding/api/task/"+taskID+"/tracks", "application/json", strings.NewReader(`{"tracks": ["`+trackID+`"]}`))
+	assert.Equal(t, 200, resp.StatusCode)
+	var resTask compTask
+	json.NewDecoder(resp.Body).Decode(&resTask)
+	assert.Equal(t, []string{trackID}, resTask.TrackIDs)
+	assert.Equal(t, float64(6), resTask.GAP.NominalDistance)
+	assert.Equal(t, duration(5*time.Minute), resTask.GAP.NominalTime)
+	assert.Equal(t, defaultGAP().NominalGoal, resTask.GAP.NominalGoal)
+
+	resp, _ = http.Post(ts.URL+"/paragliding/api/task/"+taskID+"/tracks", "application/json", strings.NewReader(`{"tracks": ["999999"]}`))
+	assert.Equal(t, 400, resp.StatusCode)
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/task/" + taskID + "/results")
+	assert.Equal(t, 200, resp.StatusCode)
+	var day dayResults
+	json.NewDecoder(resp.Body).Decode(&day)
+	assert.Equal(t, 1, day.PilotsInGoal)
+	if assert.Len(t, day.Results, 1) {
+		assert.Equal(t, "Jane Doe", day.Results[0].Pilot)
+		assert.Equal(t, 1, day.Results[0].Rank)
+		assert.True(t, day.Results[0].Total > 0)
+	}
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/task/" + taskID + "/results?format=csv")
+	assert.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	assert.Nil(t, err)
+	if assert.Len(t, rows, 2) {
+		assert.Equal(t, "rank", rows[0][0])
+		assert.Equal(t, []string{"1", trackID, "Jane Doe"}, rows[1][:3])
+	}
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/task/" + taskID + "/results?format=xml")
+	assert.Equal(t, 400, resp.StatusCode)
+
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/paragliding/api/task/"+taskID+"/tracks/"+trackID, nil)
+	resp, _ = http.DefaultClient.Do(req)
+	assert.Equal(t, 200, resp.StatusCode)
+	resp, _ = http.DefaultClient.Do(req)
+	assert.Equal(t, 404, resp.StatusCode)
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/task/" + taskID + "/results")
+	json.NewDecoder(resp.Body).Decode(&day)
+	assert.Equal(t, 0, day.Pilots)
+	assert.Len(t, day.Results, 0)
+}
+
+// slowTaskStore takes time to return a task, so concurrent changes of a task overlap
+type slowTaskStore struct {
+	TaskStore
+}
+
+func (st slowTaskStore) GetTask(ctx context.Context, id string) (compTask, error) {
+	task, err := st.TaskStore.GetTask(ctx, id)
+	time.Sleep(10 * time.Millisecond)
+	return task, err
+}
+
+func Test_handlerTaskTracks_Concurrent(t *testing.T) {
+
+	s := newTestServer()
+	s.tasks = slowTaskStore{s.tasks}
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+
+	ctx := context.Background()
+	s.tasks.AddTask(ctx, compTask{TaskID: "1000", Name: "Club task", TrackIDs: []string{}})
+	n := 20
+	for i := 0; i < n; i++ {
+		s.tracks.AddTrack(ctx, tracks{UniqueID: counterID(int64(firstID + i)), TimeRecorded: time.Now()})
+	}
+
+	// Every track is added by its own request, at the same time
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			resp, err := http.Post(ts.URL+"/paragliding/api/task/1000/tracks", "application/json", strings.NewReader(`{"tracks": ["`+id+`"]}`))
+			if err == nil {
+				resp.Body.Close()
+			}
+		}(counterID(int64(firstID + i)))
+	}
+	wg.Wait()
+
+	task, err := s.tasks.GetTask(ctx, "1000")
+	if assert.Nil(t, err) {
+		assert.Len(t, task.TrackIDs, n)
+	}
+}
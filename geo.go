@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	igc "github.com/marni/goigc"
+)
+
+// *** SPATIAL QUERIES *** //
+
+// geoTolerance is the distance in meters the simplified line of a track stays within its fixes
+const geoTolerance = 50.0
+
+// maxNearRadius is the biggest radius in km of ?near, the distances are computed on a plane tangent at the point
+const maxNearRadius = 500.0
+
+// geoFields are the geometries of the tracks a spatial query can be on
+var geoFields = []string{"takeoff", "landing", "line"}
+
+// geoPoint and geoLine are GeoJSON geometries, positions are [lon, lat]
+// They are stored as is in Mongo, for its 2dsphere indexes
+type geoPoint struct {
+	Type        string
+	Coordinates []float64
+}
+
+type geoLine struct {
+	Type        string
+	Coordinates [][]float64
+}
+
+// trackGeo is the geometry of the flight: the takeoff, the landing and the line between them,
+// simplified so it is small enough to be indexed
+type trackGeo struct {
+	Takeoff geoPoint
+	Landing geoPoint
+	Line    geoLine
+}
+
+// geoBox is a box of longitudes and latitudes, it can't cross the antimeridian
+type geoBox struct {
+	MinLon float64
+	MinLat float64
+	MaxLon float64
+	MaxLat float64
+}
+
+// intersects tells if the boxes have a point in common
+func (b geoBox) intersects(o geoBox) bool {
+	return b.MinLon <= o.MaxLon && o.MinLon <= b.MaxLon && b.MinLat <= o.MaxLat && o.MinLat <= b.MaxLat
+}
+
+// contains tells if the position is in the box
+func (b geoBox) contains(lon float64, lat float64) bool {
+	return lon >= b.MinLon && lon <= b.MaxLon && lat >= b.MinLat && lat <= b.MaxLat
+}
+
+// union returns the smallest box around both boxes
+func (b geoBox) union(o geoBox) geoBox {
+	return geoBox{math.Min(b.MinLon, o.MinLon), math.Min(b.MinLat, o.MinLat), math.Max(b.MaxLon, o.MaxLon), math.Max(b.MaxLat, o.MaxLat)}
+}
+
+// area is the area of the box in square degrees, to choose where the R-tree grows the least
+func (b geoBox) area() float64 {
+	return (b.MaxLon - b.MinLon) * (b.MaxLat - b.MinLat)
+}
+
+// geoCircle is the point and the radius in km of ?near
+type geoCircle struct {
+	Lat    float64
+	Lon    float64
+	Radius float64
+}
+
+// bounds returns the box around the circle
+func (c geoCircle) bounds() geoBox {
+	dLat := c.Radius / igc.EarthRadius * 180 / math.Pi
+	dLon := 180.0
+	if cos := math.Cos(c.Lat * math.Pi / 180); cos > dLat/90 {
+		dLon = math.Min(180, dLat/cos)
+	}
+	return geoBox{c.Lon - dLon, math.Max(-90, c.Lat-dLat), c.Lon + dLon, math.Min(90, c.Lat+dLat)}
+}
+
+// project returns the position in km on the plane tangent to the earth at the center of the circle
+func (c geoCircle) project(lon float64, lat float64) (float64, float64) {
+	x := (lon - c.Lon) * math.Pi / 180 * igc.EarthRadius * math.Cos(c.Lat*math.Pi/180)
+	y := (lat - c.Lat) * math.Pi / 180 * igc.EarthRadius
+	return x, y
+}
+
+// newTrackGeo returns the geometry of the flight from the takeoff to the landing,
+// or nil when the track has no flight
+func newTrackGeo(fixes []fix) *trackGeo {
+	flights := flagged(fixes)
+	if len(flights) == 0 {
+		return nil
+	}
+	flown := fixes[flights[0].Start : flights[len(flights)-1].End+1]
+
+	line := [][]float64{}
+	for _, val := range simplifyFixes(flown, geoTolerance/1000) {
+		position := []float64{roundDegrees(val.Lon), roundDegrees(val.Lat)}
+		// GeoJSON lines can't have the same position twice in a row
+		if last := len(line) - 1; last >= 0 && line[last][0] == position[0] && line[last][1] == position[1] {
+			continue
+		}
+		line = append(line, position)
+	}
+	if len(line) < 2 {
+		return nil
+	}
+
+	return &trackGeo{
+		Takeoff: geoPoint{Type: "Point", Coordinates: line[0]},
+		Landing: geoPoint{Type: "Point", Coordinates: line[len(line)-1]},
+		Line:    geoLine{Type: "LineString", Coordinates: line},
+	}
+}
+
+// roundDegrees keeps 6 decimals, about 10 cm
+func roundDegrees(degrees float64) float64 {
+	return math.Round(degrees*1e6) / 1e6
+}
+
+// simplifyFixes keeps the fixes of the Douglas-Peucker simplification of the line,
+// which stays within tolerance km of every fix
+func simplifyFixes(fixes []fix, tolerance float64) []fix {
+	if len(fixes) < 3 {
+		return fixes
+	}
+
+	keep := make([]bool, len(fixes))
+	keep[0], keep[len(fixes)-1] = true, true
+	stack := [][2]int{{0, len(fixes) - 1}}
+	for len(stack) > 0 {
+		first, last := stack[len(stack)-1][0], stack[len(stack)-1][1]
+		stack = stack[:len(stack)-1]
+
+		farthest, distance := 0, 0.0
+		for i := first + 1; i < last; i++ {
+			if d := segmentDistance(fixes[i], fixes[first], fixes[last]); d > distance {
+				farthest, distance = i, d
+			}
+		}
+		if distance > tolerance {
+			keep[farthest] = true
+			stack = append(stack, [2]int{first, farthest}, [2]int{farthest, last})
+		}
+	}
+
+	resFixes := []fix{}
+	for key, val := range fixes {
+		if keep[key] {
+			resFixes = append(resFixes, val)
+		}
+	}
+	return resFixes
+}
+
+// segmentDistance returns the distance in km from the fix to the segment between a and b
+func segmentDistance(val fix, a fix, b fix) float64 {
+	c := geoCircle{Lat: val.Lat, Lon: val.Lon}
+	ax, ay := c.project(a.Lon, a.Lat)
+	bx, by := c.project(b.Lon, b.Lat)
+	return originToSegment(ax, ay, bx, by)
+}
+
+// originToSegment returns the distance from the origin of the plane to the segment between a and b
+func originToSegment(ax float64, ay float64, bx float64, by float64) float64 {
+	dx, dy := bx-ax, by-ay
+	t := 0.0
+	if length := dx*dx + dy*dy; length > 0 {
+		t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/length))
+	}
+	return math.Hypot(ax+t*dx, ay+t*dy)
+}
+
+// positions returns the positions of the geometry of the track the query is on
+func (g *trackGeo) positions(field string) [][]float64 {
+	switch field {
+	case "takeoff":
+		return [][]float64{g.Takeoff.Coordinates}
+	case "landing":
+		return [][]float64{g.Landing.Coordinates}
+	}
+	return g.Line.Coordinates
+}
+
+// bounds returns the box around the geometry
+func (g *trackGeo) bounds(field string) geoBox {
+	positions := g.positions(field)
+	box := geoBox{positions[0][0], positions[0][1], positions[0][0], positions[0][1]}
+	for _, val := range positions[1:] {
+		box = box.union(geoBox{val[0], val[1], val[0], val[1]})
+	}
+	return box
+}
+
+// crosses tells if the geometry has a point in the box
+// The segments are straight in longitude and latitude, as long as the box is not too big
+func (g *trackGeo) crosses(field string, box geoBox) bool {
+	positions := g.positions(field)
+	for key, val := range positions {
+		if box.contains(val[0], val[1]) {
+			return true
+		}
+		if key > 0 && segmentCrossesBox(positions[key-1], val, box) {
+			return true
+		}
+	}
+	return false
+}
+
+// segmentCrossesBox clips the segment between a and b to the box, Liang-Barsky style
+func segmentCrossesBox(a []float64, b []float64, box geoBox) bool {
+	t0, t1 := 0.0, 1.0
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	for _, edge := range [][2]float64{
+		{-dx, a[0] - box.MinLon}, {dx, box.MaxLon - a[0]},
+		{-dy, a[1] - box.MinLat}, {dy, box.MaxLat - a[1]},
+	} {
+		p, q := edge[0], edge[1]
+		if p == 0 {
+			if q < 0 {
+				return false
+			}
+			continue
+		}
+		r := q / p
+		if p < 0 {
+			t0 = math.Max(t0, r)
+		} else {
+			t1 = math.Min(t1, r)
+		}
+		if t0 > t1 {
+			return false
+		}
+	}
+	return true
+}
+
+// within tells if the geometry comes within the radius of the circle
+func (g *trackGeo) within(field string, circle geoCircle) bool {
+	positions := g.positions(field)
+	for key, val := range positions {
+		x, y := circle.project(val[0], val[1])
+		if math.Hypot(x, y) <= circle.Radius {
+			return true
+		}
+		if key > 0 {
+			ax, ay := circle.project(positions[key-1][0], positions[key-1][1])
+			if originToSegment(ax, ay, x, y) <= circle.Radius {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesGeo tells if the track passes the spatial filters of the query
+// The tracks without a geometry never do
+func (q trackQuery) matchesGeo(t tracks) bool {
+	if q.BBox == nil && q.Near == nil {
+		return true
+	}
+	if t.Geo == nil {
+		return false
+	}
+	if q.BBox != nil && !t.Geo.crosses(q.GeoOn, *q.BBox) {
+		return false
+	}
+	return q.Near == nil || t.Geo.within(q.GeoOn, *q.Near)
+}
+
+// parseGeoQuery reads bbox=minLon,minLat,maxLon,maxLat or near=lat,lon&radius=km,
+// and on=takeoff, landing or line (the default), the geometry of the tracks they are on
+func parseGeoQuery(query url.Values, q *trackQuery) error {
+	q.GeoOn = "line"
+	if val := query.Get("on"); val != "" {
+		q.GeoOn = val
+		if val != "takeoff" && val != "landing" && val != "line" {
+			return fmt.Errorf("on must be takeoff, landing or line")
+		}
+	}
+
+	if val := query.Get("bbox"); val != "" {
+		box, err := parseNumbers(val, 4)
+		if err != nil || box[0] < -180 || box[2] > 180 || box[1] < -90 || box[3] > 90 || box[0] > box[2] || box[1] > box[3] {
+			return fmt.Errorf("bbox must be min longitude,min latitude,max longitude,max latitude")
+		}
+		q.BBox = &geoBox{box[0], box[1], box[2], box[3]}
+	}
+
+	if val := query.Get("near"); val != "" {
+		if q.BBox != nil {
+			return fmt.Errorf("bbox and near can't be used together")
+		}
+		point, err := parseNumbers(val, 2)
+		if err != nil || math.Abs(point[0]) > 90 || math.Abs(point[1]) > 180 {
+			return fmt.Errorf("near must be latitude,longitude")
+		}
+		radius, err := strconv.ParseFloat(query.Get("radius"), 64)
+		if err != nil || radius <= 0 || radius > maxNearRadius {
+			return fmt.Errorf("radius must be a number of km up to %g", maxNearRadius)
+		}
+		q.Near = &geoCircle{Lat: point[0], Lon: point[1], Radius: radius}
+	}
+	return nil
+}
+
+// parseNumbers reads the given count of comma separated numbers
+func parseNumbers(val string, count int) ([]float64, error) {
+	parts := strings.Split(val, ",")
+	if len(parts) != count {
+		return nil, fmt.Errorf("expected %d numbers", count)
+	}
+	numbers := []float64{}
+	for _, part := range parts {
+		number, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, err
+		}
+		numbers = append(numbers, number)
+	}
+	return numbers, nil
+}
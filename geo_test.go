@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_simplifyFixes(t *testing.T) {
+	// A straight line with a small wiggle, then a turn of 1 km
+	fixes := []fix{
+		{Lat: 46, Lon: 6},
+		{Lat: 46.0001, Lon: 6.005},
+		{Lat: 46, Lon: 6.01},
+		{Lat: 46.01, Lon: 6.015},
+		{Lat: 46, Lon: 6.02},
+	}
+	simplified := simplifyFixes(fixes, 0.05)
+	assert.Equal(t, []fix{fixes[0], fixes[2], fixes[3], fixes[4]}, simplified)
+}
+
+func Test_trackGeo(t *testing.T) {
+	geo := &trackGeo{
+		Takeoff: geoPoint{Type: "Point", Coordinates: []float64{6, 46}},
+		Landing: geoPoint{Type: "Point", Coordinates: []float64{7, 46}},
+		Line:    geoLine{Type: "LineString", Coordinates: [][]float64{{6, 46}, {7, 46}}},
+	}
+
+	// The line crosses the box without a fix in it
+	box := geoBox{6.4, 45.9, 6.6, 46.1}
+	assert.True(t, geo.crosses("line", box))
+	assert.False(t, geo.crosses("takeoff", box))
+	assert.False(t, geo.crosses("line", geoBox{6.4, 46.1, 6.6, 46.2}))
+	assert.Equal(t, geoBox{6, 46, 7, 46}, geo.bounds("line"))
+
+	// 46.05 is about 5.6 km north of the line
+	assert.True(t, geo.within("line", geoCircle{Lat: 46.05, Lon: 6.5, Radius: 6}))
+	assert.False(t, geo.within("line", geoCircle{Lat: 46.05, Lon: 6.5, Radius: 5}))
+	assert.False(t, geo.within("landing", geoCircle{Lat: 46.05, Lon: 6.5, Radius: 6}))
+}
+
+func Test_parseGeoQuery(t *testing.T) {
+	query, _ := url.ParseQuery("near=45.9,6.2&radius=5&on=takeoff")
+	q := trackQuery{}
+	if assert.Nil(t, parseGeoQuery(query, &q)) {
+		assert.Equal(t, &geoCircle{Lat: 45.9, Lon: 6.2, Radius: 5}, q.Near)
+		assert.Equal(t, "takeoff", q.GeoOn)
+	}
+
+	for _, val := range []string{"bbox=6,45,7", "bbox=7,45,6,46", "bbox=6,45,7,95", "near=45.9", "near=45.9,6.2",
+		"near=45.9,6.2&radius=-1", "bbox=6,45,7,46&near=45.9,6.2&radius=5", "bbox=6,45,7,46&on=glider"} {
+		query, _ := url.ParseQuery(val)
+		assert.NotNil(t, parseGeoQuery(query, &trackQuery{}), val)
+	}
+}
+
+func Test_handlerTrack_Geo(t *testing.T) {
+
+	s := newTestServer()
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+
+	// The IGC sample flies around 45.9N 6.27E, the GPX sample around 45.91N 6.21E
+	ids := []string{postTrackFile(t, ts, "sample.igc"), postTrackFile(t, ts, "sample.gpx")}
+
+	get := func(query string) (int, string) {
+		resp, err := http.Get(ts.URL + "/paragliding/api/track" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	_, body := get("?bbox=6.24,45.85,6.35,45.95")
+	assert.Equal(t, idList(ids[0]), body)
+	_, body = get("?bbox=6,45,7,46")
+	assert.Equal(t, idList(ids[0], ids[1]), body)
+	_, body = get("?near=45.905,6.205&radius=1")
+	assert.Equal(t, idList(ids[1]), body)
+	_, body = get("?near=45.905,6.205&radius=1&on=landing")
+	assert.Equal(t, idList(), body)
+	_, body = get("?bbox=10,45,11,46")
+	assert.Equal(t, idList(), body)
+
+	status, _ := get("?near=45.905,6.205")
+	assert.Equal(t, 400, status)
+}
+
+func Test_boltStore_FindTracks_Geo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "paragliding.db")
+	store, err := newBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A track every 0.1 degree of longitude along the 46th parallel, and one without a flight
+	ctx := context.Background()
+	for i := 0; i < 50; i++ {
+		lon := 6 + float64(i)/10
+		track := tracks{UniqueID: counterID(int64(firstID + i)), TimeRecorded: time.Now(), Geo: newTrackGeo([]fix{
+			{Time: time.Unix(0, 0), Lat: 46, Lon: lon},
+			{Time: time.Unix(60, 0), Lat: 46, Lon: lon + 0.01},
+			{Time: time.Unix(120, 0), Lat: 46.01, Lon: lon + 0.02},
+		})}
+		if err := store.AddTrack(ctx, track); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.AddTrack(ctx, tracks{UniqueID: "5000", TimeRecorded: time.Now()})
+	store.Close(ctx)
+
+	// The R-tree is built again when the file is opened
+	store, err = newBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(ctx)
+
+	found, err := store.FindTracks(ctx, trackQuery{BBox: &geoBox{6.95, 45.9, 7.25, 46.1}, GeoOn: "line"})
+	if assert.Nil(t, err) && assert.Len(t, found, 3) {
+		assert.Equal(t, counterID(int64(firstID+10)), found[0].UniqueID)
+	}
+
+	found, err = store.FindTracks(ctx, trackQuery{Near: &geoCircle{Lat: 46, Lon: 7, Radius: 0.5}, GeoOn: "takeoff"})
+	if assert.Nil(t, err) && assert.Len(t, found, 1) {
+		assert.Equal(t, counterID(int64(firstID+10)), found[0].UniqueID)
+	}
+
+	store.DeleteAllTracks(ctx)
+	found, _ = store.FindTracks(ctx, trackQuery{BBox: &geoBox{6, 45, 8, 47}, GeoOn: "line"})
+	assert.Len(t, found, 0)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// *** GEOJSON EXPORT *** //
+
+const geoJSONContentType = "application/geo+json"
+
+// geoJSONGeometry is a Point or a LineString, positions are [lon, lat, altitude]
+type geoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   geoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+// geoJSONPosition returns the position of the fix, with the GNSS altitude
+// or the pressure altitude for loggers without GNSS altitude
+func geoJSONPosition(val fix, useGNSS bool) []float64 {
+	return []float64{val.Lon, val.Lat, float64(fixAltitude(val, useGNSS))}
+}
+
+// writeGeoJSON writes the track as a FeatureCollection: the LineString of every fix with the metadata
+// of the track as properties, then the takeoff and landing Points
+func writeGeoJSON(w io.Writer, track tracks, fixes []fix) error {
+	useGNSS := hasGNSSAltitude(fixes)
+
+	line := [][]float64{}
+	for _, val := range fixes {
+		line = append(line, geoJSONPosition(val, useGNSS))
+	}
+
+	collection := geoJSONCollection{
+		Type: "FeatureCollection",
+		Features: []geoJSONFeature{{
+			Type:     "Feature",
+			Geometry: geoJSONGeometry{Type: "LineString", Coordinates: line},
+			Properties: map[string]interface{}{
+				"id":            track.UniqueID,
+				"H_date":        track.Hdate,
+				"pilot":         track.Pilot,
+				"glider":        track.Glider,
+				"glider_id":     track.GliderID,
+				"length":        track.TrackLength,
+				"track_src_url": track.URL,
+				"file_name":     track.FileName,
+			},
+		}},
+	}
+
+	// The first flight starts at the takeoff, the last one ends at the landing
+	if flights := flagged(fixes); len(flights) > 0 {
+		points := []struct {
+			name string
+			val  fix
+		}{
+			{"takeoff", fixes[flights[0].Start]},
+			{"landing", fixes[flights[len(flights)-1].End]},
+		}
+		for _, point := range points {
+			collection.Features = append(collection.Features, geoJSONFeature{
+				Type:       "Feature",
+				Geometry:   geoJSONGeometry{Type: "Point", Coordinates: geoJSONPosition(point.val, useGNSS)},
+				Properties: map[string]interface{}{"name": point.name, "time": point.val.Time},
+			})
+		}
+	}
+
+	return json.NewEncoder(w).Encode(collection)
+}
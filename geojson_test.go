@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// geoJSONResponse is a GeoJSON FeatureCollection as read by the clients
+type geoJSONResponse struct {
+	Type     string `json:"type"`
+	Features []struct {
+		Geometry struct {
+			Type        string          `json:"type"`
+			Coordinates json.RawMessage `json:"coordinates"`
+		} `json:"geometry"`
+		Properties map[string]interface{} `json:"properties"`
+	} `json:"features"`
+}
+
+func Test_handlerExport_GeoJSON(t *testing.T) {
+
+	s := newTestServer()
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+
+	trackID := postTrackFile(t, ts, "sample.igc")
+
+	resp, _ := http.Get(ts.URL + "/paragliding/api/track/" + trackID + ".geojson")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, geoJSONContentType, resp.Header.Get("Content-Type"))
+
+	var collection geoJSONResponse
+	json.NewDecoder(resp.Body).Decode(&collection)
+	assert.Equal(t, "FeatureCollection", collection.Type)
+	if !assert.Len(t, collection.Features, 3) {
+		return
+	}
+
+	line := collection.Features[0]
+	assert.Equal(t, "LineString", line.Geometry.Type)
+	assert.Equal(t, "Jane Doe", line.Properties["pilot"])
+	assert.Equal(t, trackID, line.Properties["id"])
+	var coordinates [][]float64
+	json.Unmarshal(line.Geometry.Coordinates, &coordinates)
+	if assert.Len(t, coordinates, 6) {
+		// Longitude first, then latitude and the GNSS altitude
+		assert.Equal(t, 6.25, coordinates[0][0])
+		assert.InDelta(t, 45.88333, coordinates[0][1], 0.0001)
+		assert.Equal(t, 1250.0, coordinates[0][2])
+	}
+
+	assert.Equal(t, "Point", collection.Features[1].Geometry.Type)
+	assert.Equal(t, "takeoff", collection.Features[1].Properties["name"])
+	assert.Equal(t, "landing", collection.Features[2].Properties["name"])
+
+	// The same export asked for in the Accept header
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/paragliding/api/track/"+trackID, nil)
+	req.Header.Set("Accept", "application/geo+json")
+	resp, _ = http.DefaultClient.Do(req)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, geoJSONContentType, resp.Header.Get("Content-Type"))
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/" + trackID + ".shp")
+	assert.Equal(t, 404, resp.StatusCode)
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/999999.geojson")
+	assert.Equal(t, 404, resp.StatusCode)
+}
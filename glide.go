@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// *** GLIDE ANALYSIS *** //
+
+// minGlide is the shortest glide kept, shorter ones are transitions between two thermals
+const minGlide = 30 * time.Second
+
+// glide is a straight segment of a flight, between two thermals
+// Distances are in km, altitudes in meters and the speed in km/h
+type glide struct {
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Duration     int64     `json:"duration"` // in seconds
+	Distance     float64   `json:"distance"`
+	AltitudeLost int64     `json:"altitude_lost"` // negative if the glider climbed
+	GlideRatio   float64   `json:"glide_ratio"`   // L/D, 0 if no altitude was lost
+	AvgSpeed     float64   `json:"avg_speed"`
+	Heading      float64   `json:"heading"` // from the start to the end, in degrees from north
+}
+
+// detectGlides returns the segments of the flights that are not in a thermal, in order
+func detectGlides(fixes []fix) []glide {
+	circling := make([]bool, len(fixes))
+	k := 0
+	for _, val := range detectThermals(fixes) {
+		for k < len(fixes) && fixes[k].Time.Before(val.Start) {
+			k++
+		}
+		for k < len(fixes) && !fixes[k].Time.After(val.End) {
+			circling[k] = true
+			k++
+		}
+	}
+
+	glides := []glide{}
+	for start := 0; start < len(fixes); {
+		if fixes[start].Ground || circling[start] {
+			start++
+			continue
+		}
+		end := start
+		for end+1 < len(fixes) && !fixes[end+1].Ground && !circling[end+1] {
+			end++
+		}
+		if fixes[end].Time.Sub(fixes[start].Time) >= minGlide {
+			glides = append(glides, newGlide(fixes[start:end+1]))
+		}
+		start = end + 1
+	}
+	return glides
+}
+
+// newGlide returns the glide made of the fixes
+func newGlide(fixes []fix) glide {
+	useGNSS := fixes[0].GNSSAltitude != 0
+	first, last := fixes[0], fixes[len(fixes)-1]
+
+	gl := glide{
+		Start:        first.Time,
+		End:          last.Time,
+		Duration:     int64(last.Time.Sub(first.Time) / time.Second),
+		AltitudeLost: fixAltitude(first, useGNSS) - fixAltitude(last, useGNSS),
+		Heading:      bearing(first, last),
+	}
+	for i := 1; i < len(fixes); i++ {
+		gl.Distance += fixDistance(fixes[i-1], fixes[i])
+	}
+	if gl.AltitudeLost > 0 {
+		gl.GlideRatio = gl.Distance * 1000 / float64(gl.AltitudeLost)
+	}
+	if gl.Duration > 0 {
+		gl.AvgSpeed = gl.Distance / (float64(gl.Duration) / 3600)
+	}
+	return gl
+}
+
+// Handles path: GET /api/track/<id>/glides
+// Returns the glides of the track, in order
+func (s *server) handlerGlides(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "501 - Method not implemented", http.StatusNotImplemented)
+		return
+	}
+
+	_, fixes, ok := s.requestFixes(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detectGlides(fixes))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_detectGlides(t *testing.T) {
+	// A glide, a thermal and another glide, see circlingFixes
+	fixes := circlingFixes()
+
+	glides := detectGlides(fixes)
+	if !assert.Len(t, glides, 2) {
+		return
+	}
+
+	for _, gl := range glides {
+		// 30 km/h, sinking at 1 m/s: L/D of 30 / 3.6 = 8.3
+		assert.InDelta(t, 30, gl.AvgSpeed, 2)
+		assert.InDelta(t, 8.3, gl.GlideRatio, 0.6)
+		assert.True(t, gl.AltitudeLost > 100)
+		assert.InDelta(t, 0, gl.Heading, 1)
+	}
+	assert.True(t, glides[0].End.Before(glides[1].Start))
+}
+
+func Test_detectGlides_Ground(t *testing.T) {
+	// On launch, then gliding, the time on launch is not a glide
+	fixes := simulatedFixes(circlingFixes()[0].Time, []leg{{5, 0}, {5, 30}})
+	flagGround(fixes)
+
+	glides := detectGlides(fixes)
+	if assert.Len(t, glides, 1) {
+		assert.InDelta(t, 2.5, glides[0].Distance, 0.2)
+		// Flat flight: no altitude lost, no glide ratio
+		assert.Equal(t, float64(0), glides[0].GlideRatio)
+	}
+}
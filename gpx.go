@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	igc "github.com/marni/goigc"
+)
+
+// *** GPX IMPORT AND EXPORT *** //
+
+// gpxContentType is the media type of a GPX file, exported or sent in the request body
+const gpxContentType = "application/gpx+xml"
+
+// gpxDocument is a GPX 1.1 file, only the parts of a flight track are read
+type gpxDocument struct {
+	XMLName   xml.Name     `xml:"gpx"`
+	XMLNS     string       `xml:"xmlns,attr,omitempty"`
+	Version   string       `xml:"version,attr"`
+	Creator   string       `xml:"creator,attr"`
+	Metadata  *gpxMetadata `xml:"metadata"`
+	Waypoints []gpxPoint   `xml:"wpt"`
+	Tracks    []gpxTrack   `xml:"trk"`
+}
+
+type gpxMetadata struct {
+	Name   string     `xml:"name,omitempty"`
+	Author string     `xml:"author>name,omitempty"`
+	Time   *time.Time `xml:"time"`
+}
+
+type gpxTrack struct {
+	Name     string       `xml:"name,omitempty"`
+	Desc     string       `xml:"desc,omitempty"`
+	Segments []gpxSegment `xml:"trkseg"`
+}
+
+type gpxSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+// gpxPoint is a track point or a waypoint, the elevation in meters
+type gpxPoint struct {
+	Lat  float64    `xml:"lat,attr"`
+	Lon  float64    `xml:"lon,attr"`
+	Ele  float64    `xml:"ele"`
+	Time *time.Time `xml:"time"`
+	Name string     `xml:"name,omitempty"`
+}
+
+// isGPX tells if the track file is GPX rather than IGC, an XML document instead of A and H records
+func isGPX(data []byte) bool {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("<"))
+}
+
+// parseGPX converts the track points of a GPX file to a track, like one parsed from an IGC file
+// The segments of every track are joined in order, the elevation is the GNSS altitude,
+// the pilot is the author of the file and the date is the day of the first point, in UTC
+func parseGPX(data []byte) (igc.Track, error) {
+	var doc gpxDocument
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return igc.Track{}, err
+	}
+
+	track := igc.NewTrack()
+	if doc.Metadata != nil {
+		track.Pilot = doc.Metadata.Author
+	}
+
+	for _, trk := range doc.Tracks {
+		for _, seg := range trk.Segments {
+			for _, val := range seg.Points {
+				if val.Time == nil {
+					return igc.Track{}, fmt.Errorf("the GPX track points need a time")
+				}
+				if val.Lat < -90 || val.Lat > 90 || val.Lon < -180 || val.Lon > 180 {
+					return igc.Track{}, fmt.Errorf("invalid coordinates %g, %g", val.Lat, val.Lon)
+				}
+
+				// The points only keep the time of day, like a B record, the date is the one of the track
+				t := val.Time.UTC()
+				if len(track.Points) == 0 {
+					track.Date = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+				}
+				point := igc.NewPointFromLatLng(val.Lat, val.Lon)
+				point.Time = time.Date(0, 1, 1, t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+				point.GNSSAltitude = int64(math.Round(val.Ele))
+				track.Points = append(track.Points, point)
+			}
+		}
+	}
+	if len(track.Points) == 0 {
+		return igc.Track{}, fmt.Errorf("the GPX file has no track points")
+	}
+
+	return track, nil
+}
+
+// newGPXPoint returns the fix as a GPX point
+func newGPXPoint(val fix, useGNSS bool, name string) gpxPoint {
+	t := val.Time.UTC()
+	return gpxPoint{Lat: val.Lat, Lon: val.Lon, Ele: float64(fixAltitude(val, useGNSS)), Time: &t, Name: name}
+}
+
+// writeGPX writes the track as a GPX 1.1 file: the takeoff and landing waypoints, and one track of every fix
+func writeGPX(w io.Writer, track tracks, fixes []fix) error {
+	useGNSS := hasGNSSAltitude(fixes)
+
+	doc := gpxDocument{
+		XMLNS:    "http://www.topografix.com/GPX/1/1",
+		Version:  "1.1",
+		Creator:  "igcinfo",
+		Metadata: &gpxMetadata{Name: track.Pilot, Author: track.Pilot},
+		Tracks:   []gpxTrack{{Name: track.Pilot}},
+	}
+	if glider := strings.TrimSpace(track.Glider + " " + track.GliderID); glider != "" {
+		doc.Tracks[0].Desc = "Glider: " + glider
+	}
+
+	seg := gpxSegment{Points: []gpxPoint{}}
+	for _, val := range fixes {
+		seg.Points = append(seg.Points, newGPXPoint(val, useGNSS, ""))
+	}
+	doc.Tracks[0].Segments = []gpxSegment{seg}
+
+	if len(fixes) > 0 {
+		doc.Metadata.Time = seg.Points[0].Time
+	}
+
+	// The first flight starts at the takeoff, the last one ends at the landing
+	if flights := flagged(fixes); len(flights) > 0 {
+		doc.Waypoints = []gpxPoint{
+			newGPXPoint(fixes[flights[0].Start], useGNSS, "Takeoff"),
+			newGPXPoint(fixes[flights[len(flights)-1].End], useGNSS, "Landing"),
+		}
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(doc)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseGPX(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/sample.gpx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, isGPX(data))
+	track, err := parseTrack(data)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "John Smith", track.Pilot)
+	assert.Equal(t, time.Date(2018, 7, 3, 0, 0, 0, 0, time.UTC), track.Date)
+	assert.Len(t, track.Points, 6)
+
+	// The times are in UTC, and the flight goes past midnight
+	fixes := trackFixes(track)
+	assert.Equal(t, time.Date(2018, 7, 3, 23, 58, 0, 0, time.UTC), fixes[0].Time)
+	assert.Equal(t, time.Date(2018, 7, 4, 0, 3, 0, 0, time.UTC), fixes[5].Time)
+	assert.InDelta(t, 45.9, fixes[0].Lat, 0.000001)
+	assert.Equal(t, int64(1450), fixes[0].GNSSAltitude)
+
+	invalid := map[string]string{
+		"no points": `<gpx version="1.1"><trk><trkseg></trkseg></trk></gpx>`,
+		"no time":   `<gpx version="1.1"><trk><trkseg><trkpt lat="45.9" lon="6.2"><ele>1450</ele></trkpt></trkseg></trk></gpx>`,
+		"bad xml":   `<gpx version="1.1"><trk>`,
+	}
+	for name, val := range invalid {
+		_, err := parseTrack([]byte(val))
+		assert.NotNil(t, err, name)
+	}
+}
+
+func Test_handlerTrack_Post_GPX(t *testing.T) {
+
+	s := newTestServer()
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+
+	data, err := ioutil.ReadFile("testdata/sample.gpx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(ts.URL+"/paragliding/api/track", gpxContentType, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error executing the POST request, %s", err)
+	}
+	assert.Equal(t, 200, resp.StatusCode)
+	var created map[string]string
+	json.NewDecoder(resp.Body).Decode(&created)
+
+	// The GPX track is served like an IGC one
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/" + created["id"] + "/pilot")
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "John Smith", string(body))
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/" + created["id"] + "/points")
+	var points []fix
+	json.NewDecoder(resp.Body).Decode(&points)
+	assert.Len(t, points, 6)
+
+	resp, _ = http.Post(ts.URL+"/paragliding/api/track", gpxContentType, bytes.NewReader(data))
+	assert.Equal(t, 409, resp.StatusCode)
+
+	resp, _ = http.Post(ts.URL+"/paragliding/api/track", gpxContentType, strings.NewReader(`<gpx version="1.1"></gpx>`))
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func Test_handlerExport_GPX(t *testing.T) {
+
+	s := newTestServer()
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+
+	trackID := postTrackFile(t, ts, "sample.igc")
+
+	resp, _ := http.Get(ts.URL + "/paragliding/api/track/" + trackID + ".gpx")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, gpxContentType, resp.Header.Get("Content-Type"))
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(body), `<gpx xmlns="http://www.topografix.com/GPX/1/1" version="1.1"`)
+	assert.Contains(t, string(body), "<desc>Glider: Ozone Rush 5 OZ-1234</desc>")
+
+	// The exported file can be imported back, with the same fixes
+	track, err := parseTrack(body)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "Jane Doe", track.Pilot)
+		fixes := trackFixes(track)
+		if assert.Len(t, fixes, 6) {
+			assert.Equal(t, time.Date(2018, 7, 2, 10, 0, 0, 0, time.UTC), fixes[0].Time)
+			assert.InDelta(t, 45.88333, fixes[0].Lat, 0.0001)
+			assert.Equal(t, int64(1250), fixes[0].GNSSAltitude)
+		}
+	}
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/999999.gpx")
+	assert.Equal(t, 404, resp.StatusCode)
+}
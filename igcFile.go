@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// *** ORIGINAL AND GENERATED IGC FILES *** //
+
+// igcCoordinate formats the degrees as IGC does: degrees, minutes with 3 decimals and the hemisphere
+func igcCoordinate(degrees float64, width int, positive byte, negative byte) string {
+	hemisphere := positive
+	if degrees < 0 {
+		hemisphere = negative
+	}
+	degrees = math.Abs(degrees)
+
+	whole := int(degrees)
+	minutes := int(math.Round((degrees - float64(whole)) * 60000))
+	if minutes == 60000 {
+		whole, minutes = whole+1, 0
+	}
+	return fmt.Sprintf("%0*d%05d%c", width, whole, minutes, hemisphere)
+}
+
+// writeIGC writes the fixes as an IGC file: the A record, the date, pilot and glider headers, and a B record per fix
+// The date is the one of the first fix, the B records going past midnight are on the next day
+// anonymous leaves out the pilot and the registration of the glider
+func writeIGC(w io.Writer, track tracks, fixes []fix, anonymous bool) error {
+	pilot, gliderID := track.Pilot, track.GliderID
+	if anonymous {
+		pilot, gliderID = "", ""
+	}
+
+	lines := []string{"AXXXIGCINFO"}
+	if len(fixes) > 0 {
+		lines = append(lines, "HFDTE"+fixes[0].Time.UTC().Format("020106"))
+	}
+	lines = append(lines,
+		"HFPLTPILOTINCHARGE:"+pilot,
+		"HFGTYGLIDERTYPE:"+track.Glider,
+		"HFGIDGLIDERID:"+gliderID,
+	)
+
+	for _, val := range fixes {
+		lines = append(lines, fmt.Sprintf("B%s%s%sA%05d%05d",
+			val.Time.UTC().Format("150405"),
+			igcCoordinate(val.Lat, 2, 'N', 'S'),
+			igcCoordinate(val.Lon, 3, 'E', 'W'),
+			val.PressureAltitude, val.GNSSAltitude))
+	}
+
+	_, err := io.WriteString(w, strings.Join(lines, "\r\n")+"\r\n")
+	return err
+}
+
+// hideEnds leaves out the fixes closer than radius meters to the takeoff and the landing,
+// so the track doesn't show where the pilot lives or parks
+func hideEnds(fixes []fix, radius float64) []fix {
+	flights := flagged(fixes)
+	if len(flights) == 0 {
+		return fixes
+	}
+	takeoff, landing := fixes[flights[0].Start], fixes[flights[len(flights)-1].End]
+
+	resFixes := []fix{}
+	for _, val := range fixes {
+		if fixDistance(val, takeoff)*1000 >= radius && fixDistance(val, landing)*1000 >= radius {
+			resFixes = append(resFixes, val)
+		}
+	}
+	return resFixes
+}
+
+// attachment sets the header to download the response as a file with the given name
+func attachment(w http.ResponseWriter, fileName string) {
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+}
+
+// Handles path: GET /api/track/<id>/igc
+// Returns the original file of the track, as it was uploaded or fetched
+// With generated=true, returns an IGC file made from the fixes of the track instead, with the query
+// parameters of /points to select the fixes, privacy to leave out the fixes closer than this number
+// of meters to the takeoff and the landing, and anonymous=true to leave out the pilot and glider ID
+func (s *server) handlerIGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "501 - Method not implemented", http.StatusNotImplemented)
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("generated") == "true" {
+		s.generateIGC(w, r)
+		return
+	}
+
+	track, err := s.tracks.GetTrack(r.Context(), mux.Vars(r)["id"])
+	if err == errNotFound {
+		http.Error(w, "404 - The trackInfo with that id doesn't exists in our database ", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	data, err := s.files.GetFile(r.Context(), igcFiles, track.UniqueID)
+	if err == errNotFound {
+		http.Error(w, "404 - The original file of this track was not kept, use generated=true", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	// The original file is the GPX one for the tracks registered from GPX
+	contentType, ext := igcContentType, ".igc"
+	if isGPX(data) {
+		contentType, ext = gpxContentType, ".gpx"
+	}
+	fileName := track.FileName
+	if fileName == "" {
+		fileName = track.UniqueID + ext
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	attachment(w, fileName)
+	w.Write(data)
+}
+
+// generateIGC sends the IGC file made from the fixes of the track
+func (s *server) generateIGC(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter, err := parseFixFilter(query)
+	if err != nil {
+		http.Error(w, "400 - Bad Request, "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	privacy := 0.0
+	if val := query.Get("privacy"); val != "" {
+		if privacy, err = strconv.ParseFloat(val, 64); err != nil || privacy <= 0 {
+			http.Error(w, "400 - Bad Request, privacy must be a positive number of meters", http.StatusBadRequest)
+			return
+		}
+	}
+
+	track, fixes, ok := s.requestFixes(w, r)
+	if !ok {
+		return
+	}
+
+	if privacy > 0 {
+		fixes = hideEnds(fixes, privacy)
+	}
+	fixes = filter.apply(fixes)
+
+	// Written to a buffer first, so an error is still sent as an error and not as a broken file
+	buf := &bytes.Buffer{}
+	if err := writeIGC(buf, track, fixes, query.Get("anonymous") == "true"); err != nil {
+		serverError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", igcContentType)
+	attachment(w, track.UniqueID+".igc")
+	buf.WriteTo(w)
+}
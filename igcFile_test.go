@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_igcCoordinate(t *testing.T) {
+	assert.Equal(t, "4553000N", igcCoordinate(45.88333333, 2, 'N', 'S'))
+	assert.Equal(t, "07036000W", igcCoordinate(-70.6, 3, 'E', 'W'))
+	assert.Equal(t, "3300000S", igcCoordinate(-32.9999999, 2, 'N', 'S'))
+}
+
+func Test_writeIGC(t *testing.T) {
+	// South and west of Greenwich, past midnight UTC
+	start := time.Date(2018, 7, 2, 23, 59, 0, 0, time.UTC)
+	fixes := []fix{
+		{Time: start, Lat: -33.45, Lon: -70.66, PressureAltitude: -12, GNSSAltitude: 850},
+		{Time: start.Add(time.Minute), Lat: -33.46, Lon: -70.67, PressureAltitude: 10, GNSSAltitude: 870},
+		{Time: start.Add(2 * time.Minute), Lat: -33.47, Lon: -70.68, PressureAltitude: 30, GNSSAltitude: 890},
+	}
+
+	var buf bytes.Buffer
+	assert.Nil(t, writeIGC(&buf, tracks{Pilot: "Jane Doe", Glider: "Ozone Rush 5"}, fixes, false))
+
+	track, err := parseIGC(buf.Bytes())
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "Jane Doe", track.Pilot)
+	assert.Equal(t, "Ozone Rush 5", track.GliderType)
+
+	parsed := trackFixes(track)
+	if assert.Len(t, parsed, 3) {
+		for key, val := range parsed {
+			assert.Equal(t, fixes[key].Time, val.Time)
+			assert.InDelta(t, fixes[key].Lat, val.Lat, 0.00001)
+			assert.InDelta(t, fixes[key].Lon, val.Lon, 0.00001)
+			assert.Equal(t, fixes[key].PressureAltitude, val.PressureAltitude)
+			assert.Equal(t, fixes[key].GNSSAltitude, val.GNSSAltitude)
+		}
+	}
+}
+
+func Test_handlerIGC(t *testing.T) {
+
+	s := newTestServer()
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+
+	data, err := ioutil.ReadFile("testdata/sample.igc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := postTrackFile(t, ts, "sample.igc")
+
+	// The original bytes
+	resp, _ := http.Get(ts.URL + "/paragliding/api/track/" + id + "/igc")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, igcContentType, resp.Header.Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=`+id+`.igc`, resp.Header.Get("Content-Disposition"))
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, data, body)
+
+	// A generated file without the pilot, every other fix
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/" + id + "/igc?generated=true&anonymous=true&step=2")
+	assert.Equal(t, 200, resp.StatusCode)
+	body, _ = ioutil.ReadAll(resp.Body)
+	track, err := parseIGC(body)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "", track.Pilot)
+		assert.Equal(t, "", track.GliderID)
+		assert.Equal(t, "Ozone Rush 5", track.GliderType)
+		assert.Len(t, track.Points, 3)
+	}
+
+	// The fixes are about 1.1 km apart, only the 2 in the middle are further than 2 km from both ends
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/" + id + "/igc?generated=true&privacy=2000")
+	body, _ = ioutil.ReadAll(resp.Body)
+	track, err = parseIGC(body)
+	if assert.Nil(t, err) {
+		assert.Len(t, track.Points, 2)
+	}
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/" + id + "/igc?generated=true&privacy=-5")
+	assert.Equal(t, 400, resp.StatusCode)
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/999999/igc")
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// The original of a GPX track is the GPX file
+	gpx, err := ioutil.ReadFile("testdata/sample.gpx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id = postTrackFile(t, ts, "sample.gpx")
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/" + id + "/igc")
+	assert.Equal(t, gpxContentType, resp.Header.Get("Content-Type"))
+	body, _ = ioutil.ReadAll(resp.Body)
+	assert.Equal(t, gpx, body)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// *** BULK IMPORT *** //
+
+// maxImportSize is the biggest ZIP archive accepted by the import, in bytes
+const maxImportSize = 200 << 20
+
+// importResult is the outcome of the import of one file of the archive
+type importResult struct {
+	File        string `json:"file"`
+	ID          string `json:"id,omitempty"`           // the new track
+	DuplicateOf string `json:"duplicate_of,omitempty"` // the existing track with the same content
+	Error       string `json:"error,omitempty"`        // why the file was not imported
+}
+
+// readArchive returns the ZIP archive sent as the raw body or as the "file" field of a multipart form
+func readArchive(w http.ResponseWriter, r *http.Request) (*zip.Reader, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+
+	body := r.Body
+	if mediaType == "multipart/form-data" {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, fmt.Errorf("the multipart form needs a \"file\" field: %s", err)
+		}
+		defer file.Close()
+		body = file
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return zip.NewReader(bytes.NewReader(data), int64(len(data)))
+}
+
+// Handles path: POST /admin/api/import
+// Adds every .igc and .gpx file of the ZIP archive in the body and returns a report for each of them
+// The webhooks are called once for the whole archive
+func (s *server) adminAPIImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "501 - Method not implemented", http.StatusNotImplemented)
+		return
+	}
+
+	archive, err := readArchive(w, r)
+	if err != nil {
+		http.Error(w, "400 - Bad Request, invalid ZIP archive: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report := []importResult{}
+	added := 0
+
+	// Called even if the import stops on an error, for the tracks already added
+	defer func() {
+		if added > 0 {
+			s.triggerWhenTrackIsAdded(r.Context(), added)
+		}
+	}()
+
+	for _, file := range archive.File {
+		ext := path.Ext(file.Name)
+		if file.FileInfo().IsDir() || !strings.EqualFold(ext, ".igc") && !strings.EqualFold(ext, ".gpx") {
+			continue
+		}
+
+		result := importResult{File: file.Name}
+
+		data, err := readZipFile(file)
+		if err != nil {
+			result.Error = err.Error()
+			report = append(report, result)
+			continue
+		}
+
+		track, err := parseTrack(data)
+		if err != nil {
+			result.Error = "invalid track file: " + err.Error()
+			report = append(report, result)
+			continue
+		}
+
+		// The same duplicate detection as a single upload, files repeated in the archive included
+		trackInDB, err := s.tracks.GetTrackByHash(r.Context(), contentHash(data))
+		if err == nil {
+			result.DuplicateOf = trackInDB.UniqueID
+			report = append(report, result)
+			continue
+		}
+		if err != errNotFound {
+			serverError(w, err)
+			return
+		}
+
+		trackFile, err := s.storeTrack(r.Context(), track, data, "", path.Base(file.Name))
+		if err == errDuplicateContent {
+			// Added by another request in the meantime
+			trackInDB, err = s.tracks.GetTrackByHash(r.Context(), contentHash(data))
+			if err == nil {
+				result.DuplicateOf = trackInDB.UniqueID
+				report = append(report, result)
+				continue
+			}
+		}
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
+		result.ID = trackFile.UniqueID
+		report = append(report, result)
+		added++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// readZipFile returns the content of a file of the archive
+func readZipFile(file *zip.File) ([]byte, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return readIGC(rc)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	igc "github.com/marni/goigc"
+)
+
+// *** TRACK INGESTION *** //
+
+// igcContentType is the media type of a raw IGC file sent in the request body
+const igcContentType = "application/vnd.fai.igc"
+
+// maxIGCSize is the biggest IGC file accepted, in bytes
+const maxIGCSize = 10 << 20
+
+// igcFiles is the FileStore bucket of the original IGC files, by track ID
+const igcFiles = "igc_files"
+
+// fetchIGC downloads the IGC file at the URL
+// Unlike igc.ParseLocation, it never falls back to reading a local file
+func (s *server) fetchIGC(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(s.cfg.FetchTimeout))
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+
+	return readIGC(resp.Body)
+}
+
+// readIGC reads at most maxIGCSize bytes of IGC content
+func readIGC(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxIGCSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxIGCSize {
+		return nil, fmt.Errorf("the IGC file is bigger than %d bytes", maxIGCSize)
+	}
+	return data, nil
+}
+
+// parseTrack parses the content of a track file, either GPX or IGC
+func parseTrack(data []byte) (igc.Track, error) {
+	if isGPX(data) {
+		return parseGPX(data)
+	}
+	return parseIGC(data)
+}
+
+// parseIGC parses the content of an IGC file
+func parseIGC(data []byte) (igc.Track, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return igc.Track{}, fmt.Errorf("the IGC file is empty")
+	}
+	return igc.Parse(string(data))
+}
+
+// contentHash returns the SHA-256 of the IGC file, in hex
+// Line endings and trailing spaces are normalized and blank lines dropped first,
+// so the same flight downloaded from different places gets the same hash
+func contentHash(data []byte) string {
+	lines := strings.Split(string(data), "\n")
+	normalized := make([]string, 0, len(lines))
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line != "" {
+			normalized = append(normalized, line)
+		}
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(normalized, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// readUpload returns the IGC or GPX file sent in the request, either as the raw body
+// or as the "file" field of a multipart form, and the name of the uploaded file
+func readUpload(w http.ResponseWriter, r *http.Request) ([]byte, string, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if mediaType == igcContentType || mediaType == gpxContentType {
+		data, err := readIGC(r.Body)
+		return data, "", err
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxIGCSize+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return nil, "", fmt.Errorf("the multipart form needs a \"file\" field: %s", err)
+	}
+	defer file.Close()
+
+	data, err := readIGC(file)
+	return data, header.Filename, err
+}
+
+// addTrack stores the track parsed from data and calls the webhooks
+// It returns errDuplicateContent if the same file was already added
+func (s *server) addTrack(ctx context.Context, track igc.Track, data []byte, srcURL string, fileName string) (tracks, error) {
+	trackFile, err := s.storeTrack(ctx, track, data, srcURL, fileName)
+	if err != nil {
+		return tracks{}, err
+	}
+
+	s.triggerWhenTrackIsAdded(ctx, 1)
+
+	return trackFile, nil
+}
+
+// storeTrack stores the track parsed from data with a new ID and keeps the original file,
+// without calling the webhooks
+func (s *server) storeTrack(ctx context.Context, track igc.Track, data []byte, srcURL string, fileName string) (tracks, error) {
+
+	// Taking a new unique ID from the tracks counter
+	id, err := nextID(ctx, s.counters, "tracks")
+	if err != nil {
+		return tracks{}, err
+	}
+
+	// The length and statistics only count the fixes in flight
+	fixes := trackFixes(track)
+	stats := computeStats(fixes, time.Duration(s.cfg.StatsWindow))
+	geo := newTrackGeo(fixes)
+
+	trackFile := tracks{
+		UniqueID:     id,
+		Pilot:        track.Pilot,
+		Glider:       track.GliderType,
+		GliderID:     track.GliderID,
+		TrackLength:  stats.Distance,
+		Hdate:        track.Date.String(),
+		URL:          srcURL,
+		TimeRecorded: time.Now(),
+		FileName:     fileName,
+		ContentHash:  contentHash(data),
+		Stats:        stats,
+		Geo:          geo}
+
+	// The takeoff and the landing on the nearest sites of the catalogue
+	if geo != nil {
+		trackFile.TakeoffSite = nearestSite(s.sites, geo.Takeoff.Coordinates)
+		trackFile.LandingSite = nearestSite(s.sites, geo.Landing.Coordinates)
+	}
+
+	// The files are stored first, so a track in the store always has its file and fixes
+	if err = s.files.PutFile(ctx, igcFiles, id, data); err != nil {
+		return tracks{}, err
+	}
+	if err = s.saveFixes(ctx, id, fixes); err == nil {
+		err = s.tracks.AddTrack(ctx, trackFile)
+	}
+	if err != nil {
+		// The files of a track that was not added, like a duplicate, are not kept
+		s.files.DeleteFile(ctx, igcFiles, id)
+		s.files.DeleteFile(ctx, trackPoints, id)
+		return tracks{}, err
+	}
+
+	return trackFile, nil
+}
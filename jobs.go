@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// *** INGESTION JOBS *** //
+
+// States of an ingestion job, stored, duplicate and failed are final
+const (
+	jobQueued    = "queued"
+	jobFetching  = "fetching"
+	jobParsing   = "parsing"
+	jobStored    = "stored"
+	jobDuplicate = "duplicate" // the file was already added, the job has the ID of the existing track
+	jobFailed    = "failed"
+)
+
+// jobQueueSize is the number of jobs that can wait for a worker, more are refused until the queue drains
+const jobQueueSize = 100
+
+// errQueueFull is returned when a job can't be queued because every worker is busy and the queue is full
+var errQueueFull = errors.New("the ingestion queue is full")
+
+// ingestJob is the registration of a track from a URL, done in the background by the workers
+type ingestJob struct {
+	JobID   string    `json:"id"`
+	URL     string    `json:"url"`
+	State   string    `json:"state"`
+	TrackID string    `json:"track_id,omitempty"` // the new track, or the existing one if the file was already added
+	Error   string    `json:"error,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// finished tells if the job reached a final state
+func (job ingestJob) finished() bool {
+	return job.State == jobStored || job.State == jobDuplicate || job.State == jobFailed
+}
+
+// queueJob creates a job for the URL and hands it to the workers
+func (s *server) queueJob(ctx context.Context, url string) (ingestJob, error) {
+	id, err := nextID(ctx, s.counters, "jobs")
+	if err != nil {
+		return ingestJob{}, err
+	}
+
+	job := ingestJob{JobID: id, URL: url, State: jobQueued, Created: time.Now(), Updated: time.Now()}
+	if err = s.jobs.AddJob(ctx, job); err != nil {
+		return ingestJob{}, err
+	}
+
+	if !s.enqueue(job.JobID) {
+		job.State, job.Error, job.Updated = jobFailed, errQueueFull.Error(), time.Now()
+		if err = s.jobs.UpdateJob(ctx, job); err != nil {
+			return ingestJob{}, err
+		}
+		return ingestJob{}, errQueueFull
+	}
+	return job, nil
+}
+
+// enqueue passes the job ID to the workers without blocking the caller, it returns false when the queue is full
+func (s *server) enqueue(id string) bool {
+	select {
+	case s.jobQueue <- id:
+		return true
+	default:
+		return false
+	}
+}
+
+// startWorkers starts n workers processing the queue,
+// after queueing again the jobs left unfinished by the previous run
+func (s *server) startWorkers(ctx context.Context, n int) error {
+	pending, err := s.jobs.GetPendingJobs(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < n; i++ {
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			for {
+				select {
+				case id := <-s.jobQueue:
+					s.runJob(s.jobCtx, id)
+				case <-s.stopJobs:
+					return
+				}
+			}
+		}()
+	}
+
+	// The unfinished jobs can be more than the queue holds, one goroutine waits for room for them
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Created.Before(pending[j].Created) })
+	go func() {
+		for _, val := range pending {
+			select {
+			case s.jobQueue <- val.JobID:
+			case <-s.stopJobs:
+				// Left queued in the store, it is resumed on the next start
+				return
+			}
+		}
+	}()
+	if len(pending) > 0 {
+		log.Printf("Resumed %d ingestion jobs", len(pending))
+	}
+
+	return nil
+}
+
+// stopWorkers cancels the fetches in flight and waits for the workers to save their jobs, or until the context is done
+// The jobs that are still running are resumed on the next start
+func (s *server) stopWorkers(ctx context.Context) error {
+	close(s.stopJobs)
+	s.cancelJobs()
+
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runJob fetches, parses and stores the track of the job, saving each step in the store
+// Cancelling stop cancels the fetch, the job is then left unfinished to be resumed on the next start
+func (s *server) runJob(stop context.Context, id string) {
+	// The steps are saved even while the server stops
+	ctx := context.Background()
+
+	job, err := s.jobs.GetJob(ctx, id)
+	if err != nil {
+		log.Printf("Ingestion job %s: %s", id, err)
+		return
+	}
+
+	setState := func(state string) bool {
+		job.State = state
+		job.Updated = time.Now()
+		if err := s.jobs.UpdateJob(ctx, job); err != nil {
+			log.Printf("Ingestion job %s: %s", id, err)
+			return false
+		}
+		return true
+	}
+	fail := func(err error) {
+		job.Error = err.Error()
+		setState(jobFailed)
+	}
+	duplicate := func(trackID string) {
+		job.TrackID = trackID
+		setState(jobDuplicate)
+	}
+
+	if !setState(jobFetching) {
+		return
+	}
+	data, err := s.fetchIGC(stop, job.URL)
+	if stop.Err() != nil {
+		log.Printf("Ingestion job %s: stopped while fetching", id)
+		return
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	if !setState(jobParsing) {
+		return
+	}
+	track, err := parseTrack(data)
+	if err != nil {
+		fail(fmt.Errorf("invalid track file: %s", err))
+		return
+	}
+
+	trackInDB, err := s.tracks.GetTrackByHash(ctx, contentHash(data))
+	if err == nil {
+		duplicate(trackInDB.UniqueID)
+		return
+	}
+	if err != errNotFound {
+		fail(err)
+		return
+	}
+
+	trackFile, err := s.addTrack(ctx, track, data, job.URL, "")
+	if err == errDuplicateContent {
+		// The same file was added by another request since the check
+		trackInDB, err = s.tracks.GetTrackByHash(ctx, contentHash(data))
+		if err == nil {
+			duplicate(trackInDB.UniqueID)
+			return
+		}
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	job.TrackID = trackFile.UniqueID
+	setState(jobStored)
+}
+
+// Handles path: GET /api/jobs/<id>
+// Returns the state of the ingestion job, with the track ID once it is stored
+func (s *server) handlerJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "501 - Method not implemented", http.StatusNotImplemented)
+		return
+	}
+
+	job, err := s.jobs.GetJob(r.Context(), mux.Vars(r)["id"])
+	if err == errNotFound {
+		http.Error(w, "404 - The job with that id doesn't exists in our database", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// waitJob polls the job until it is finished
+func waitJob(t *testing.T, s *server, id string) ingestJob {
+	for i := 0; i < 100; i++ {
+		job, err := s.jobs.GetJob(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.finished() {
+			return job
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Job %s did not finish", id)
+	return ingestJob{}
+}
+
+func Test_ingestJob(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/sample.igc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Mock host of the IGC files
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sample.igc" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer files.Close()
+
+	s := newTestServer()
+	if err := s.startWorkers(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	defer s.stopWorkers(context.Background())
+
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+
+	testCases := []struct {
+		url   string
+		state string
+	}{
+		{files.URL + "/sample.igc", jobStored},
+		{files.URL + "/missing.igc", jobFailed},
+		{files.URL + "/sample.igc?mirror=2", jobDuplicate}, // same content as the first one
+	}
+
+	var trackID string
+	for _, tc := range testCases {
+		body, _ := json.Marshal(_url{URL: tc.url})
+		resp, err := http.Post(ts.URL+"/paragliding/api/track", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Error executing the POST request, %s", err)
+		}
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode, tc.url)
+
+		var accepted map[string]string
+		json.NewDecoder(resp.Body).Decode(&accepted)
+		assert.Equal(t, "/paragliding/api/jobs/"+accepted["job_id"], resp.Header.Get("Location"))
+
+		job := waitJob(t, s, accepted["job_id"])
+		assert.Equal(t, tc.state, job.State, tc.url)
+
+		resp, err = http.Get(ts.URL + "/paragliding/api/jobs/" + accepted["job_id"])
+		if err != nil {
+			t.Fatalf("Error making the GET request, %s", err)
+		}
+		var shown ingestJob
+		json.NewDecoder(resp.Body).Decode(&shown)
+		assert.Equal(t, tc.state, shown.State, tc.url)
+
+		switch tc.state {
+		case jobStored:
+			trackID = job.TrackID
+		case jobFailed:
+			assert.NotEmpty(t, job.Error, tc.url)
+		}
+	}
+
+	// The duplicate points to the track of the first job
+	job, _ := s.jobs.GetJob(context.Background(), "1002")
+	assert.Equal(t, trackID, job.TrackID)
+
+	track, err := s.tracks.GetTrack(context.Background(), trackID)
+	assert.Nil(t, err)
+	assert.Equal(t, files.URL+"/sample.igc", track.URL)
+
+	resp, _ := http.Get(ts.URL + "/paragliding/api/jobs/999999")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func Test_startWorkers_Resume(t *testing.T) {
+	files := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer files.Close()
+
+	s := newTestServer()
+
+	// A job interrupted by a restart while it was fetching
+	interrupted := ingestJob{JobID: "1000", URL: files.URL + "/sample.igc", State: jobFetching, Created: time.Now()}
+	if err := s.jobs.AddJob(context.Background(), interrupted); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.startWorkers(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	defer s.stopWorkers(context.Background())
+
+	job := waitJob(t, s, "1000")
+	assert.Equal(t, jobStored, job.State)
+	assert.NotEmpty(t, job.TrackID)
+}
+
+// staleHashStore misses the first lookup by hash, as if the track was added right after it
+type staleHashStore struct {
+	TrackStore
+	missed bool
+}
+
+func (st *staleHashStore) GetTrackByHash(ctx context.Context, hash string) (tracks, error) {
+	if !st.missed {
+		st.missed = true
+		return tracks{}, errNotFound
+	}
+	return st.TrackStore.GetTrackByHash(ctx, hash)
+}
+
+func Test_runJob_DuplicateRace(t *testing.T) {
+	files := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer files.Close()
+
+	s := newTestServer()
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+	existing := postTrackFile(t, ts, "sample.igc")
+	s.tracks = &staleHashStore{TrackStore: s.tracks}
+
+	job := ingestJob{JobID: "1000", URL: files.URL + "/sample.igc", State: jobQueued, Created: time.Now()}
+	if err := s.jobs.AddJob(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	s.runJob(context.Background(), job.JobID)
+
+	job, _ = s.jobs.GetJob(context.Background(), job.JobID)
+	assert.Equal(t, jobDuplicate, job.State)
+	assert.Equal(t, existing, job.TrackID)
+}
+
+func Test_queueJob_Full(t *testing.T) {
+	s := newTestServer()
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+
+	// No worker takes the jobs off the queue
+	for i := 0; i < jobQueueSize; i++ {
+		s.jobQueue <- "0"
+	}
+
+	body, _ := json.Marshal(_url{URL: "http://example.com/sample.igc"})
+	resp, err := http.Post(ts.URL+"/paragliding/api/track", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error executing the POST request, %s", err)
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	job, err := s.jobs.GetJob(context.Background(), "1000")
+	if assert.Nil(t, err) {
+		assert.Equal(t, jobFailed, job.State)
+	}
+}
+
+func Test_stopWorkers_CancelFetch(t *testing.T) {
+	// A host that never answers
+	fetching := make(chan struct{})
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(fetching)
+		<-r.Context().Done()
+	}))
+	defer files.Close()
+
+	s := newTestServer()
+	if err := s.startWorkers(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	job, err := s.queueJob(context.Background(), files.URL+"/sample.igc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-fetching
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, s.stopWorkers(ctx))
+
+	// Left unfinished, to be resumed on the next start
+	job, _ = s.jobs.GetJob(context.Background(), job.JobID)
+	assert.Equal(t, jobFetching, job.State)
+}
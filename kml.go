@@ -0,0 +1,278 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// *** KML EXPORT *** //
+
+const (
+	kmlContentType = "application/vnd.google-earth.kml+xml"
+	kmzContentType = "application/vnd.google-earth.kmz"
+
+	// varioWindow is the time over which the climb rate coloring the track is averaged
+	varioWindow = 10 * time.Second
+)
+
+// varioSteps are the upper climb rates, in m/s, of the colors of the track but the last one
+var varioSteps = []float64{-3, -1.5, -0.5, 0.5, 1.5, 3}
+
+// varioColors go from the strong sink in dark blue to the strong climb in red, as KML aabbggrr colors
+var varioColors = []string{"ff8b0000", "ffff0000", "ffffff00", "ff00ff00", "ff00ffff", "ff0080ff", "ff0000ff"}
+
+type kmlDocument struct {
+	XMLName    xml.Name       `xml:"kml"`
+	XMLNS      string         `xml:"xmlns,attr"`
+	XMLNSGX    string         `xml:"xmlns:gx,attr"`
+	Name       string         `xml:"Document>name"`
+	Styles     []kmlStyle     `xml:"Document>Style"`
+	Placemarks []kmlPlacemark `xml:"Document>Placemark"`
+	Folders    []kmlFolder    `xml:"Document>Folder"`
+}
+
+// kmlStyle is the style of the lines and their curtain, or the icon of the points
+type kmlStyle struct {
+	ID        string        `xml:"id,attr"`
+	LineStyle *kmlLineStyle `xml:"LineStyle"`
+	PolyStyle *kmlPolyStyle `xml:"PolyStyle"`
+	IconStyle *kmlIconStyle `xml:"IconStyle"`
+}
+
+type kmlLineStyle struct {
+	Color string `xml:"color"`
+	Width int    `xml:"width"`
+}
+
+type kmlPolyStyle struct {
+	Color string `xml:"color"`
+}
+
+type kmlIconStyle struct {
+	Href string `xml:"Icon>href"`
+}
+
+// newLineStyle returns the style of a line in the color, with a transparent curtain of the same color
+func newLineStyle(id string, color string, width int) kmlStyle {
+	return kmlStyle{ID: id, LineStyle: &kmlLineStyle{Color: color, Width: width}, PolyStyle: &kmlPolyStyle{Color: "40" + color[2:]}}
+}
+
+// newIconStyle returns the style of a point with the icon
+func newIconStyle(id string, href string) kmlStyle {
+	return kmlStyle{ID: id, IconStyle: &kmlIconStyle{Href: href}}
+}
+
+type kmlFolder struct {
+	Name       string         `xml:"name"`
+	Placemarks []kmlPlacemark `xml:"Placemark"`
+}
+
+// kmlPlacemark has one geometry: the timed track, a line or a point
+type kmlPlacemark struct {
+	Name        string         `xml:"name"`
+	Description string         `xml:"description,omitempty"`
+	StyleURL    string         `xml:"styleUrl,omitempty"`
+	TimeSpan    *kmlTimeSpan   `xml:"TimeSpan"`
+	Track       *kmlTrack      `xml:"gx:Track"`
+	LineString  *kmlLineString `xml:"LineString"`
+	Point       *kmlGeometry   `xml:"Point"`
+}
+
+type kmlTimeSpan struct {
+	Begin string `xml:"begin,omitempty"`
+	End   string `xml:"end,omitempty"`
+}
+
+// kmlTrack is the timed track, for the animation in Google Earth
+type kmlTrack struct {
+	Extrude      int      `xml:"extrude"`
+	AltitudeMode string   `xml:"altitudeMode"`
+	When         []string `xml:"when"`
+	Coords       []string `xml:"gx:coord"`
+}
+
+type kmlLineString struct {
+	Extrude      int    `xml:"extrude"`
+	Tessellate   int    `xml:"tessellate"`
+	AltitudeMode string `xml:"altitudeMode"`
+	Coordinates  string `xml:"coordinates"`
+}
+
+type kmlGeometry struct {
+	AltitudeMode string `xml:"altitudeMode"`
+	Coordinates  string `xml:"coordinates"`
+}
+
+// kmlCoordinates returns the position of the fix as KML coordinates: longitude, latitude, altitude
+func kmlCoordinates(val fix, useGNSS bool) string {
+	return fmt.Sprintf("%g,%g,%d", val.Lon, val.Lat, fixAltitude(val, useGNSS))
+}
+
+// varioClass returns the index in varioColors of the climb rate
+func varioClass(vario float64) int {
+	for key, val := range varioSteps {
+		if vario < val {
+			return key
+		}
+	}
+	return len(varioSteps)
+}
+
+// kmlTime formats the time of a fix for the KML timestamps
+func kmlTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// varioLines cuts the flights in lines of about the same climb rate, averaged over varioWindow
+func varioLines(fixes []fix, useGNSS bool) []kmlPlacemark {
+	lines := []kmlPlacemark{}
+	for _, flight := range flagged(fixes) {
+		// k is the first fix at most one window before the fix i
+		k := flight.Start
+		var coordinates []string
+		class := -1
+		for i := flight.Start + 1; i <= flight.End; i++ {
+			for k < i-1 && fixes[i].Time.Sub(fixes[k].Time) > varioWindow {
+				k++
+			}
+			vario := 0.0
+			if seconds := fixes[i].Time.Sub(fixes[k].Time).Seconds(); seconds > 0 {
+				vario = float64(fixAltitude(fixes[i], useGNSS)-fixAltitude(fixes[k], useGNSS)) / seconds
+			}
+
+			// A new line starts at the end of the previous one
+			if next := varioClass(vario); next != class {
+				if class >= 0 {
+					lines = append(lines, newVarioLine(class, coordinates))
+				}
+				class = next
+				coordinates = []string{kmlCoordinates(fixes[i-1], useGNSS)}
+			}
+			coordinates = append(coordinates, kmlCoordinates(fixes[i], useGNSS))
+		}
+		if class >= 0 {
+			lines = append(lines, newVarioLine(class, coordinates))
+		}
+	}
+	return lines
+}
+
+// newVarioLine returns the line in the color of the climb rate class
+func newVarioLine(class int, coordinates []string) kmlPlacemark {
+	var name string
+	switch class {
+	case 0:
+		name = fmt.Sprintf("below %g m/s", varioSteps[0])
+	case len(varioSteps):
+		name = fmt.Sprintf("above %g m/s", varioSteps[class-1])
+	default:
+		name = fmt.Sprintf("%g to %g m/s", varioSteps[class-1], varioSteps[class])
+	}
+	return kmlPlacemark{
+		Name:     name,
+		StyleURL: fmt.Sprintf("#vario%d", class),
+		LineString: &kmlLineString{
+			Extrude:      1,
+			Tessellate:   1,
+			AltitudeMode: "absolute",
+			Coordinates:  strings.Join(coordinates, " "),
+		},
+	}
+}
+
+// newKML returns the KML document of the track: the timed track, the takeoff, the landing,
+// the track colored by the climb rate and the thermals. Every altitude is absolute, the lines extruded to the ground
+func newKML(track tracks, fixes []fix) kmlDocument {
+	useGNSS := hasGNSSAltitude(fixes)
+
+	// The document is named after the pilot and the day of the flight
+	name := track.Pilot
+	if len(fixes) > 0 {
+		name = strings.TrimSpace(name + " " + fixes[0].Time.UTC().Format("2006-01-02"))
+	}
+
+	doc := kmlDocument{
+		XMLNS:   "http://www.opengis.net/kml/2.2",
+		XMLNSGX: "http://www.google.com/kml/ext/2.2",
+		Name:    name,
+		Styles: []kmlStyle{
+			newLineStyle("track", "ff00ffff", 2),
+			newIconStyle("takeoff", "http://maps.google.com/mapfiles/kml/paddle/grn-circle.png"),
+			newIconStyle("landing", "http://maps.google.com/mapfiles/kml/paddle/red-circle.png"),
+			newIconStyle("thermal", "http://maps.google.com/mapfiles/kml/shapes/arrow.png"),
+		},
+	}
+	for key, val := range varioColors {
+		doc.Styles = append(doc.Styles, newLineStyle(fmt.Sprintf("vario%d", key), val, 3))
+	}
+
+	// gx:coord separates the longitude, latitude and altitude with spaces
+	timed := &kmlTrack{Extrude: 1, AltitudeMode: "absolute"}
+	for _, val := range fixes {
+		timed.When = append(timed.When, kmlTime(val.Time))
+		timed.Coords = append(timed.Coords, strings.Replace(kmlCoordinates(val, useGNSS), ",", " ", -1))
+	}
+	doc.Placemarks = append(doc.Placemarks, kmlPlacemark{Name: "Track", StyleURL: "#track", Track: timed})
+
+	// The first flight starts at the takeoff, the last one ends at the landing
+	if flights := flagged(fixes); len(flights) > 0 {
+		takeoff, landing := fixes[flights[0].Start], fixes[flights[len(flights)-1].End]
+		doc.Placemarks = append(doc.Placemarks,
+			kmlPlacemark{
+				Name:     "Takeoff",
+				StyleURL: "#takeoff",
+				TimeSpan: &kmlTimeSpan{Begin: kmlTime(takeoff.Time)},
+				Point:    &kmlGeometry{AltitudeMode: "absolute", Coordinates: kmlCoordinates(takeoff, useGNSS)},
+			},
+			kmlPlacemark{
+				Name:     "Landing",
+				StyleURL: "#landing",
+				TimeSpan: &kmlTimeSpan{Begin: kmlTime(landing.Time)},
+				Point:    &kmlGeometry{AltitudeMode: "absolute", Coordinates: kmlCoordinates(landing, useGNSS)},
+			})
+	}
+
+	doc.Folders = append(doc.Folders, kmlFolder{Name: "Climb rate", Placemarks: varioLines(fixes, useGNSS)})
+
+	// The thermals are shown while the glider circles in them, at the exit altitude
+	thermals := kmlFolder{Name: "Thermals", Placemarks: []kmlPlacemark{}}
+	for _, val := range detectThermals(fixes) {
+		thermals.Placemarks = append(thermals.Placemarks, kmlPlacemark{
+			Name: fmt.Sprintf("%+.1f m/s", val.Climb),
+			Description: fmt.Sprintf("%d m to %d m in %d s, %.1f turns %s",
+				val.EntryAltitude, val.ExitAltitude, val.Duration, val.Turns, val.Direction),
+			StyleURL: "#thermal",
+			TimeSpan: &kmlTimeSpan{Begin: kmlTime(val.Start), End: kmlTime(val.End)},
+			Point:    &kmlGeometry{AltitudeMode: "absolute", Coordinates: fmt.Sprintf("%g,%g,%d", val.Lon, val.Lat, val.ExitAltitude)},
+		})
+	}
+	doc.Folders = append(doc.Folders, thermals)
+	return doc
+}
+
+// writeKML writes the track as a KML document
+func writeKML(w io.Writer, track tracks, fixes []fix) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(newKML(track, fixes))
+}
+
+// writeKMZ writes the track as a KMZ archive, the KML document zipped as doc.kml
+func writeKMZ(w io.Writer, track tracks, fixes []fix) error {
+	archive := zip.NewWriter(w)
+	file, err := archive.Create("doc.kml")
+	if err != nil {
+		return err
+	}
+	if err = writeKML(file, track, fixes); err != nil {
+		return err
+	}
+	return archive.Close()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newKML(t *testing.T) {
+	fixes := circlingFixes()
+	doc := newKML(tracks{Pilot: "Jane Doe"}, fixes)
+
+	assert.Equal(t, "Jane Doe 2018-07-02", doc.Name)
+	if assert.Len(t, doc.Placemarks, 3) {
+		assert.Len(t, doc.Placemarks[0].Track.When, len(fixes))
+		assert.Equal(t, "absolute", doc.Placemarks[0].Track.AltitudeMode)
+		assert.Equal(t, 1, doc.Placemarks[0].Track.Extrude)
+		assert.Equal(t, "6 45 2000", doc.Placemarks[0].Track.Coords[0])
+		assert.Equal(t, "Takeoff", doc.Placemarks[1].Name)
+		assert.Equal(t, "Landing", doc.Placemarks[2].Name)
+	}
+
+	// Sinking at 1 m/s, climbing at 2 m/s in the thermal, then sinking again
+	lines := doc.Folders[0].Placemarks
+	if assert.True(t, len(lines) >= 3) {
+		assert.Equal(t, "#vario2", lines[0].StyleURL)
+		assert.Equal(t, "#vario2", lines[len(lines)-1].StyleURL)
+		styles := []string{}
+		for _, val := range lines {
+			styles = append(styles, val.StyleURL)
+		}
+		assert.Contains(t, styles, "#vario5")
+	}
+
+	thermals := doc.Folders[1].Placemarks
+	if assert.Len(t, thermals, 1) {
+		assert.Equal(t, "+2.0 m/s", thermals[0].Name)
+		assert.NotEmpty(t, thermals[0].TimeSpan.End)
+	}
+}
+
+func Test_handlerExport_KML(t *testing.T) {
+
+	s := newTestServer()
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+
+	trackID := postTrackFile(t, ts, "sample.igc")
+
+	resp, _ := http.Get(ts.URL + "/paragliding/api/track/" + trackID + ".kml")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, kmlContentType, resp.Header.Get("Content-Type"))
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "<gx:Track>")
+
+	var doc kmlDocument
+	assert.Nil(t, xml.Unmarshal(body, &doc))
+	assert.Equal(t, "Jane Doe 2018-07-02", doc.Name)
+
+	// The KMZ is the same document, zipped
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/" + trackID + ".kmz")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, kmzContentType, resp.Header.Get("Content-Type"))
+	zipped, _ := ioutil.ReadAll(resp.Body)
+	archive, err := zip.NewReader(bytes.NewReader(zipped), int64(len(zipped)))
+	if assert.Nil(t, err) && assert.Len(t, archive.File, 1) {
+		assert.Equal(t, "doc.kml", archive.File[0].Name)
+		file, _ := archive.File[0].Open()
+		unzipped, _ := ioutil.ReadAll(file)
+		assert.Equal(t, body, unzipped)
+	}
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/999999.kml")
+	assert.Equal(t, 404, resp.StatusCode)
+}
@@ -1,19 +1,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http" //"html/template"
 	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
 	"time" //"path/filepath"
 
 	"github.com/gorilla/mux"
-	igc "github.com/marni/goigc"
 )
 
 var timeStarted = time.Now()
-var uniqueID int
 
 
 type tracks struct {
@@ -25,6 +27,13 @@ type tracks struct {
 	Hdate        string
 	URL          string
 	TimeRecorded time.Time
+	LegacyID     string      // old random ID of the track, before the IDs were made unique
+	FileName     string      // name of the uploaded file, empty when the track was fetched from URL
+	ContentHash  string      `bson:"contenthash,omitempty"` // SHA-256 of the normalized IGC file, empty for old tracks
+	Stats        flightStats // zero for the tracks added before the statistics were kept
+	Geo          *trackGeo   `bson:"geo,omitempty"` // nil for the tracks without a flight or added before the spatial queries
+	TakeoffSite  string      // ID of the site of the takeoff, empty when it is on no site of the catalogue
+	LandingSite  string      // ID of the site of the landing
 }
 
 //FloatToString : convert a float number to a string
@@ -37,18 +46,6 @@ type _url struct {
 	URL string `json:"url"`
 }
 
-//Calculating the total length of track
-func trackLength(track igc.Track) float64 {
-
-	totalDistance := 0.0
-
-	for i := 0; i < len(track.Points)-1; i++ {
-		totalDistance += track.Points[i].Distance(track.Points[i+1])
-	}
-
-	return totalDistance
-}
-
 //Calculating uptime based on ISO 8601
 func timeSince(t time.Time) string {
 
@@ -72,32 +69,154 @@ func timeSince(t time.Time) string {
 	return fmt.Sprintf("P%dY%dD%dH%dM%d.%dS", y, d, h, m, s, f)
 }
 
-func main() {
+// server holds the dependencies shared by the handlers
+type server struct {
+	cfg      Config
+	tracks   TrackStore
+	webhooks WebhookStore
+	counters CounterStore
+	files    FileStore
+	jobs     JobStore
+	tasks    TaskStore
+	sites    []site // the catalogue of sites, read at boot
+
+	deliveries sync.WaitGroup // webhook deliveries still running
+
+	clockMu          sync.Mutex
+	latestTrackCount int64 // number of tracks at the previous clock check
+
+	taskMu sync.Mutex // serializes the changes of the tracks of the tasks
+
+	jobQueue   chan string        // IDs of the ingestion jobs waiting for a worker
+	stopJobs   chan struct{}      // closed to stop the workers
+	jobCtx     context.Context    // cancelled to stop the fetches of the running jobs
+	cancelJobs context.CancelFunc // cancels jobCtx
+	workers    sync.WaitGroup     // running ingestion workers
+}
+
+// newServer returns a server using the store for everything
+func newServer(cfg Config, store Store) *server {
+	jobCtx, cancelJobs := context.WithCancel(context.Background())
+	return &server{
+		cfg:      cfg,
+		tracks:   store,
+		webhooks: store,
+		counters: store,
+		files:    store,
+		jobs:     store,
+		tasks:    store,
+		jobQueue: make(chan string, jobQueueSize),
+		stopJobs: make(chan struct{}),
+
+		jobCtx:     jobCtx,
+		cancelJobs: cancelJobs,
+
+		latestTrackCount: 1,
+	}
+}
+
+// newRouter registers every path of the API on a new router
+func newRouter(s *server) *mux.Router {
 	r := mux.NewRouter()
 	r.HandleFunc("/paragliding", handler)
 	r.HandleFunc("/paragliding/api", handlerAPI)
 	//Handling Track
-	r.HandleFunc("/paragliding/api/track", handlerTrack)
-	r.HandleFunc("/paragliding/api/track/{id}", handlerID)
-	r.HandleFunc("/paragliding/api/track/{id}/{field}", handlerField)
+	r.HandleFunc("/paragliding/api/track", s.handlerTrack)
+	r.HandleFunc("/paragliding/api/track/{id:[^/.]+}.{format}", s.handlerExport)
+	r.HandleFunc("/paragliding/api/track/{id}", s.handlerID)
+	r.HandleFunc("/paragliding/api/track/{id}/points", s.handlerPoints)
+	r.HandleFunc("/paragliding/api/track/{id}/stats", s.handlerStats)
+	r.HandleFunc("/paragliding/api/track/{id}/thermals", s.handlerThermals)
+	r.HandleFunc("/paragliding/api/track/{id}/glides", s.handlerGlides)
+	r.HandleFunc("/paragliding/api/track/{id}/score", s.handlerScore)
+	r.HandleFunc("/paragliding/api/track/{id}/igc", s.handlerIGC)
+	r.HandleFunc("/paragliding/api/track/{id}/task/{task_id}", s.handlerTaskValidation)
+	r.HandleFunc("/paragliding/api/track/{id}/{field}", s.handlerField)
+	//Handling the ingestion jobs
+	r.HandleFunc("/paragliding/api/jobs/{id}", s.handlerJob)
+
+	r.HandleFunc("/paragliding/api/task", s.handlerTask)
+	r.HandleFunc("/paragliding/api/task/{id}", s.handlerTaskID)
+	r.HandleFunc("/paragliding/api/task/{id}/tracks", s.handlerTaskTracks)
+	r.HandleFunc("/paragliding/api/task/{id}/tracks/{track_id}", s.handlerTaskTrack)
+	r.HandleFunc("/paragliding/api/task/{id}/results", s.handlerTaskResults)
+	//Handling the sites
+	r.HandleFunc("/paragliding/api/site", s.handlerSite)
+	r.HandleFunc("/paragliding/api/site/{id}", s.handlerSiteID)
+	r.HandleFunc("/paragliding/api/site/{id}/tracks", s.handlerSiteTracks)
+	r.HandleFunc("/paragliding/api/site/{id}/stats", s.handlerSiteStats)
 	//Handling ticker
-	r.HandleFunc("/paragliding/api/ticker/latest", handlerTickerLatest)
-	r.HandleFunc("/paragliding/api/ticker", handlerTicker)
-	r.HandleFunc("/paragliding/api/ticker/{timestamp}", handlerTickerTimestamp)
+	r.HandleFunc("/paragliding/api/ticker/latest", s.handlerTickerLatest)
+	r.HandleFunc("/paragliding/api/ticker", s.handlerTicker)
+	r.HandleFunc("/paragliding/api/ticker/{timestamp}", s.handlerTickerTimestamp)
 	//Handling the webhooks
-	r.HandleFunc("/paragliding/api/webhook/new_track/", webhookNewTrack)
-	r.HandleFunc("/paragliding/api/webhook/new_track/{webhook_id}", webhookID)
+	r.HandleFunc("/paragliding/api/webhook/new_track/", s.webhookNewTrack)
+	r.HandleFunc("/paragliding/api/webhook/new_track/{webhook_id}", s.webhookID)
 	//Handling the admin part
-	r.HandleFunc("/paragliding/admin/api/tracks_count", adminAPITracksCount)
-	r.HandleFunc("/paragliding/admin/api/tracks", adminAPITracks)
-	r.HandleFunc("/paragliding/admin/api/webhooks", adminAPIWebhookTrigger)
+	r.HandleFunc("/paragliding/admin/api/tracks_count", s.adminOnly(s.adminAPITracksCount))
+	r.HandleFunc("/paragliding/admin/api/tracks", s.adminOnly(s.adminAPITracks))
+	r.HandleFunc("/paragliding/admin/api/webhooks", s.adminOnly(s.adminAPIWebhookTrigger))
+	r.HandleFunc("/paragliding/admin/api/config", s.adminOnly(s.adminAPIConfig))
+	r.HandleFunc("/paragliding/admin/api/import", s.adminOnly(s.adminAPIImport))
+
+	return r
+}
 
-	err := http.ListenAndServe(":"+os.Getenv("PORT"), r)
+func main() {
+	cfg, err := loadConfig()
 	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		log.Fatal("Invalid configuration: ", err)
 	}
 
-	/*if err := http.ListenAndServe(":8080", r); err != nil {
-		log.Fatal(err)
-	}*/
+	// A single store (and database client) is shared by every request
+	store, err := openStore(cfg)
+	if err != nil {
+		log.Fatal("Opening the store: ", err)
+	}
+
+	s := newServer(cfg, store)
+	if s.sites, err = loadSites(cfg.SitesFile); err != nil {
+		log.Fatal("Loading the sites: ", err)
+	}
+
+	if err := s.startWorkers(context.Background(), cfg.IngestWorkers); err != nil {
+		log.Fatal("Starting the ingestion workers: ", err)
+	}
+
+	if cfg.ClockInterval > 0 {
+		go s.runClock(time.Duration(cfg.ClockInterval))
+	}
+
+	httpServer := &http.Server{Addr: ":" + cfg.Port, Handler: newRouter(s)}
+
+	go func() {
+		err := httpServer.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Fatal("ListenAndServe: ", err)
+		}
+	}()
+
+	// Wait for the dyno to be stopped or restarted
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	log.Println("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownWait))
+	defer cancel()
+
+	// Drain the requests in flight first, then the ingestion jobs, they can still start webhook deliveries
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Println("Shutting down the HTTP server: ", err)
+	}
+	if err := s.stopWorkers(ctx); err != nil {
+		log.Println("Waiting for the ingestion jobs: ", err)
+	}
+	if err := s.waitDeliveries(ctx); err != nil {
+		log.Println("Waiting for the webhook deliveries: ", err)
+	}
+	if err := store.Close(ctx); err != nil {
+		log.Println("Closing the store: ", err)
+	}
 }
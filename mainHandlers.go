@@ -1,19 +1,16 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"log"
-	"math/rand"
+	"mime"
 	"net/http"
+	"net/url"
 	"regexp"
-	"strconv"
 	"strings"
-	"time"
 
 	"github.com/gorilla/mux"
-	igc "github.com/marni/goigc"
 )
 
 //Handling based in parsing url
@@ -25,10 +22,22 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Path != "/paragliding" {
+		http.Error(w, "404 - Page not found", http.StatusNotFound)
+		return
+	}
+
 	// Redirect to /paragliding/api
 	http.Redirect(w, r, "/paragliding/api", 302)
 
 }
+
+// serverError logs the error and sends a 500 response to the user
+func serverError(w http.ResponseWriter, err error) {
+	log.Println(err)
+	http.Error(w, "500 - Internal Server Error", http.StatusInternalServerError)
+}
+
 func handlerAPI(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -46,110 +55,214 @@ func handlerAPI(w http.ResponseWriter, r *http.Request) {
 }
 
 //Handling for /paragliding/api/track
-func handlerTrack(w http.ResponseWriter, r *http.Request) {
+func (s *server) handlerTrack(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	switch r.Method {
 	//Handling GET /paragliding/api/track for returning all ids storing in database
 	case http.MethodGet:
 
-		client := mongoConnect()
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "json" && format != "csv" {
+			http.Error(w, "400 - Bad Request, format must be json or csv", http.StatusBadRequest)
+			return
+		}
 
-		ids := getTrackID(client)
+		q, err := parseTrackQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, "400 - Bad Request, "+err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		fmt.Fprint(w, ids)
+		// The catalogue of the tracks with their statistics, for spreadsheets
+		if format == "csv" {
+			s.writeCatalogueCSV(w, r, q)
+			return
+		}
+		s.writeTrackList(w, r, q)
 
 	case http.MethodPost:
 
-		//handling post /igcinfo/api/igc for sending a url and returning an id for that url
-		pattern := ".*.igc"
-
-		URL := &_url{}
-
-		var error = json.NewDecoder(r.Body).Decode(URL)
-		if error != nil {
-			fmt.Fprintln(w, "Error!! ", error)
-			return
+		// The IGC or GPX file is either uploaded directly, or fetched from the URL sent as JSON
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "multipart/form-data", igcContentType, gpxContentType:
+			s.postTrackUpload(w, r)
+		default:
+			s.postTrackURL(w, r)
 		}
-		res, err := regexp.MatchString(pattern, URL.URL)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if res {
-			ID := rand.Intn(1000)
 
-			track, err := igc.ParseLocation(URL.URL)
-			if err != nil {
-				fmt.Fprintln(w, "Error made: ", err)
-				return
-			}
+	default:
+		http.Error(w, "Not implemented", http.StatusNotImplemented)
+		return
+	}
 
-			track.UniqueID = strconv.Itoa(ID)
+}
 
-			trackFile := tracks{}
+// postTrackURL queues the registration of the IGC or GPX file found at the URL sent as {"url": ...}
+func (s *server) postTrackURL(w http.ResponseWriter, r *http.Request) {
 
-			timestamp := time.Now().Second()
-			timestamp = timestamp * 1000
+	//handling post /igcinfo/api/igc for sending a url and returning an id for that url
+	pattern := ".*.(igc|gpx)"
 
-			client := mongoConnect()
+	URL := &_url{}
 
-			collection := client.Database("igcfiles").Collection("tracks")
+	var error = json.NewDecoder(r.Body).Decode(URL)
+	if error != nil {
+		fmt.Fprintln(w, "Error!! ", error)
+		return
+	}
+	res, err := regexp.MatchString(pattern, URL.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !res {
+		return
+	}
 
-			// Checking for duplicates so that the user doesn't add into the database igc files with the same URL
-			duplicate := urlInMongo(URL.URL, collection)
+	// Checking for duplicates so that the user doesn't add into the database igc files with the same URL
+	trackInDB, err := s.tracks.GetTrackByURL(r.Context(), URL.URL)
+	if err == nil {
+		trackConflict(w, trackInDB.UniqueID)
+		return
+	}
+	if err != errNotFound {
+		serverError(w, err)
+		return
+	}
 
-			if !duplicate {
+	// The file is fetched in the background, the user follows the job to get the track ID
+	job, err := s.queueJob(r.Context(), URL.URL)
+	if err == errQueueFull {
+		http.Error(w, "503 - Service Unavailable, "+err.Error()+", try again later", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/paragliding/api/jobs/"+job.JobID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"job_id": job.JobID})
+}
 
-				trackFile = tracks{
-					track.UniqueID,
-					track.Pilot,
-					track.GliderType,
-					track.GliderID,
-					trackLength(track),
-					track.Date.String(),
-					URL.URL, time.Now()}
+// postTrackUpload registers the IGC or GPX file sent as the raw body or as a multipart form
+func (s *server) postTrackUpload(w http.ResponseWriter, r *http.Request) {
+	data, fileName, err := readUpload(w, r)
+	if err != nil {
+		http.Error(w, "400 - Bad Request, "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
-				res, err := collection.InsertOne(context.Background(), trackFile)
-				if err != nil {
-					log.Fatal(err)
-				}
+	s.postTrack(w, r, data, "", fileName)
+}
 
-				id := res.InsertedID
+// postTrack parses and stores the IGC or GPX file, then sends the new ID to the user
+func (s *server) postTrack(w http.ResponseWriter, r *http.Request, data []byte, srcURL string, fileName string) {
+	track, err := parseTrack(data)
+	if err != nil {
+		http.Error(w, "400 - Bad Request, invalid track file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
-				if id == nil {
-					http.Error(w, "", 300)
-				}
+	// The same file can come from another URL, or be uploaded again
+	trackInDB, err := s.tracks.GetTrackByHash(r.Context(), contentHash(data))
+	if err == nil {
+		trackConflict(w, trackInDB.UniqueID)
+		return
+	}
+	if err != errNotFound {
+		serverError(w, err)
+		return
+	}
 
-				// Encoding the ID of the track that was just added to DB
-				fmt.Fprint(w, "{\n\"id\":\""+track.UniqueID+"\"\n}")
+	trackFile, err := s.addTrack(r.Context(), track, data, srcURL, fileName)
+	if err == errDuplicateContent {
+		// Added by another request in the meantime
+		trackInDB, err = s.tracks.GetTrackByHash(r.Context(), contentHash(data))
+		if err == nil {
+			trackConflict(w, trackInDB.UniqueID)
+			return
+		}
+	}
+	if err != nil {
+		serverError(w, err)
+		return
+	}
 
-				triggerWhenTrackIsAdded()
+	// Encoding the ID of the track that was just added to DB
+	fmt.Fprint(w, "{\n\"id\":\""+trackFile.UniqueID+"\"\n}")
+}
 
-			} else {
+// trackConflict tells the user that the IGC file is already in the database, with the ID of the existing track
+func trackConflict(w http.ResponseWriter, id string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]string{"id": id})
+}
 
-				trackInDB := getTrack(client, URL.URL)
-				// If there is another file in igcFilesDB with that URL return and tell the user that that IGC FILE is already in the database
-				http.Error(w, "409 Conflict - The Igc File you entered is already in our database!", http.StatusConflict)
-				fmt.Fprintln(w, "\nThe file you entered has the following ID: ", trackInDB.UniqueID)
-				return
+// findPage returns the page of tracks of the query and sets the Link header of the next page,
+// or sends the error and returns false
+func (s *server) findPage(w http.ResponseWriter, r *http.Request, q trackQuery) ([]tracks, bool) {
+	// One more track than the page tells if there is a next page
+	limit := q.Limit
+	if limit > 0 {
+		q.Limit++
+	}
+	resTracks, err := s.tracks.FindTracks(r.Context(), q)
+	if err == errNotFound {
+		http.Error(w, "400 - Bad Request, after must be the ID of a track", http.StatusBadRequest)
+		return nil, false
+	}
+	if err != nil {
+		serverError(w, err)
+		return nil, false
+	}
 
-			}
+	if limit > 0 && len(resTracks) > limit {
+		resTracks = resTracks[:limit]
+		w.Header().Set("Link", nextPageLink(r, resTracks[limit-1].UniqueID))
+	}
+	return resTracks, true
+}
 
-		}
-	default:
-		http.Error(w, "Not implemented", http.StatusNotImplemented)
+// writeTrackList sends the IDs of the page of tracks of the query, with the Link header of the next page
+func (s *server) writeTrackList(w http.ResponseWriter, r *http.Request, q trackQuery) {
+	resTracks, ok := s.findPage(w, r, q)
+	if !ok {
 		return
 	}
 
+	ids := []string{}
+	for _, val := range resTracks {
+		ids = append(ids, val.UniqueID)
+	}
+	json.NewEncoder(w).Encode(ids)
+}
+
+// nextPageLink returns the Link header of the page after the given track, with the same filters
+func nextPageLink(r *http.Request, after string) string {
+	query := r.URL.Query()
+	query.Set("after", after)
+	next := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	return "<" + next.String() + `>; rel="next"`
 }
-func handlerID(w http.ResponseWriter, r *http.Request) {
+
+func (s *server) handlerID(w http.ResponseWriter, r *http.Request) {
 	//Handling /igcinfo/api/igc/<id>
 	if r.Method != "GET" {
 		http.Error(w, "501 - Method not implemented", http.StatusNotImplemented)
 		return
 	}
 
+	// Exporting the track when the client asks for a file format
+	if format, ok := acceptedExport(r); ok {
+		s.exportTrack(w, r, format)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	idURL := mux.Vars(r)
 
@@ -159,41 +272,22 @@ func handlerID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client := mongoConnect()
-
-	collection := client.Database("igcfiles").Collection("tracks")
-
-	cursor, err := collection.Find(context.Background(), nil, nil)
+	track, err := s.tracks.GetTrack(r.Context(), idURL["id"])
+	if err == errNotFound {
+		//Handling if user type different id from ids stored
+		http.Error(w, "404 - The trackInfo with that id doesn't exists in our database ", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		log.Fatal(err)
+		serverError(w, err)
+		return
 	}
 
-	// 'Close' the cursor
-	defer cursor.Close(context.Background())
-
-	track := tracks{}
-	//URL := &_url{}
-
-	for cursor.Next(context.Background()) {
-		err = cursor.Decode(&track)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		if track.UniqueID == idURL["id"] {
-			fmt.Fprint(w, "{\n\"H_date\":\""+track.Hdate+"\",\n\"pilot\":\""+track.Pilot+"\",\n\"glider\":\""+track.Glider+"\",\n\"glider_id\":\""+track.GliderID+"\",\n\"length\":\""+FloatToString(track.TrackLength)+"\",\n\"track_src_url\":\""+track.URL+"\"\n}")
-
-		} else {
-			//Handling if user type different id from ids stored
-			http.Error(w, "404 - The trackInfo with that id doesn't exists in our database ", http.StatusNotFound)
-
-		}
-
-	}
+	fmt.Fprint(w, "{\n\"H_date\":\""+track.Hdate+"\",\n\"pilot\":\""+track.Pilot+"\",\n\"glider\":\""+track.Glider+"\",\n\"glider_id\":\""+track.GliderID+"\",\n\"length\":\""+FloatToString(track.TrackLength)+"\",\n\"track_src_url\":\""+track.URL+"\"\n}")
 
 }
 
-func handlerField(w http.ResponseWriter, r *http.Request) {
+func (s *server) handlerField(w http.ResponseWriter, r *http.Request) {
 
 	//Handling for GET /api/igc/<id>/<field>
 	w.Header().Set("Content-Type", "application/json")
@@ -217,11 +311,17 @@ func handlerField(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "400 - Bad Request, wrong parameters", http.StatusBadRequest)
 		return
 	}
-	client := mongoConnect()
 
-	trackDB := tracks{}
+	trackDB, err := s.tracks.GetTrack(r.Context(), urlFields["id"])
+	if err == errNotFound {
+		http.Error(w, "File not found!", 404)
+		return
+	}
+	if err != nil {
+		serverError(w, err)
+		return
+	}
 
-	trackDB = getTrack1(client, urlFields["id"], w)
 	// Taking the field variable from the URL path and converting it to lower case to skip some potential errors
 	field := urlFields["field"]
 
@@ -239,7 +339,18 @@ func handlerField(w http.ResponseWriter, r *http.Request) {
 	case "track_src_url":
 		fmt.Fprint(w, trackDB.URL)
 	default:
-		http.Error(w, "", 404)
+		// The flight statistics are fields too
+		stats, err := s.trackStats(r.Context(), trackDB)
+		if err != nil && err != errNotFound {
+			serverError(w, err)
+			return
+		}
+		value, ok := statsField(stats, field)
+		if err == errNotFound || !ok {
+			http.Error(w, "", 404)
+			return
+		}
+		fmt.Fprint(w, value)
 	}
 
 }
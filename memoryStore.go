@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// memoryStore keeps tracks and webhooks in memory
+// It is used by the tests and for local development, everything is lost on restart
+type memoryStore struct {
+	mu       sync.RWMutex
+	tracks   []tracks
+	webhooks []Webhook
+	counters map[string]int64
+	files    map[string]map[string][]byte
+	jobs     []ingestJob
+	tasks    []compTask
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{counters: map[string]int64{}, files: map[string]map[string][]byte{}}
+}
+
+// NextCounter increments the named counter
+func (m *memoryStore) NextCounter(ctx context.Context, name string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counters[name]++
+	return m.counters[name], nil
+}
+
+// MigrateIDs does nothing, the memory store never holds tracks from older versions
+func (m *memoryStore) MigrateIDs(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+// Close does nothing, there is no connection to release
+func (m *memoryStore) Close(ctx context.Context) error {
+	return nil
+}
+
+// *** TRACKS *** //
+
+func (m *memoryStore) AddTrack(ctx context.Context, track tracks) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, val := range m.tracks {
+		if val.UniqueID == track.UniqueID {
+			return errDuplicateID
+		}
+		if track.ContentHash != "" && val.ContentHash == track.ContentHash {
+			return errDuplicateContent
+		}
+	}
+
+	m.tracks = append(m.tracks, track)
+	return nil
+}
+
+func (m *memoryStore) GetTrack(ctx context.Context, id string) (tracks, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, val := range m.tracks {
+		if matchTrackID(val, id) {
+			return val, nil
+		}
+	}
+	return tracks{}, errNotFound
+}
+
+func (m *memoryStore) GetTrackByURL(ctx context.Context, url string) (tracks, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, val := range m.tracks {
+		if val.URL == url {
+			return val, nil
+		}
+	}
+	return tracks{}, errNotFound
+}
+
+func (m *memoryStore) GetTrackByHash(ctx context.Context, hash string) (tracks, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, val := range m.tracks {
+		if val.ContentHash == hash {
+			return val, nil
+		}
+	}
+	return tracks{}, errNotFound
+}
+
+func (m *memoryStore) GetAllTracks(ctx context.Context) ([]tracks, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	resTracks := make([]tracks, len(m.tracks))
+	copy(resTracks, m.tracks)
+	return resTracks, nil
+}
+
+// EachTrack iterates over a copy of the tracks, so fn can take its time without holding the lock
+func (m *memoryStore) EachTrack(ctx context.Context, fn func(tracks) error) error {
+	allTracks, _ := m.GetAllTracks(ctx)
+	for _, val := range allTracks {
+		if err := fn(val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindTracks filters and sorts a copy of the tracks
+func (m *memoryStore) FindTracks(ctx context.Context, q trackQuery) ([]tracks, error) {
+	allTracks, _ := m.GetAllTracks(ctx)
+	return selectTracks(allTracks, q)
+}
+
+func (m *memoryStore) CountTracks(ctx context.Context) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return int64(len(m.tracks)), nil
+}
+
+func (m *memoryStore) DeleteAllTracks(ctx context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := int64(len(m.tracks))
+	m.tracks = nil
+	return count, nil
+}
+
+// *** WEBHOOKS *** //
+
+func (m *memoryStore) AddWebhook(ctx context.Context, webhook Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, val := range m.webhooks {
+		if val.WebhookID == webhook.WebhookID {
+			return errDuplicateID
+		}
+	}
+
+	m.webhooks = append(m.webhooks, webhook)
+	return nil
+}
+
+func (m *memoryStore) UpdateWebhook(ctx context.Context, webhook Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, val := range m.webhooks {
+		if val.WebhookURL == webhook.WebhookURL {
+			m.webhooks[key].MinTriggerValue = webhook.MinTriggerValue
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+func (m *memoryStore) GetWebhook(ctx context.Context, id string) (Webhook, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, val := range m.webhooks {
+		if matchWebhookID(val, id) {
+			return val, nil
+		}
+	}
+	return Webhook{}, errNotFound
+}
+
+func (m *memoryStore) GetWebhookByURL(ctx context.Context, url string) (Webhook, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, val := range m.webhooks {
+		if val.WebhookURL == url {
+			return val, nil
+		}
+	}
+	return Webhook{}, errNotFound
+}
+
+func (m *memoryStore) GetAllWebhooks(ctx context.Context) ([]Webhook, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	resWebhooks := make([]Webhook, len(m.webhooks))
+	copy(resWebhooks, m.webhooks)
+	return resWebhooks, nil
+}
+
+func (m *memoryStore) DeleteWebhook(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, val := range m.webhooks {
+		if matchWebhookID(val, id) {
+			m.webhooks = append(m.webhooks[:key], m.webhooks[key+1:]...)
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+// *** FILES *** //
+
+func (m *memoryStore) PutFile(ctx context.Context, bucket string, id string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.files[bucket] == nil {
+		m.files[bucket] = map[string][]byte{}
+	}
+	m.files[bucket][id] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *memoryStore) GetFile(ctx context.Context, bucket string, id string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	data, ok := m.files[bucket][id]
+	if !ok {
+		return nil, errNotFound
+	}
+	return data, nil
+}
+
+func (m *memoryStore) DeleteFile(ctx context.Context, bucket string, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.files[bucket], id)
+	return nil
+}
+
+func (m *memoryStore) DeleteFiles(ctx context.Context, bucket string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.files, bucket)
+	return nil
+}
+
+// *** JOBS *** //
+
+func (m *memoryStore) AddJob(ctx context.Context, job ingestJob) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.jobs = append(m.jobs, job)
+	return nil
+}
+
+func (m *memoryStore) UpdateJob(ctx context.Context, job ingestJob) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, val := range m.jobs {
+		if val.JobID == job.JobID {
+			m.jobs[key] = job
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+func (m *memoryStore) GetJob(ctx context.Context, id string) (ingestJob, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, val := range m.jobs {
+		if val.JobID == id {
+			return val, nil
+		}
+	}
+	return ingestJob{}, errNotFound
+}
+
+func (m *memoryStore) GetPendingJobs(ctx context.Context) ([]ingestJob, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	resJobs := []ingestJob{}
+	for _, val := range m.jobs {
+		if !val.finished() {
+			resJobs = append(resJobs, val)
+		}
+	}
+	return resJobs, nil
+}
+
+// *** TASKS *** //
+
+func (m *memoryStore) AddTask(ctx context.Context, task compTask) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, val := range m.tasks {
+		if val.TaskID == task.TaskID {
+			return errDuplicateID
+		}
+	}
+
+	m.tasks = append(m.tasks, task)
+	return nil
+}
+
+func (m *memoryStore) GetTask(ctx context.Context, id string) (compTask, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, val := range m.tasks {
+		if val.TaskID == id {
+			return val, nil
+		}
+	}
+	return compTask{}, errNotFound
+}
+
+func (m *memoryStore) UpdateTask(ctx context.Context, task compTask) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, val := range m.tasks {
+		if val.TaskID == task.TaskID {
+			m.tasks[key] = task
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+func (m *memoryStore) GetAllTasks(ctx context.Context) ([]compTask, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	resTasks := make([]compTask, len(m.tasks))
+	copy(resTasks, m.tasks)
+	return resTasks, nil
+}
+
+func (m *memoryStore) DeleteTask(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, val := range m.tasks {
+		if val.TaskID == id {
+			m.tasks = append(m.tasks[:key], m.tasks[key+1:]...)
+			return nil
+		}
+	}
+	return errNotFound
+}
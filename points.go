@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	igc "github.com/marni/goigc"
+)
+
+// *** TRACK POINTS *** //
+
+// trackPoints is the FileStore bucket of the fixes of every track, by track ID
+const trackPoints = "track_points"
+
+// fix is one B record of a track
+type fix struct {
+	Time             time.Time `json:"time"`
+	Lat              float64   `json:"lat"`
+	Lon              float64   `json:"lon"`
+	PressureAltitude int64     `json:"pressure_altitude"`
+	GNSSAltitude     int64     `json:"gnss_altitude"`
+	Ground           bool      `json:"ground,omitempty"` // before takeoff, after landing or between two flights
+}
+
+// trackFixes returns the fixes of the track with full timestamps, the fixes on the ground flagged
+// The B records only have the time of day, so the date comes from the header,
+// and a time going backwards means the flight went past midnight UTC
+func trackFixes(track igc.Track) []fix {
+	fixes := make([]fix, 0, len(track.Points))
+
+	day := track.Date
+	var previous time.Time
+	for _, point := range track.Points {
+		clock := point.Time
+		if len(fixes) > 0 && clock.Before(previous) {
+			day = day.AddDate(0, 0, 1)
+		}
+		previous = clock
+
+		fixes = append(fixes, fix{
+			Time:             time.Date(day.Year(), day.Month(), day.Day(), clock.Hour(), clock.Minute(), clock.Second(), 0, time.UTC),
+			Lat:              point.Lat.Degrees(),
+			Lon:              point.Lng.Degrees(),
+			PressureAltitude: point.PressureAltitude,
+			GNSSAltitude:     point.GNSSAltitude,
+		})
+	}
+
+	flagGround(fixes)
+	return fixes
+}
+
+// encodeFixes packs the fixes as gzipped JSON
+func encodeFixes(fixes []fix) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(fixes); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeFixes unpacks fixes written by encodeFixes
+func decodeFixes(data []byte) ([]fix, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var fixes []fix
+	err = json.NewDecoder(zr).Decode(&fixes)
+	return fixes, err
+}
+
+// saveFixes stores the fixes of the track
+func (s *server) saveFixes(ctx context.Context, id string, fixes []fix) error {
+	data, err := encodeFixes(fixes)
+	if err != nil {
+		return err
+	}
+	return s.files.PutFile(ctx, trackPoints, id, data)
+}
+
+// loadFixes returns the fixes of the track with the given ID, or errNotFound
+// Tracks added before the fixes were kept get them from their original file the first time
+func (s *server) loadFixes(ctx context.Context, id string) ([]fix, error) {
+	data, err := s.files.GetFile(ctx, trackPoints, id)
+	if err == nil {
+		return decodeFixes(data)
+	}
+	if err != errNotFound {
+		return nil, err
+	}
+
+	data, err = s.files.GetFile(ctx, igcFiles, id)
+	if err != nil {
+		return nil, err
+	}
+	track, err := parseTrack(data)
+	if err != nil {
+		return nil, err
+	}
+	fixes := trackFixes(track)
+	if err = s.saveFixes(ctx, id, fixes); err != nil {
+		return nil, err
+	}
+	return fixes, nil
+}
+
+// requestFixes returns the track with the ID in the URL and its fixes,
+// or sends 404 to the user if either is missing
+func (s *server) requestFixes(w http.ResponseWriter, r *http.Request) (tracks, []fix, bool) {
+	track, err := s.tracks.GetTrack(r.Context(), mux.Vars(r)["id"])
+	if err == errNotFound {
+		http.Error(w, "404 - The trackInfo with that id doesn't exists in our database ", http.StatusNotFound)
+		return tracks{}, nil, false
+	}
+	if err != nil {
+		serverError(w, err)
+		return tracks{}, nil, false
+	}
+
+	fixes, err := s.loadFixes(r.Context(), track.UniqueID)
+	if err == errNotFound {
+		http.Error(w, "404 - The points of this track were not kept", http.StatusNotFound)
+		return tracks{}, nil, false
+	}
+	if err != nil {
+		serverError(w, err)
+		return tracks{}, nil, false
+	}
+
+	return track, fixes, true
+}
+
+// filterFixes keeps the fixes between from and to (both optional), in flight only if trim is set,
+// then every step-th of them
+func filterFixes(fixes []fix, from time.Time, to time.Time, trim bool, step int) []fix {
+	resFixes := []fix{}
+	kept := 0
+	for _, val := range fixes {
+		if (!from.IsZero() && val.Time.Before(from)) || (!to.IsZero() && val.Time.After(to)) || (trim && val.Ground) {
+			continue
+		}
+		if kept%step == 0 {
+			resFixes = append(resFixes, val)
+		}
+		kept++
+	}
+	return resFixes
+}
+
+// fixFilter selects the fixes returned, from the query parameters of the request
+type fixFilter struct {
+	from time.Time
+	to   time.Time
+	trim bool
+	step int
+	max  int
+}
+
+// parseFixFilter reads the query parameters from, to, trim, step and max
+func parseFixFilter(query url.Values) (fixFilter, error) {
+	filter := fixFilter{step: 1}
+
+	var err error
+	if val := query.Get("from"); val != "" {
+		if filter.from, err = time.Parse(time.RFC3339, val); err != nil {
+			return filter, fmt.Errorf("from must be an RFC 3339 time")
+		}
+	}
+	if val := query.Get("to"); val != "" {
+		if filter.to, err = time.Parse(time.RFC3339, val); err != nil {
+			return filter, fmt.Errorf("to must be an RFC 3339 time")
+		}
+	}
+
+	filter.trim = query.Get("trim") == "true"
+
+	if val := query.Get("step"); val != "" {
+		if filter.step, err = strconv.Atoi(val); err != nil || filter.step < 1 {
+			return filter, fmt.Errorf("step must be a positive number")
+		}
+	}
+	if val := query.Get("max"); val != "" {
+		if filter.max, err = strconv.Atoi(val); err != nil || filter.max < 1 {
+			return filter, fmt.Errorf("max must be a positive number")
+		}
+	}
+	return filter, nil
+}
+
+// apply returns the fixes selected by the filter
+func (f fixFilter) apply(fixes []fix) []fix {
+	fixes = filterFixes(fixes, f.from, f.to, f.trim, f.step)
+	if f.max > 0 && len(fixes) > f.max {
+		// Rounding the step up so the result never has more than max fixes
+		fixes = filterFixes(fixes, time.Time{}, time.Time{}, false, (len(fixes)+f.max-1)/f.max)
+	}
+	return fixes
+}
+
+// Handles path: GET /api/track/<id>/points
+// Optional query parameters: from and to (RFC 3339) to select a time range, trim=true to leave out
+// the fixes on the ground, step to return only every step-th fix, and max to return at most max fixes
+func (s *server) handlerPoints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "501 - Method not implemented", http.StatusNotImplemented)
+		return
+	}
+
+	filter, err := parseFixFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, "400 - Bad Request, "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, fixes, ok := s.requestFixes(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(filter.apply(fixes))
+}
@@ -0,0 +1,117 @@
+package main
+
+import "sort"
+
+// *** R-TREE *** //
+
+// rtreeMaxEntries is the number of entries of a node before it is split in two
+const rtreeMaxEntries = 16
+
+// rtree indexes boxes with a key, to find the keys whose box intersects a box
+// without looking at every box. The embedded store keeps one per geometry of the tracks
+// It is not safe for concurrent use
+type rtree struct {
+	root *rtreeNode
+}
+
+type rtreeNode struct {
+	leaf    bool
+	entries []rtreeEntry
+}
+
+// rtreeEntry is a key in a leaf, or a child node and the box around it
+type rtreeEntry struct {
+	box   geoBox
+	key   uint64
+	child *rtreeNode
+}
+
+// bounds returns the box around the entries of the node
+func (n *rtreeNode) bounds() geoBox {
+	box := n.entries[0].box
+	for _, val := range n.entries[1:] {
+		box = box.union(val.box)
+	}
+	return box
+}
+
+// Insert adds the key with its box
+func (t *rtree) Insert(box geoBox, key uint64) {
+	if t.root == nil {
+		t.root = &rtreeNode{leaf: true}
+	}
+	if split := t.root.insert(rtreeEntry{box: box, key: key}); split != nil {
+		// The root was split, the tree grows by one level
+		t.root = &rtreeNode{entries: []rtreeEntry{
+			{box: t.root.bounds(), child: t.root},
+			{box: split.bounds(), child: split},
+		}}
+	}
+}
+
+// insert adds the entry under the node, and returns the new node when the node had to be split
+func (n *rtreeNode) insert(entry rtreeEntry) *rtreeNode {
+	if n.leaf {
+		n.entries = append(n.entries, entry)
+	} else {
+		// The child whose box grows the least, then the smallest one
+		best := 0
+		for key, val := range n.entries {
+			growth := val.box.union(entry.box).area() - val.box.area()
+			bestGrowth := n.entries[best].box.union(entry.box).area() - n.entries[best].box.area()
+			if growth < bestGrowth || (growth == bestGrowth && val.box.area() < n.entries[best].box.area()) {
+				best = key
+			}
+		}
+
+		child := n.entries[best].child
+		split := child.insert(entry)
+		n.entries[best].box = child.bounds()
+		if split != nil {
+			n.entries = append(n.entries, rtreeEntry{box: split.bounds(), child: split})
+		}
+	}
+
+	if len(n.entries) <= rtreeMaxEntries {
+		return nil
+	}
+	return n.split()
+}
+
+// split moves half of the entries to a new node, along the axis where the entries are the most spread
+func (n *rtreeNode) split() *rtreeNode {
+	box := n.bounds()
+	byLon := box.MaxLon-box.MinLon > box.MaxLat-box.MinLat
+	sort.Slice(n.entries, func(i, j int) bool {
+		a, b := n.entries[i].box, n.entries[j].box
+		if byLon {
+			return a.MinLon+a.MaxLon < b.MinLon+b.MaxLon
+		}
+		return a.MinLat+a.MaxLat < b.MinLat+b.MaxLat
+	})
+
+	half := len(n.entries) / 2
+	other := &rtreeNode{leaf: n.leaf, entries: append([]rtreeEntry{}, n.entries[half:]...)}
+	n.entries = n.entries[:half:half]
+	return other
+}
+
+// Search calls fn with the key of every box that intersects the box
+func (t *rtree) Search(box geoBox, fn func(key uint64)) {
+	if t.root != nil {
+		t.root.search(box, fn)
+	}
+}
+
+func (n *rtreeNode) search(box geoBox, fn func(key uint64)) {
+	for _, val := range n.entries {
+		if !val.box.intersects(box) {
+			continue
+		}
+		if n.leaf {
+			fn(val.key)
+		} else {
+			val.child.search(box, fn)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_rtree(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	randomBox := func(size float64) geoBox {
+		lon, lat := random.Float64()*20, random.Float64()*20
+		return geoBox{lon, lat, lon + random.Float64()*size, lat + random.Float64()*size}
+	}
+
+	// Enough boxes for a few levels of nodes
+	tree := rtree{}
+	boxes := []geoBox{}
+	for i := 0; i < 1000; i++ {
+		box := randomBox(0.5)
+		boxes = append(boxes, box)
+		tree.Insert(box, uint64(i))
+	}
+
+	for i := 0; i < 50; i++ {
+		query := randomBox(3)
+		expected := []uint64{}
+		for key, val := range boxes {
+			if val.intersects(query) {
+				expected = append(expected, uint64(key))
+			}
+		}
+
+		found := []uint64{}
+		tree.Search(query, func(key uint64) { found = append(found, key) })
+		sort.Slice(found, func(i, j int) bool { return found[i] < found[j] })
+		assert.Equal(t, expected, found)
+	}
+
+	empty := rtree{}
+	empty.Search(geoBox{0, 0, 1, 1}, func(uint64) { t.Error("Expected no key in an empty tree") })
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// *** CROSS-COUNTRY SCORING *** //
+
+const (
+	// freeSamples and triangleSamples are the number of fixes the optimizer searches,
+	// the best turnpoints are then moved to the best fix around them
+	// The triangle search is cubic, 300 samples is about 4.5 million triangles
+	// The search is exact over the samples, so if every fix is at most e from a sample,
+	// each of the 5 points of the best flight moves by at most e: the distance found is at most
+	// 8 e shorter than the optimum (2 per turnpoint, 1 for the start and the finish)
+	// For triangles the bound holds when the best triangle is not at the limit of the closing ratio or the FAI rule
+	freeSamples     = 600
+	triangleSamples = 300
+	// faiMinLeg is the shortest leg of an FAI triangle, as a share of its perimeter
+	faiMinLeg = 0.28
+)
+
+// scoringRules are the multipliers of a scoring system, and the longest closing distance
+// of a triangle as a share of its perimeter
+// The closing distance is taken off the perimeter of a triangle
+type scoringRules struct {
+	Name           string  `json:"name"`
+	FreeMultiplier float64 `json:"free_distance"`
+	FlatMultiplier float64 `json:"flat_triangle"`
+	FAIMultiplier  float64 `json:"fai_triangle"`
+	ClosingRatio   float64 `json:"closing_ratio"`
+}
+
+// scoringRuleSets are the scoring systems built in, by name
+// More are added, or these replaced, by the scoring_rule_sets of the configuration
+var scoringRuleSets = map[string]scoringRules{
+	"xcontest": {Name: "xcontest", FreeMultiplier: 1.0, FlatMultiplier: 1.2, FAIMultiplier: 1.4, ClosingRatio: 0.2},
+	"olc":      {Name: "olc", FreeMultiplier: 1.5, FlatMultiplier: 1.75, FAIMultiplier: 2.0, ClosingRatio: 0.2},
+}
+
+// validate checks that the multipliers are positive and the closing ratio a share of the perimeter
+func (rules scoringRules) validate() error {
+	if rules.FreeMultiplier <= 0 || rules.FlatMultiplier <= 0 || rules.FAIMultiplier <= 0 {
+		return fmt.Errorf("the multipliers must be positive")
+	}
+	if rules.ClosingRatio <= 0 || rules.ClosingRatio > 1 {
+		return fmt.Errorf("closing_ratio must be more than 0 and at most 1")
+	}
+	return nil
+}
+
+// ruleSetNames returns the names of the scoring systems, sorted
+func ruleSetNames(sets map[string]scoringRules) []string {
+	names := []string{}
+	for name := range sets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// requestRules returns the scoring system picked by the rules query parameter, the configured one by default,
+// with the multipliers and the closing ratio given by the other query parameters
+func (s *server) requestRules(query url.Values) (scoringRules, error) {
+	sets := s.cfg.ruleSets()
+	name := s.cfg.ScoringRules
+	if val := query.Get("rules"); val != "" {
+		name = val
+	}
+	rules, ok := sets[name]
+	if !ok {
+		return rules, fmt.Errorf("rules must be one of: %s", strings.Join(ruleSetNames(sets), ", "))
+	}
+
+	for key, val := range map[string]*float64{
+		"free_distance": &rules.FreeMultiplier,
+		"flat_triangle": &rules.FlatMultiplier,
+		"fai_triangle":  &rules.FAIMultiplier,
+		"closing_ratio": &rules.ClosingRatio,
+	} {
+		if query.Get(key) == "" {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(query.Get(key), 64)
+		if err != nil {
+			return rules, fmt.Errorf("%s must be a number", key)
+		}
+		*val = parsed
+	}
+	return rules, rules.validate()
+}
+
+// scoredPoint is a point of a scored flight: the start, a turnpoint or the finish
+type scoredPoint struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+	Lat  float64   `json:"lat"`
+	Lon  float64   `json:"lon"`
+}
+
+// xcScore is the best flight of one type, distances are in km
+type xcScore struct {
+	Type            string        `json:"type"`                       // free_distance, flat_triangle or fai_triangle
+	Distance        float64       `json:"distance"`                   // scored distance, the closing distance taken off for triangles
+	ClosingDistance float64       `json:"closing_distance,omitempty"` // between the start and the finish of a triangle
+	Multiplier      float64       `json:"multiplier"`
+	Points          float64       `json:"points"`
+	Turnpoints      []scoredPoint `json:"turnpoints"` // start, turnpoints and finish, in order
+}
+
+// xcResult is the score of a track with every type of flight
+// A triangle is missing if the track never closed one
+type xcResult struct {
+	Rules        string   `json:"rules"`
+	ClosingRatio float64  `json:"closing_ratio"`
+	Best         *xcScore `json:"best"`
+	FreeDistance *xcScore `json:"free_distance"`
+	FlatTriangle *xcScore `json:"flat_triangle"`
+	FAITriangle  *xcScore `json:"fai_triangle"`
+}
+
+// sampleIndexes returns at most max fix indexes evenly spread over n fixes, the last one included
+func sampleIndexes(n int, max int) []int {
+	step := (n + max - 1) / max
+	if step < 1 {
+		step = 1
+	}
+	indexes := []int{}
+	for i := 0; i < n; i += step {
+		indexes = append(indexes, i)
+	}
+	if n > 0 && indexes[len(indexes)-1] != n-1 {
+		indexes = append(indexes, n-1)
+	}
+	return indexes
+}
+
+// refine moves each point of idx to the fix within radius of it with the best score, until none moves
+// The points stay in order, the score is negative for invalid points
+func refine(n int, idx []int, radius int, score func([]int) float64) []int {
+	best := score(idx)
+	for improved := true; improved; {
+		improved = false
+		for p := range idx {
+			lo, hi := idx[p]-radius, idx[p]+radius
+			if p > 0 && lo < idx[p-1] {
+				lo = idx[p-1]
+			}
+			if p < len(idx)-1 && hi > idx[p+1] {
+				hi = idx[p+1]
+			}
+			if lo < 0 {
+				lo = 0
+			}
+			if hi > n-1 {
+				hi = n - 1
+			}
+
+			candidate := append([]int{}, idx...)
+			for c := lo; c <= hi; c++ {
+				candidate[p] = c
+				if val := score(candidate); val > best+1e-9 {
+					best = val
+					idx = append([]int{}, candidate...)
+					improved = true
+				}
+			}
+		}
+	}
+	return idx
+}
+
+// optimizeFree returns the start, up to 3 turnpoints and the finish of the longest free distance
+// The distance is the sum of the legs between them, in order
+func optimizeFree(fixes []fix) ([]int, float64) {
+	return optimizeFreeOn(fixes, sampleIndexes(len(fixes), freeSamples))
+}
+
+// optimizeFreeOn searches the free distance on the fixes of sample, then refines it on every fix
+func optimizeFreeOn(fixes []fix, sample []int) ([]int, float64) {
+	m := len(sample)
+	legs := 4
+	if m-1 < legs {
+		legs = m - 1
+	}
+	if legs < 1 {
+		return nil, 0
+	}
+
+	// best[k][j] is the longest path of k legs ending at the sample j, from[k][j] the sample before j
+	best := make([][]float64, legs+1)
+	from := make([][]int, legs+1)
+	for k := range best {
+		best[k] = make([]float64, m)
+		from[k] = make([]int, m)
+	}
+	for k := 1; k <= legs; k++ {
+		for j := 0; j < m; j++ {
+			best[k][j] = -1
+			for i := k - 1; i < j; i++ {
+				if best[k-1][i] < 0 {
+					continue
+				}
+				if val := best[k-1][i] + fixDistance(fixes[sample[i]], fixes[sample[j]]); val > best[k][j] {
+					best[k][j], from[k][j] = val, i
+				}
+			}
+		}
+	}
+
+	end := 0
+	for j := range best[legs] {
+		if best[legs][j] > best[legs][end] {
+			end = j
+		}
+	}
+	idx := make([]int, legs+1)
+	for k := legs; k >= 0; k-- {
+		idx[k] = sample[end]
+		end = from[k][end]
+	}
+
+	score := func(idx []int) float64 {
+		total := 0.0
+		for i := 1; i < len(idx); i++ {
+			total += fixDistance(fixes[idx[i-1]], fixes[idx[i]])
+		}
+		return total
+	}
+	idx = refine(len(fixes), idx, sample[1]-sample[0], score)
+	return idx, score(idx)
+}
+
+// triangleScore returns the perimeter and the closing distance of the triangle of idx
+// (start, 3 turnpoints, finish), and if it is valid under the closing ratio and the FAI rule
+func triangleScore(fixes []fix, idx []int, closingRatio float64, fai bool) (float64, float64, bool) {
+	a := fixDistance(fixes[idx[1]], fixes[idx[2]])
+	b := fixDistance(fixes[idx[2]], fixes[idx[3]])
+	c := fixDistance(fixes[idx[3]], fixes[idx[1]])
+	perimeter := a + b + c
+	closing := fixDistance(fixes[idx[0]], fixes[idx[4]])
+
+	if perimeter == 0 || closing > closingRatio*perimeter {
+		return perimeter, closing, false
+	}
+	if fai && (a < faiMinLeg*perimeter || b < faiMinLeg*perimeter || c < faiMinLeg*perimeter) {
+		return perimeter, closing, false
+	}
+	return perimeter, closing, true
+}
+
+// optimizeTriangle returns the start, the 3 turnpoints and the finish of the triangle with the best
+// perimeter minus closing distance, and both distances
+// The start is before the first turnpoint and the finish after the last, as close to each other as possible
+func optimizeTriangle(fixes []fix, closingRatio float64, fai bool) ([]int, float64, float64, bool) {
+	return optimizeTriangleOn(fixes, sampleIndexes(len(fixes), triangleSamples), closingRatio, fai)
+}
+
+// optimizeTriangleOn searches the triangle on the fixes of sample, then refines it on every fix
+func optimizeTriangleOn(fixes []fix, sample []int, closingRatio float64, fai bool) ([]int, float64, float64, bool) {
+	m := len(sample)
+	if m < 3 {
+		return nil, 0, 0, false
+	}
+
+	dist := make([][]float64, m)
+	for i := range dist {
+		dist[i] = make([]float64, m)
+	}
+	for i := 0; i < m; i++ {
+		for j := i + 1; j < m; j++ {
+			dist[i][j] = fixDistance(fixes[sample[i]], fixes[sample[j]])
+			dist[j][i] = dist[i][j]
+		}
+	}
+
+	// gap[i][k] is the shortest closing distance from a start before the sample i
+	// to a finish after the sample k, reached from start[i][k] to finish[i][k]
+	gap := make([][]float64, m)
+	start := make([][]int, m)
+	finish := make([][]int, m)
+	for i := 0; i < m; i++ {
+		gap[i] = make([]float64, m)
+		start[i] = make([]int, m)
+		finish[i] = make([]int, m)
+		for k := m - 1; k >= i; k-- {
+			gap[i][k], start[i][k], finish[i][k] = dist[i][k], i, k
+			if i > 0 && gap[i-1][k] < gap[i][k] {
+				gap[i][k], start[i][k], finish[i][k] = gap[i-1][k], start[i-1][k], finish[i-1][k]
+			}
+			if k < m-1 && gap[i][k+1] < gap[i][k] {
+				gap[i][k], start[i][k], finish[i][k] = gap[i][k+1], start[i][k+1], finish[i][k+1]
+			}
+		}
+	}
+
+	var idx []int
+	bestScore := 0.0
+	for t1 := 0; t1 < m; t1++ {
+		for t3 := t1 + 2; t3 < m; t3++ {
+			closing := gap[t1][t3]
+			for t2 := t1 + 1; t2 < t3; t2++ {
+				a, b, c := dist[t1][t2], dist[t2][t3], dist[t3][t1]
+				perimeter := a + b + c
+				if perimeter-closing <= bestScore || closing > closingRatio*perimeter {
+					continue
+				}
+				if fai && (a < faiMinLeg*perimeter || b < faiMinLeg*perimeter || c < faiMinLeg*perimeter) {
+					continue
+				}
+				bestScore = perimeter - closing
+				idx = []int{sample[start[t1][t3]], sample[t1], sample[t2], sample[t3], sample[finish[t1][t3]]}
+			}
+		}
+	}
+	if idx == nil {
+		return nil, 0, 0, false
+	}
+
+	score := func(idx []int) float64 {
+		perimeter, closing, ok := triangleScore(fixes, idx, closingRatio, fai)
+		if !ok {
+			return -1
+		}
+		return perimeter - closing
+	}
+	idx = refine(len(fixes), idx, sample[1]-sample[0], score)
+	perimeter, closing, _ := triangleScore(fixes, idx, closingRatio, fai)
+	return idx, perimeter, closing, true
+}
+
+// newScore returns the score of the flight through the fixes of idx
+func newScore(fixes []fix, idx []int, kind string, distance float64, closing float64, multiplier float64) *xcScore {
+	score := &xcScore{
+		Type:            kind,
+		Distance:        distance,
+		ClosingDistance: closing,
+		Multiplier:      multiplier,
+		Points:          distance * multiplier,
+		Turnpoints:      []scoredPoint{},
+	}
+	for key, val := range idx {
+		name := "tp" + strconv.Itoa(key)
+		switch key {
+		case 0:
+			name = "start"
+		case len(idx) - 1:
+			name = "finish"
+		}
+		score.Turnpoints = append(score.Turnpoints, scoredPoint{Name: name, Time: fixes[val].Time, Lat: fixes[val].Lat, Lon: fixes[val].Lon})
+	}
+	return score
+}
+
+// scoreFixes scores every flight of the track and keeps the best of each type
+// The fixes on the ground are left out, so a relaunch is never joined to the flight before it
+func scoreFixes(fixes []fix, rules scoringRules) xcResult {
+	result := xcResult{Rules: rules.Name, ClosingRatio: rules.ClosingRatio}
+
+	better := func(current *xcScore, candidate *xcScore) *xcScore {
+		if current == nil || candidate.Points > current.Points {
+			return candidate
+		}
+		return current
+	}
+
+	for _, val := range flagged(fixes) {
+		flight := fixes[val.Start : val.End+1]
+
+		if idx, distance := optimizeFree(flight); idx != nil {
+			result.FreeDistance = better(result.FreeDistance, newScore(flight, idx, "free_distance", distance, 0, rules.FreeMultiplier))
+		}
+		if idx, perimeter, closing, ok := optimizeTriangle(flight, rules.ClosingRatio, false); ok {
+			result.FlatTriangle = better(result.FlatTriangle, newScore(flight, idx, "flat_triangle", perimeter-closing, closing, rules.FlatMultiplier))
+		}
+		if idx, perimeter, closing, ok := optimizeTriangle(flight, rules.ClosingRatio, true); ok {
+			result.FAITriangle = better(result.FAITriangle, newScore(flight, idx, "fai_triangle", perimeter-closing, closing, rules.FAIMultiplier))
+		}
+	}
+
+	for _, val := range []*xcScore{result.FreeDistance, result.FlatTriangle, result.FAITriangle} {
+		if val != nil {
+			result.Best = better(result.Best, val)
+		}
+	}
+	return result
+}
+
+// Handles path: GET /api/track/<id>/score
+// The optional rules query parameter picks the scoring system, the configured one by default,
+// and free_distance, flat_triangle, fai_triangle and closing_ratio change its values
+func (s *server) handlerScore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "501 - Method not implemented", http.StatusNotImplemented)
+		return
+	}
+
+	rules, err := s.requestRules(r.URL.Query())
+	if err != nil {
+		http.Error(w, "400 - Bad Request, "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, fixes, ok := s.requestFixes(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scoreFixes(fixes, rules))
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// routeFixes returns a fix every 5 seconds flying straight between the waypoints (lat, lon) at 30 km/h
+func routeFixes(waypoints [][2]float64) []fix {
+	fixes := []fix{}
+	t := time.Date(2018, 7, 2, 12, 0, 0, 0, time.UTC)
+	for i := 1; i < len(waypoints); i++ {
+		from := fix{Lat: waypoints[i-1][0], Lon: waypoints[i-1][1]}
+		to := fix{Lat: waypoints[i][0], Lon: waypoints[i][1]}
+		steps := int(math.Ceil(fixDistance(from, to) / (30.0 / 720)))
+		for j := 0; j < steps; j++ {
+			ratio := float64(j) / float64(steps)
+			fixes = append(fixes, fix{
+				Time:             t,
+				Lat:              from.Lat + (to.Lat-from.Lat)*ratio,
+				Lon:              from.Lon + (to.Lon-from.Lon)*ratio,
+				PressureAltitude: 1500,
+				GNSSAltitude:     1500,
+			})
+			t = t.Add(5 * time.Second)
+		}
+	}
+	last := waypoints[len(waypoints)-1]
+	return append(fixes, fix{Time: t, Lat: last[0], Lon: last[1], PressureAltitude: 1500, GNSSAltitude: 1500})
+}
+
+// One degree of latitude is about 111 km, one degree of longitude about 78.6 km at 45 degrees north
+var (
+	pointA = [2]float64{45.0, 6.0}
+	pointB = [2]float64{45.0, 6.0 + 20.0/78.6}
+	pointC = [2]float64{45.0 + 17.32/111, 6.0 + 10.0/78.6}
+)
+
+func Test_scoreFixes_FAITriangle(t *testing.T) {
+	// An equilateral triangle of 20 km sides, closed on the start
+	fixes := routeFixes([][2]float64{pointA, pointB, pointC, pointA})
+	flagGround(fixes)
+
+	result := scoreFixes(fixes, scoringRuleSets["xcontest"])
+	if !assert.NotNil(t, result.FAITriangle) || !assert.NotNil(t, result.FlatTriangle) || !assert.NotNil(t, result.FreeDistance) {
+		return
+	}
+
+	assert.InDelta(t, 60, result.FAITriangle.Distance, 1)
+	assert.InDelta(t, 0, result.FAITriangle.ClosingDistance, 0.5)
+	assert.InDelta(t, 1.4*result.FAITriangle.Distance, result.FAITriangle.Points, 0.001)
+	assert.Len(t, result.FAITriangle.Turnpoints, 5)
+	assert.Equal(t, "start", result.FAITriangle.Turnpoints[0].Name)
+	assert.Equal(t, "tp2", result.FAITriangle.Turnpoints[2].Name)
+	assert.Equal(t, "finish", result.FAITriangle.Turnpoints[4].Name)
+
+	// The turnpoints are the corners of the triangle
+	corners := []fix{{Lat: pointB[0], Lon: pointB[1]}, {Lat: pointC[0], Lon: pointC[1]}}
+	for _, corner := range corners {
+		closest := math.Inf(1)
+		for _, val := range result.FAITriangle.Turnpoints[1:4] {
+			closest = math.Min(closest, fixDistance(corner, fix{Lat: val.Lat, Lon: val.Lon}))
+		}
+		assert.InDelta(t, 0, closest, 0.5)
+	}
+
+	// Free distance through the corners is the same 60 km, at a lower multiplier
+	assert.InDelta(t, 60, result.FreeDistance.Distance, 1)
+	assert.Equal(t, "fai_triangle", result.Best.Type)
+}
+
+func Test_scoreFixes_OpenTriangle(t *testing.T) {
+	// The same triangle landing 20 km away from the start: not closed
+	fixes := routeFixes([][2]float64{pointA, pointB, pointC})
+	flagGround(fixes)
+
+	result := scoreFixes(fixes, scoringRuleSets["xcontest"])
+	assert.Nil(t, result.FAITriangle)
+	assert.Nil(t, result.FlatTriangle)
+	if assert.NotNil(t, result.FreeDistance) {
+		assert.InDelta(t, 40, result.FreeDistance.Distance, 1)
+		assert.Equal(t, result.FreeDistance, result.Best)
+	}
+}
+
+func Test_scoreFixes_FlatTriangle(t *testing.T) {
+	// A long and narrow triangle: 30 km east, 20 km back west, and 18 km to land 5 km south of the start
+	pointD := [2]float64{45.0, 6.0 + 30.0/78.6}
+	pointE := [2]float64{45.0 + 8.0/111, 6.0 + 12.0/78.6}
+	pointF := [2]float64{45.0 - 5.0/111, 6.0}
+	fixes := routeFixes([][2]float64{pointA, pointD, pointE, pointF})
+	flagGround(fixes)
+
+	result := scoreFixes(fixes, scoringRuleSets["olc"])
+	if !assert.NotNil(t, result.FlatTriangle) || !assert.NotNil(t, result.FAITriangle) {
+		return
+	}
+	// The last turnpoint is on the way back, where the perimeter less the closing distance is the best
+	assert.InDelta(t, 63, result.FlatTriangle.Distance, 2)
+	assert.True(t, result.FlatTriangle.ClosingDistance <= 0.2*(result.FlatTriangle.Distance+result.FlatTriangle.ClosingDistance))
+	assert.Equal(t, 1.75, result.FlatTriangle.Multiplier)
+
+	// Only a smaller triangle inside it has the FAI shape
+	assert.True(t, result.FAITriangle.Distance < result.FlatTriangle.Distance)
+}
+
+func Test_scoreFixes_LongTrack(t *testing.T) {
+	// Zigzags over 10000 fixes, the scoring must stay fast
+	waypoints := [][2]float64{}
+	for i := 0; i < 8; i++ {
+		waypoints = append(waypoints, [2]float64{45.0 + float64(i)*0.05, 6.0 + float64(i%2)*0.2})
+	}
+	fixes := routeFixes(waypoints)
+	for len(fixes) < 10000 {
+		next := fixes[len(fixes)-1]
+		next.Time = next.Time.Add(5 * time.Second)
+		next.Lat += 0.0003
+		fixes = append(fixes, next)
+	}
+	flagGround(fixes)
+
+	begin := time.Now()
+	result := scoreFixes(fixes, scoringRuleSets["xcontest"])
+	assert.True(t, time.Since(begin) < 10*time.Second, "scoring took %s", time.Since(begin))
+	assert.NotNil(t, result.Best)
+}
+
+// sampleError returns the longest distance from a fix to the nearest sample, in km
+func sampleError(fixes []fix, sample []int) float64 {
+	max := 0.0
+	for k := 1; k < len(sample); k++ {
+		for i := sample[k-1] + 1; i < sample[k]; i++ {
+			d := math.Min(fixDistance(fixes[i], fixes[sample[k-1]]), fixDistance(fixes[i], fixes[sample[k]]))
+			max = math.Max(max, d)
+		}
+	}
+	return max
+}
+
+func Test_optimizeFree_ErrorBound(t *testing.T) {
+	// About 1500 fixes, so the free distance is searched on every third fix
+	fixes := routeFixes([][2]float64{pointA, pointB, pointC, {45.1, 6.05}, pointB})
+	sample := sampleIndexes(len(fixes), freeSamples)
+	if !assert.True(t, len(sample) < len(fixes)) {
+		return
+	}
+
+	every := sampleIndexes(len(fixes), len(fixes))
+	_, exact := optimizeFreeOn(fixes, every)
+	_, found := optimizeFree(fixes)
+	assert.True(t, found <= exact+1e-9)
+	assert.True(t, found >= exact-8*sampleError(fixes, sample), "found %f, optimum %f", found, exact)
+}
+
+func Test_optimizeTriangle_ErrorBound(t *testing.T) {
+	// A triangle of 6 km sides, about 450 fixes searched on 100 of them
+	pointB := [2]float64{45.0, 6.0 + 6.0/78.6}
+	pointC := [2]float64{45.0 + 5.2/111, 6.0 + 3.0/78.6}
+	fixes := routeFixes([][2]float64{pointA, pointB, pointC, pointA})
+	sample := sampleIndexes(len(fixes), 100)
+	bound := 8 * sampleError(fixes, sample)
+
+	for _, fai := range []bool{false, true} {
+		every := sampleIndexes(len(fixes), len(fixes))
+		_, perimeter, closing, ok := optimizeTriangleOn(fixes, every, 0.2, fai)
+		if !assert.True(t, ok) {
+			return
+		}
+		_, foundPerimeter, foundClosing, ok := optimizeTriangleOn(fixes, sample, 0.2, fai)
+		if assert.True(t, ok) {
+			exact, found := perimeter-closing, foundPerimeter-foundClosing
+			assert.True(t, found <= exact+1e-9)
+			assert.True(t, found >= exact-bound, "found %f, optimum %f", found, exact)
+		}
+	}
+}
+
+func Test_handlerScore(t *testing.T) {
+
+	s := newTestServer()
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+
+	trackID := postTrackFile(t, ts, "sample.igc")
+
+	resp, _ := http.Get(ts.URL + "/paragliding/api/track/" + trackID + "/score")
+	assert.Equal(t, 200, resp.StatusCode)
+	var result xcResult
+	json.NewDecoder(resp.Body).Decode(&result)
+	assert.Equal(t, "xcontest", result.Rules)
+	if assert.NotNil(t, result.Best) {
+		assert.Equal(t, "free_distance", result.Best.Type)
+		assert.True(t, result.Best.Distance > 0)
+	}
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/" + trackID + "/score?rules=olc")
+	json.NewDecoder(resp.Body).Decode(&result)
+	assert.Equal(t, "olc", result.Rules)
+
+	// The multipliers and the closing ratio of the request, and the rule sets of the configuration
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/" + trackID + "/score?rules=olc&free_distance=3&closing_ratio=0.05")
+	result = xcResult{}
+	json.NewDecoder(resp.Body).Decode(&result)
+	assert.Equal(t, 0.05, result.ClosingRatio)
+	if assert.NotNil(t, result.FreeDistance) {
+		assert.Equal(t, 3.0, result.FreeDistance.Multiplier)
+	}
+
+	s.cfg.ScoringRuleSets = []scoringRules{{Name: "club", FreeMultiplier: 2, FlatMultiplier: 2, FAIMultiplier: 2, ClosingRatio: 0.1}}
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/" + trackID + "/score?rules=club")
+	json.NewDecoder(resp.Body).Decode(&result)
+	assert.Equal(t, "club", result.Rules)
+	assert.Equal(t, 2.0, result.FreeDistance.Multiplier)
+
+	for _, val := range []string{"rules=nope", "free_distance=abc", "fai_triangle=-1", "closing_ratio=2"} {
+		resp, _ = http.Get(ts.URL + "/paragliding/api/track/" + trackID + "/score?" + val)
+		assert.Equal(t, 400, resp.StatusCode, val)
+	}
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/999999/score")
+	assert.Equal(t, 404, resp.StatusCode)
+}
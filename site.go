@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// *** LAUNCH AND LANDING SITES *** //
+
+// site is a launch or landing site of the catalogue
+type site struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	Lat         float64 `json:"lat"`
+	Lon         float64 `json:"lon"`
+	Radius      float64 `json:"radius"`      // in meters, the takeoffs and landings further away are not on the site
+	Orientation string  `json:"orientation"` // the wind directions the site is flown in, eg: "SW" or "N-NE"
+	Altitude    int64   `json:"altitude"`    // in meters
+}
+
+// siteStats are the figures of the flights that took off from a site
+type siteStats struct {
+	Flights        int     `json:"flights"`
+	Airtime        int64   `json:"airtime"`          // total, in seconds
+	BestPathLength float64 `json:"best_path_length"` // in km, along the longest track
+	BestTrack      string  `json:"best_track"`       // ID of the longest track, empty when no flight has a length
+}
+
+// loadSites reads the catalogue of sites from the JSON array in the file, or returns no site without a file
+func loadSites(path string) ([]site, error) {
+	if path == "" {
+		return []site{}, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sites := []site{}
+	if err := json.Unmarshal(data, &sites); err != nil {
+		return nil, fmt.Errorf("reading %s: %s", path, err)
+	}
+
+	ids := map[string]bool{}
+	for _, val := range sites {
+		switch {
+		case val.ID == "" || ids[val.ID]:
+			return nil, fmt.Errorf("site %q: the id must be set and unique", val.Name)
+		case val.Lat < -90 || val.Lat > 90 || val.Lon < -180 || val.Lon > 180:
+			return nil, fmt.Errorf("site %s: invalid position", val.ID)
+		case val.Radius <= 0:
+			return nil, fmt.Errorf("site %s: the radius must be positive", val.ID)
+		}
+		ids[val.ID] = true
+	}
+	return sites, nil
+}
+
+// nearestSite returns the ID of the nearest site whose radius has the position [lon, lat],
+// or an empty string if the position is on no site
+func nearestSite(sites []site, position []float64) string {
+	point := fix{Lat: position[1], Lon: position[0]}
+	nearest, distance := "", 0.0
+	for _, val := range sites {
+		d := fixDistance(point, fix{Lat: val.Lat, Lon: val.Lon}) * 1000
+		if d <= val.Radius && (nearest == "" || d < distance) {
+			nearest, distance = val.ID, d
+		}
+	}
+	return nearest
+}
+
+// requestSite returns the site of the path, or sends 404
+func (s *server) requestSite(w http.ResponseWriter, r *http.Request) (site, bool) {
+	id := mux.Vars(r)["id"]
+	for _, val := range s.sites {
+		if val.ID == id {
+			return val, true
+		}
+	}
+	http.Error(w, "404 - The site with that id doesn't exist", http.StatusNotFound)
+	return site{}, false
+}
+
+// Handles path: GET /api/site
+// Returns every site of the catalogue
+func (s *server) handlerSite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "501 - Method not implemented", http.StatusNotImplemented)
+		return
+	}
+
+	resSites := s.sites
+	if resSites == nil {
+		resSites = []site{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resSites)
+}
+
+// Handles path: GET /api/site/<id>
+func (s *server) handlerSiteID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "501 - Method not implemented", http.StatusNotImplemented)
+		return
+	}
+
+	resSite, ok := s.requestSite(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resSite)
+}
+
+// Handles path: GET /api/site/<id>/tracks
+// Returns the IDs of the tracks that took off from the site, or landed on it with at=landing,
+// with the filters, sort and pages of GET /api/track
+func (s *server) handlerSiteTracks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "501 - Method not implemented", http.StatusNotImplemented)
+		return
+	}
+
+	resSite, ok := s.requestSite(w, r)
+	if !ok {
+		return
+	}
+
+	q, err := parseTrackQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, "400 - Bad Request, "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.URL.Query().Get("at") {
+	case "", "takeoff":
+		q.TakeoffSite = resSite.ID
+	case "landing":
+		q.LandingSite = resSite.ID
+	default:
+		http.Error(w, "400 - Bad Request, at must be takeoff or landing", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	s.writeTrackList(w, r, q)
+}
+
+// Handles path: GET /api/site/<id>/stats
+// Returns the number of flights that took off from the site, their total airtime and the longest path
+func (s *server) handlerSiteStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "501 - Method not implemented", http.StatusNotImplemented)
+		return
+	}
+
+	resSite, ok := s.requestSite(w, r)
+	if !ok {
+		return
+	}
+
+	siteTracks, err := s.tracks.FindTracks(r.Context(), trackQuery{TakeoffSite: resSite.ID})
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	stats := siteStats{Flights: len(siteTracks)}
+	for _, val := range siteTracks {
+		stats.Airtime += val.Stats.Airtime
+		if val.Stats.Distance > stats.BestPathLength {
+			stats.BestPathLength, stats.BestTrack = val.Stats.Distance, val.UniqueID
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
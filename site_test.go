@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_loadSites(t *testing.T) {
+	sites, err := loadSites("testdata/sites.json")
+	if assert.Nil(t, err) && assert.Len(t, sites, 2) {
+		assert.Equal(t, site{ID: "planfait", Name: "Planfait", Lat: 45.8833, Lon: 6.25, Radius: 3000, Orientation: "W-NW", Altitude: 1250}, sites[0])
+	}
+
+	sites, err = loadSites("")
+	assert.Nil(t, err)
+	assert.Len(t, sites, 0)
+
+	for _, val := range []string{
+		`[{"id": "a", "lat": 45, "lon": 6, "radius": 100}, {"id": "a", "lat": 46, "lon": 6, "radius": 100}]`,
+		`[{"id": "a", "lat": 95, "lon": 6, "radius": 100}]`,
+		`[{"id": "a", "lat": 45, "lon": 6}]`,
+		`{"id": "a"}`,
+	} {
+		path := filepath.Join(t.TempDir(), "sites.json")
+		if err := os.WriteFile(path, []byte(val), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadSites(path)
+		assert.NotNil(t, err, val)
+	}
+}
+
+func Test_nearestSite(t *testing.T) {
+	sites := []site{
+		{ID: "big", Lat: 46, Lon: 6, Radius: 5000},
+		{ID: "small", Lat: 46.01, Lon: 6, Radius: 500},
+	}
+	assert.Equal(t, "small", nearestSite(sites, []float64{6, 46.012}))
+	assert.Equal(t, "big", nearestSite(sites, []float64{6, 45.99}))
+	assert.Equal(t, "", nearestSite(sites, []float64{7, 46}))
+}
+
+func Test_handlerSite(t *testing.T) {
+
+	s := newTestServer()
+	sites, err := loadSites("testdata/sites.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.sites = sites
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+
+	// The IGC sample takes off from Planfait and lands in Doussard, the GPX sample is on no site
+	ids := []string{postTrackFile(t, ts, "sample.igc"), postTrackFile(t, ts, "sample.gpx")}
+
+	track, err := s.tracks.GetTrack(context.Background(), ids[0])
+	if assert.Nil(t, err) {
+		assert.Equal(t, "planfait", track.TakeoffSite)
+		assert.Equal(t, "doussard", track.LandingSite)
+	}
+	track, _ = s.tracks.GetTrack(context.Background(), ids[1])
+	assert.Equal(t, "", track.TakeoffSite)
+
+	// A longer flight from Planfait
+	s.tracks.AddTrack(context.Background(), tracks{UniqueID: "5000", TakeoffSite: "planfait", TimeRecorded: time.Now(),
+		Stats: flightStats{Airtime: 3600, Distance: 42}})
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(ts.URL + "/paragliding/api/site" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	_, body := get("")
+	var resSites []site
+	if assert.Nil(t, json.Unmarshal([]byte(body), &resSites)) {
+		assert.Equal(t, sites, resSites)
+	}
+	_, body = get("/doussard")
+	assert.Contains(t, body, `"name":"Doussard landing"`)
+
+	_, body = get("/planfait/tracks")
+	assert.Equal(t, idList(ids[0], "5000"), body)
+	_, body = get("/planfait/tracks?sort=-distance&limit=1")
+	assert.Equal(t, idList("5000"), body)
+	_, body = get("/doussard/tracks?at=landing")
+	assert.Equal(t, idList(ids[0]), body)
+	_, body = get("/doussard/tracks")
+	assert.Equal(t, idList(), body)
+
+	_, body = get("/planfait/stats")
+	stats := siteStats{}
+	if assert.Nil(t, json.Unmarshal([]byte(body), &stats)) {
+		assert.Equal(t, 2, stats.Flights)
+		assert.Equal(t, int64(3600+300), stats.Airtime)
+		assert.Equal(t, 42.0, stats.BestPathLength)
+		assert.Equal(t, "5000", stats.BestTrack)
+	}
+	_, body = get("/doussard/stats")
+	assert.Equal(t, `{"flights":0,"airtime":0,"best_path_length":0,"best_track":""}`+"\n", body)
+
+	// A flight without a length is counted, but is not the best track
+	s.tracks.AddTrack(context.Background(), tracks{UniqueID: "5001", TakeoffSite: "doussard", TimeRecorded: time.Now(),
+		Stats: flightStats{Airtime: 60}})
+	_, body = get("/doussard/stats")
+	assert.Equal(t, `{"flights":1,"airtime":60,"best_path_length":0,"best_track":""}`+"\n", body)
+
+	status, _ := get("/unknown/stats")
+	assert.Equal(t, 404, status)
+	status, _ = get("/planfait/tracks?at=top")
+	assert.Equal(t, 400, status)
+
+	// Without a catalogue there is no site
+	s.sites = nil
+	_, body = get("")
+	assert.Equal(t, "[]\n", body)
+}
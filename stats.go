@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	igc "github.com/marni/goigc"
+)
+
+// *** FLIGHT STATISTICS *** //
+
+// flightStats are the figures computed from the fixes of a track
+// Altitudes are in meters, climb and sink in m/s, speeds in km/h
+type flightStats struct {
+	Takeoff             time.Time `json:"takeoff"`
+	Landing             time.Time `json:"landing"`
+	Airtime             int64     `json:"airtime"` // in seconds
+	MaxGNSSAltitude     int64     `json:"max_gnss_altitude"`
+	MinGNSSAltitude     int64     `json:"min_gnss_altitude"`
+	MaxPressureAltitude int64     `json:"max_pressure_altitude"`
+	MinPressureAltitude int64     `json:"min_pressure_altitude"`
+	AltitudeGain        int64     `json:"altitude_gain"` // sum of every climb
+	MaxClimb            float64   `json:"max_climb"`     // best average climb over the window
+	MaxSink             float64   `json:"max_sink"`      // worst average sink over the window, negative
+	AvgSpeed            float64   `json:"avg_speed"`
+	MaxSpeed            float64   `json:"max_speed"`         // best average ground speed over the window
+	Distance            float64   `json:"distance"`          // in km, in flight only
+	CirclingPercent     float64   `json:"circling_percent"`  // share of the airtime spent in thermals
+	AvgThermalClimb     float64   `json:"avg_thermal_climb"` // average climb rate in the thermals
+	Window              int64     `json:"window"`            // in seconds
+
+	Flights []flightStats `json:"flights,omitempty"` // each flight of the track, when there are relaunches
+}
+
+// fixDistance returns the great circle distance between two fixes in km, like igc.Point.Distance
+// It is computed here because the scoring calls it millions of times, and igc.NewPointFromLatLng allocates
+func fixDistance(a fix, b fix) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat, dLon := lat2-lat1, (b.Lon-a.Lon)*math.Pi/180
+
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dLon/2), 2)
+	return 2 * igc.EarthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// fixAltitude returns the GNSS altitude, or the pressure altitude for loggers without GNSS altitude
+func fixAltitude(val fix, useGNSS bool) int64 {
+	if useGNSS {
+		return val.GNSSAltitude
+	}
+	return val.PressureAltitude
+}
+
+// hasGNSSAltitude tells if the logger recorded the GNSS altitude, old loggers leave it to 0
+func hasGNSSAltitude(fixes []fix) bool {
+	for _, val := range fixes {
+		if val.GNSSAltitude != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// computeStats computes the statistics of the track from its flights, the fixes on the ground are left out
+// Each flight has its own statistics in Flights
+func computeStats(fixes []fix, window time.Duration) flightStats {
+	stats := flightStats{Window: int64(window / time.Second)}
+
+	for key, val := range flagged(fixes) {
+		flight := segmentStats(fixes[val.Start:val.End+1], window)
+
+		if key == 0 {
+			stats = flight
+		} else {
+			stats.Landing = flight.Landing
+			stats.Airtime += flight.Airtime
+			stats.MaxGNSSAltitude = max64(stats.MaxGNSSAltitude, flight.MaxGNSSAltitude)
+			stats.MinGNSSAltitude = min64(stats.MinGNSSAltitude, flight.MinGNSSAltitude)
+			stats.MaxPressureAltitude = max64(stats.MaxPressureAltitude, flight.MaxPressureAltitude)
+			stats.MinPressureAltitude = min64(stats.MinPressureAltitude, flight.MinPressureAltitude)
+			stats.AltitudeGain += flight.AltitudeGain
+			stats.MaxClimb = math.Max(stats.MaxClimb, flight.MaxClimb)
+			stats.MaxSink = math.Min(stats.MaxSink, flight.MaxSink)
+			stats.MaxSpeed = math.Max(stats.MaxSpeed, flight.MaxSpeed)
+			stats.Distance += flight.Distance
+		}
+		stats.Flights = append(stats.Flights, flight)
+	}
+
+	if stats.Airtime > 0 {
+		stats.AvgSpeed = stats.Distance / (float64(stats.Airtime) / 3600)
+	}
+	stats.CirclingPercent, stats.AvgThermalClimb = thermalTotals(detectThermals(fixes), stats.Airtime)
+	return stats
+}
+
+// segmentStats computes the statistics of one flight
+// Climb, sink and max speed are averaged over the window, so a single noisy fix doesn't count
+func segmentStats(fixes []fix, window time.Duration) flightStats {
+	stats := flightStats{Window: int64(window / time.Second)}
+	if len(fixes) == 0 {
+		return stats
+	}
+
+	stats.Takeoff = fixes[0].Time
+	stats.Landing = fixes[len(fixes)-1].Time
+	stats.Airtime = int64(stats.Landing.Sub(stats.Takeoff) / time.Second)
+
+	stats.MaxGNSSAltitude, stats.MinGNSSAltitude = fixes[0].GNSSAltitude, fixes[0].GNSSAltitude
+	stats.MaxPressureAltitude, stats.MinPressureAltitude = fixes[0].PressureAltitude, fixes[0].PressureAltitude
+	useGNSS := false
+	for _, val := range fixes {
+		stats.MaxGNSSAltitude = max64(stats.MaxGNSSAltitude, val.GNSSAltitude)
+		stats.MinGNSSAltitude = min64(stats.MinGNSSAltitude, val.GNSSAltitude)
+		stats.MaxPressureAltitude = max64(stats.MaxPressureAltitude, val.PressureAltitude)
+		stats.MinPressureAltitude = min64(stats.MinPressureAltitude, val.PressureAltitude)
+		if val.GNSSAltitude != 0 {
+			useGNSS = true
+		}
+	}
+
+	for i := 1; i < len(fixes); i++ {
+		stats.Distance += fixDistance(fixes[i-1], fixes[i])
+		if gain := fixAltitude(fixes[i], useGNSS) - fixAltitude(fixes[i-1], useGNSS); gain > 0 {
+			stats.AltitudeGain += gain
+		}
+	}
+	if stats.Airtime > 0 {
+		stats.AvgSpeed = stats.Distance / (float64(stats.Airtime) / 3600)
+	}
+	stats.CirclingPercent, stats.AvgThermalClimb = thermalTotals(detectThermals(fixes), stats.Airtime)
+
+	// j is the first fix at least one window after the fix i
+	j := 0
+	for i := range fixes {
+		for j < len(fixes) && fixes[j].Time.Sub(fixes[i].Time) < window {
+			j++
+		}
+		if j == len(fixes) {
+			break
+		}
+
+		seconds := fixes[j].Time.Sub(fixes[i].Time).Seconds()
+		vario := float64(fixAltitude(fixes[j], useGNSS)-fixAltitude(fixes[i], useGNSS)) / seconds
+		stats.MaxClimb = math.Max(stats.MaxClimb, vario)
+		stats.MaxSink = math.Min(stats.MaxSink, vario)
+		stats.MaxSpeed = math.Max(stats.MaxSpeed, fixDistance(fixes[i], fixes[j])/(seconds/3600))
+	}
+
+	return stats
+}
+
+func max64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// trackStats returns the statistics kept with the track,
+// or computes them from the fixes for tracks added before they were kept
+func (s *server) trackStats(ctx context.Context, track tracks) (flightStats, error) {
+	if !track.Stats.Takeoff.IsZero() {
+		return track.Stats, nil
+	}
+
+	fixes, err := s.loadFixes(ctx, track.UniqueID)
+	if err != nil {
+		return flightStats{}, err
+	}
+	return computeStats(fixes, time.Duration(s.cfg.StatsWindow)), nil
+}
+
+// statsField returns the value of one statistic, named as in the JSON of flightStats
+func statsField(stats flightStats, field string) (string, bool) {
+	switch field {
+	case "takeoff":
+		return stats.Takeoff.Format(time.RFC3339), true
+	case "landing":
+		return stats.Landing.Format(time.RFC3339), true
+	case "airtime":
+		return strconv.FormatInt(stats.Airtime, 10), true
+	case "max_gnss_altitude":
+		return strconv.FormatInt(stats.MaxGNSSAltitude, 10), true
+	case "min_gnss_altitude":
+		return strconv.FormatInt(stats.MinGNSSAltitude, 10), true
+	case "max_pressure_altitude":
+		return strconv.FormatInt(stats.MaxPressureAltitude, 10), true
+	case "min_pressure_altitude":
+		return strconv.FormatInt(stats.MinPressureAltitude, 10), true
+	case "altitude_gain":
+		return strconv.FormatInt(stats.AltitudeGain, 10), true
+	case "max_climb":
+		return FloatToString(stats.MaxClimb), true
+	case "max_sink":
+		return FloatToString(stats.MaxSink), true
+	case "avg_speed":
+		return FloatToString(stats.AvgSpeed), true
+	case "max_speed":
+		return FloatToString(stats.MaxSpeed), true
+	case "distance":
+		return FloatToString(stats.Distance), true
+	case "circling_percent":
+		return FloatToString(stats.CirclingPercent), true
+	case "avg_thermal_climb":
+		return FloatToString(stats.AvgThermalClimb), true
+	case "flights":
+		return strconv.Itoa(len(stats.Flights)), true
+	}
+	return "", false
+}
+
+// Handles path: GET /api/track/<id>/stats
+// The optional window query parameter (eg: 30s) computes climb, sink and max speed over another window
+func (s *server) handlerStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "501 - Method not implemented", http.StatusNotImplemented)
+		return
+	}
+
+	var window time.Duration
+	if val := r.URL.Query().Get("window"); val != "" {
+		var err error
+		if window, err = time.ParseDuration(val); err != nil || window < time.Second {
+			http.Error(w, "400 - Bad Request, window must be a duration of at least 1s, eg: 30s", http.StatusBadRequest)
+			return
+		}
+	}
+
+	track, err := s.tracks.GetTrack(r.Context(), mux.Vars(r)["id"])
+	if err == errNotFound {
+		http.Error(w, "404 - The trackInfo with that id doesn't exists in our database ", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	var stats flightStats
+	if window > 0 {
+		var fixes []fix
+		fixes, err = s.loadFixes(r.Context(), track.UniqueID)
+		stats = computeStats(fixes, window)
+	} else {
+		stats, err = s.trackStats(r.Context(), track)
+	}
+	if err == errNotFound {
+		http.Error(w, "404 - The points of this track were not kept", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
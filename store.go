@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// *** STORAGE *** //
+
+// errNotFound is returned by a store when the requested document doesn't exist
+var errNotFound = errors.New("not found")
+
+// errDuplicateID is returned by a store when a document with the same ID already exists
+var errDuplicateID = errors.New("duplicate ID")
+
+// errDuplicateContent is returned by a store when a track with the same content hash already exists
+var errDuplicateContent = errors.New("duplicate content")
+
+// firstID is the first ID given by the counters
+// The old random IDs were all below 1000, so new IDs never clash with them
+const firstID = 1000
+
+// isLegacyID tells if the ID was made by the old random generator
+func isLegacyID(id string) bool {
+	n, err := strconv.Atoi(id)
+	return err != nil || n < firstID
+}
+
+// TrackStore is the persistence layer for the tracks registered in the API
+// Tracks are always returned in the order they were added
+type TrackStore interface {
+	// AddTrack stores a new track, or returns errDuplicateID if a track with the same ID exists
+	// and errDuplicateContent if a track with the same (non-empty) ContentHash exists
+	AddTrack(ctx context.Context, track tracks) error
+	// GetTrack returns the track with the given ID, or errNotFound
+	// Tracks that had an old random ID are found by it as well
+	GetTrack(ctx context.Context, id string) (tracks, error)
+	// GetTrackByURL returns the track registered from the given URL, or errNotFound
+	GetTrackByURL(ctx context.Context, url string) (tracks, error)
+	// GetTrackByHash returns the track with the given content hash, or errNotFound
+	GetTrackByHash(ctx context.Context, hash string) (tracks, error)
+	// GetAllTracks returns every track in the store
+	GetAllTracks(ctx context.Context) ([]tracks, error)
+	// EachTrack calls fn for every track in the store, one at a time without loading them all,
+	// and stops at the first error
+	EachTrack(ctx context.Context, fn func(tracks) error) error
+	// FindTracks returns the page of the tracks selected and sorted by the query,
+	// or errNotFound if the track the page starts after doesn't exist
+	FindTracks(ctx context.Context, q trackQuery) ([]tracks, error)
+	// CountTracks returns the number of tracks in the store
+	CountTracks(ctx context.Context) (int64, error)
+	// DeleteAllTracks removes every track and returns how many were removed
+	DeleteAllTracks(ctx context.Context) (int64, error)
+}
+
+// WebhookStore is the persistence layer for the registered webhooks
+type WebhookStore interface {
+	// AddWebhook stores a new webhook registration, or returns errDuplicateID if the ID exists
+	AddWebhook(ctx context.Context, webhook Webhook) error
+	// UpdateWebhook changes the minTriggerValue of the webhook registered with the same URL
+	UpdateWebhook(ctx context.Context, webhook Webhook) error
+	// GetWebhook returns the webhook with the given (or old random) ID, or errNotFound
+	GetWebhook(ctx context.Context, id string) (Webhook, error)
+	// GetWebhookByURL returns the webhook registered for the given URL, or errNotFound
+	GetWebhookByURL(ctx context.Context, url string) (Webhook, error)
+	// GetAllWebhooks returns every registered webhook
+	GetAllWebhooks(ctx context.Context) ([]Webhook, error)
+	// DeleteWebhook removes the webhook with the given (or old random) ID
+	DeleteWebhook(ctx context.Context, id string) error
+}
+
+// FileStore keeps binary files, like the original IGC files, grouped in buckets
+type FileStore interface {
+	// PutFile stores (or replaces) the file with the given ID in the bucket
+	PutFile(ctx context.Context, bucket string, id string, data []byte) error
+	// GetFile returns the file with the given ID from the bucket, or errNotFound
+	GetFile(ctx context.Context, bucket string, id string) ([]byte, error)
+	// DeleteFile removes the file with the given ID from the bucket, if it exists
+	DeleteFile(ctx context.Context, bucket string, id string) error
+	// DeleteFiles removes every file in the bucket
+	DeleteFiles(ctx context.Context, bucket string) error
+}
+
+// JobStore keeps the ingestion jobs, so the queue survives restarts
+type JobStore interface {
+	// AddJob stores a new job
+	AddJob(ctx context.Context, job ingestJob) error
+	// UpdateJob replaces the job with the same ID, or returns errNotFound
+	UpdateJob(ctx context.Context, job ingestJob) error
+	// GetJob returns the job with the given ID, or errNotFound
+	GetJob(ctx context.Context, id string) (ingestJob, error)
+	// GetPendingJobs returns the jobs that are not stored or failed yet
+	GetPendingJobs(ctx context.Context) ([]ingestJob, error)
+}
+
+// TaskStore keeps the competition tasks
+type TaskStore interface {
+	// AddTask stores a new task, or returns errDuplicateID if a task with the same ID exists
+	AddTask(ctx context.Context, task compTask) error
+	// GetTask returns the task with the given ID, or errNotFound
+	GetTask(ctx context.Context, id string) (compTask, error)
+	// UpdateTask replaces the task with the same ID, or returns errNotFound
+	UpdateTask(ctx context.Context, task compTask) error
+	// GetAllTasks returns every task, in the order they were added
+	GetAllTasks(ctx context.Context) ([]compTask, error)
+	// DeleteTask removes the task with the given ID, or returns errNotFound
+	DeleteTask(ctx context.Context, id string) error
+}
+
+// CounterStore keeps named counters used to create IDs
+type CounterStore interface {
+	// NextCounter atomically increments the counter and returns the new value, starting from 1
+	NextCounter(ctx context.Context, name string) (int64, error)
+}
+
+// Store is a backend that keeps both tracks and webhooks
+type Store interface {
+	TrackStore
+	WebhookStore
+	FileStore
+	JobStore
+	TaskStore
+	CounterStore
+	// MigrateIDs gives a counter ID to the tracks and webhooks that still have an old random ID,
+	// keeping the old one as LegacyID so the old URLs keep working. It returns how many were migrated
+	MigrateIDs(ctx context.Context) (int, error)
+	// Close releases the connection, waiting at most until the context is done
+	Close(ctx context.Context) error
+}
+
+// openStore opens the storage backend selected in the configuration:
+// "mongodb", "bolt" for a single local file, or "memory"
+// The old random IDs are migrated before the store is used
+func openStore(cfg Config) (Store, error) {
+	var store Store
+	var err error
+
+	switch cfg.Storage {
+	case "mongodb":
+		client, err := mongoConnect(cfg.DBURI, time.Duration(cfg.DBTimeout))
+		if err != nil {
+			return nil, err
+		}
+		store = newMongoStore(client, cfg.DBName, time.Duration(cfg.DBTimeout))
+	case "bolt":
+		store, err = newBoltStore(cfg.BoltPath)
+		if err != nil {
+			return nil, err
+		}
+	case "memory":
+		store = newMemoryStore()
+	default:
+		return nil, fmt.Errorf("unknown storage %q", cfg.Storage)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	migrated, err := store.MigrateIDs(ctx)
+	if err != nil {
+		store.Close(ctx)
+		return nil, fmt.Errorf("migrating the IDs: %s", err)
+	}
+	if migrated > 0 {
+		log.Printf("Migrated %d tracks and webhooks to unique IDs", migrated)
+	}
+
+	return store, nil
+}
+
+// matchTrackID tells if the track has the given ID, or had it before the migration
+func matchTrackID(track tracks, id string) bool {
+	return track.UniqueID == id || (track.LegacyID != "" && track.LegacyID == id)
+}
+
+// matchWebhookID tells if the webhook has the given ID, or had it before the migration
+func matchWebhookID(webhook Webhook, id string) bool {
+	return webhook.WebhookID == id || (webhook.LegacyID != "" && webhook.LegacyID == id)
+}
+
+// counterID returns the ID made from the nth value of a counter
+func counterID(n int64) string {
+	return strconv.FormatInt(firstID+n-1, 10)
+}
+
+// nextID returns a new unique ID from the named counter
+func nextID(ctx context.Context, counters CounterStore, name string) (string, error) {
+	n, err := counters.NextCounter(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return counterID(n), nil
+}
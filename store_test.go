@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/mongo"
+	bolt "go.etcd.io/bbolt"
+)
+
+// newTestServer returns a server backed by an empty in-memory store
+func newTestServer() *server {
+	return newServer(defaultConfig(), newMemoryStore())
+}
+
+// idList returns the JSON array of the IDs, as the track list sends it
+func idList(ids ...string) string {
+	data, _ := json.Marshal(append([]string{}, ids...))
+	return string(data) + "\n"
+}
+
+// postTrackFile posts the IGC or GPX file of testdata to the test server and returns the ID of the new track
+func postTrackFile(t *testing.T, ts *httptest.Server, name string) string {
+	data, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contentType := igcContentType
+	if isGPX(data) {
+		contentType = gpxContentType
+	}
+
+	resp, err := http.Post(ts.URL+"/paragliding/api/track", contentType, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error executing the POST request, %s", err)
+	}
+	defer resp.Body.Close()
+	var created map[string]string
+	json.NewDecoder(resp.Body).Decode(&created)
+	return created["id"]
+}
+
+// mongoTestStore connects to the database in MONGODB_URI, the test is skipped if it isn't set
+func mongoTestStore(t *testing.T) *mongoStore {
+	uri := os.Getenv("MONGODB_URI")
+	if uri == "" {
+		t.Skip("MONGODB_URI is not set, skipping MongoDB test")
+	}
+
+	client, err := mongo.Connect(context.Background(), uri, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newMongoStore(client, "igcfiles_test", 5*time.Second)
+}
+
+// testTrackStore runs the same checks against every TrackStore implementation
+func testTrackStore(t *testing.T, store TrackStore) {
+	ctx := context.Background()
+
+	if _, err := store.DeleteAllTracks(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	igcTracks := []tracks{
+		tracks{UniqueID: "1", Pilot: "Pilot 1", URL: "http://example.com/1.igc", TimeRecorded: time.Now()},
+		tracks{UniqueID: "2", Pilot: "Pilot 2", URL: "http://example.com/2.igc", TimeRecorded: time.Now()},
+	}
+	for _, val := range igcTracks {
+		if err := store.AddTrack(ctx, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	track, err := store.GetTrack(ctx, "2")
+	if err != nil || track.Pilot != "Pilot 2" {
+		t.Errorf("Expected track 2, received %v, %v", track, err)
+	}
+
+	track, err = store.GetTrackByURL(ctx, "http://example.com/1.igc")
+	if err != nil || track.UniqueID != "1" {
+		t.Errorf("Expected track 1, received %v, %v", track, err)
+	}
+
+	if _, err = store.GetTrack(ctx, "3"); err != errNotFound {
+		t.Errorf("Expected errNotFound, received %v", err)
+	}
+
+	allTracks, err := store.GetAllTracks(ctx)
+	if err != nil || len(allTracks) != 2 || allTracks[0].UniqueID != "1" {
+		t.Errorf("Expected both tracks in insertion order, received %v, %v", allTracks, err)
+	}
+
+	ids := []string{}
+	err = store.EachTrack(ctx, func(track tracks) error {
+		ids = append(ids, track.UniqueID)
+		return nil
+	})
+	if err != nil || len(ids) != 2 || ids[0] != "1" {
+		t.Errorf("Expected both tracks in insertion order, received %v, %v", ids, err)
+	}
+	if err = store.EachTrack(ctx, func(track tracks) error { return errNotFound }); err != errNotFound {
+		t.Errorf("Expected the error of fn, received %v", err)
+	}
+
+	found, err := store.FindTracks(ctx, trackQuery{Pilot: "Pilot 2"})
+	if err != nil || len(found) != 1 || found[0].UniqueID != "2" {
+		t.Errorf("Expected track 2, received %v, %v", found, err)
+	}
+	found, err = store.FindTracks(ctx, trackQuery{Sort: "pilot", Desc: true, Limit: 1})
+	if err != nil || len(found) != 1 || found[0].UniqueID != "2" {
+		t.Errorf("Expected track 2 first, received %v, %v", found, err)
+	}
+	found, err = store.FindTracks(ctx, trackQuery{Sort: "pilot", Desc: true, After: "2"})
+	if err != nil || len(found) != 1 || found[0].UniqueID != "1" {
+		t.Errorf("Expected track 1 after track 2, received %v, %v", found, err)
+	}
+	if _, err = store.FindTracks(ctx, trackQuery{After: "3"}); err != errNotFound {
+		t.Errorf("Expected errNotFound, received %v", err)
+	}
+
+	count, err := store.CountTracks(ctx)
+	if err != nil || count != 2 {
+		t.Errorf("Expected count 2, received %d, %v", count, err)
+	}
+
+	count, err = store.DeleteAllTracks(ctx)
+	if err != nil || count != 2 {
+		t.Errorf("Expected 2 tracks deleted, received %d, %v", count, err)
+	}
+
+	count, _ = store.CountTracks(ctx)
+	if count != 0 {
+		t.Errorf("Expected an empty store, received %d tracks", count)
+	}
+
+	if err = store.AddTrack(ctx, igcTracks[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.AddTrack(ctx, igcTracks[0]); err != errDuplicateID {
+		t.Errorf("Expected errDuplicateID, received %v", err)
+	}
+
+	hashed := tracks{UniqueID: "3", ContentHash: "abc", TimeRecorded: time.Now()}
+	if err = store.AddTrack(ctx, hashed); err != nil {
+		t.Fatal(err)
+	}
+	track, err = store.GetTrackByHash(ctx, "abc")
+	if err != nil || track.UniqueID != "3" {
+		t.Errorf("Expected track 3, received %v, %v", track, err)
+	}
+	hashed.UniqueID = "4"
+	if err = store.AddTrack(ctx, hashed); err != errDuplicateContent {
+		t.Errorf("Expected errDuplicateContent, received %v", err)
+	}
+	store.DeleteAllTracks(ctx)
+}
+
+// testWebhookStore runs the same checks against every WebhookStore implementation
+func testWebhookStore(t *testing.T, store WebhookStore) {
+	ctx := context.Background()
+
+	webhook := Webhook{WebhookURL: "http://example.com/hook", MinTriggerValue: 1, WebhookID: "7"}
+	if err := store.AddWebhook(ctx, webhook); err != nil {
+		t.Fatal(err)
+	}
+
+	webhook.MinTriggerValue = 3
+	if err := store.UpdateWebhook(ctx, webhook); err != nil {
+		t.Fatal(err)
+	}
+
+	resWebhook, err := store.GetWebhook(ctx, "7")
+	if err != nil || resWebhook.MinTriggerValue != 3 {
+		t.Errorf("Expected updated webhook, received %v, %v", resWebhook, err)
+	}
+
+	resWebhook, err = store.GetWebhookByURL(ctx, "http://example.com/hook")
+	if err != nil || resWebhook.WebhookID != "7" {
+		t.Errorf("Expected webhook 7, received %v, %v", resWebhook, err)
+	}
+
+	allWebhooks, err := store.GetAllWebhooks(ctx)
+	if err != nil || len(allWebhooks) == 0 {
+		t.Errorf("Expected at least one webhook, received %v, %v", allWebhooks, err)
+	}
+
+	if err = store.DeleteWebhook(ctx, "7"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = store.GetWebhook(ctx, "7"); err != errNotFound {
+		t.Errorf("Expected errNotFound, received %v", err)
+	}
+}
+
+// testCounterStore checks that the counters never give the same value twice
+func testCounterStore(t *testing.T, store CounterStore) {
+	ctx := context.Background()
+
+	first, err := nextID(ctx, store, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := nextID(ctx, store, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first == second || isLegacyID(first) || isLegacyID(second) {
+		t.Errorf("Expected two different new IDs, received %s and %s", first, second)
+	}
+}
+
+// testFileStore checks that files are kept per bucket and returned unchanged
+func testFileStore(t *testing.T, store FileStore) {
+	ctx := context.Background()
+
+	if err := store.PutFile(ctx, "test_files", "1", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutFile(ctx, "test_files", "1", []byte("replaced")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := store.GetFile(ctx, "test_files", "1")
+	if err != nil || string(data) != "replaced" {
+		t.Errorf("Expected the replaced file, received %q, %v", data, err)
+	}
+
+	if _, err = store.GetFile(ctx, "other_files", "1"); err != errNotFound {
+		t.Errorf("Expected errNotFound from another bucket, received %v", err)
+	}
+
+	store.PutFile(ctx, "test_files", "2", []byte("second"))
+	if err = store.DeleteFile(ctx, "test_files", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.GetFile(ctx, "test_files", "2"); err != errNotFound {
+		t.Errorf("Expected errNotFound after deleting the file, received %v", err)
+	}
+	if err = store.DeleteFile(ctx, "other_files", "2"); err != nil {
+		t.Errorf("Expected no error deleting a missing file, received %v", err)
+	}
+
+	if err = store.DeleteFiles(ctx, "test_files"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.GetFile(ctx, "test_files", "1"); err != errNotFound {
+		t.Errorf("Expected errNotFound after delete, received %v", err)
+	}
+}
+
+// testJobStore checks that jobs are updated in place and that finished jobs are not pending
+func testJobStore(t *testing.T, store JobStore) {
+	ctx := context.Background()
+
+	jobs := []ingestJob{
+		ingestJob{JobID: "1", URL: "http://example.com/1.igc", State: jobQueued, Created: time.Now()},
+		ingestJob{JobID: "2", URL: "http://example.com/2.igc", State: jobQueued, Created: time.Now()},
+	}
+	for _, val := range jobs {
+		if err := store.AddJob(ctx, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jobs[0].State = jobStored
+	jobs[0].TrackID = "1000"
+	if err := store.UpdateJob(ctx, jobs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := store.GetJob(ctx, "1")
+	if err != nil || job.State != jobStored || job.TrackID != "1000" {
+		t.Errorf("Expected the stored job, received %v, %v", job, err)
+	}
+
+	pending, err := store.GetPendingJobs(ctx)
+	if err != nil || len(pending) != 1 || pending[0].JobID != "2" {
+		t.Errorf("Expected job 2 pending, received %v, %v", pending, err)
+	}
+
+	if err = store.UpdateJob(ctx, ingestJob{JobID: "3"}); err != errNotFound {
+		t.Errorf("Expected errNotFound, received %v", err)
+	}
+	if _, err = store.GetJob(ctx, "3"); err != errNotFound {
+		t.Errorf("Expected errNotFound, received %v", err)
+	}
+}
+
+// testTaskStore checks that tasks keep their order and that IDs are unique
+func testTaskStore(t *testing.T, store TaskStore) {
+	ctx := context.Background()
+
+	for _, id := range []string{"1", "2"} {
+		if err := store.AddTask(ctx, compTask{TaskID: id, Name: "Task " + id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.AddTask(ctx, compTask{TaskID: "1"}); err != errDuplicateID {
+		t.Errorf("Expected errDuplicateID, received %v", err)
+	}
+
+	task, err := store.GetTask(ctx, "2")
+	if err != nil || task.Name != "Task 2" {
+		t.Errorf("Expected task 2, received %v, %v", task, err)
+	}
+
+	if err = store.UpdateTask(ctx, compTask{TaskID: "2", Name: "Task 2", TrackIDs: []string{"1000"}}); err != nil {
+		t.Error(err)
+	}
+	task, err = store.GetTask(ctx, "2")
+	if err != nil || len(task.TrackIDs) != 1 {
+		t.Errorf("Expected the updated task 2, received %v, %v", task, err)
+	}
+	if err = store.UpdateTask(ctx, compTask{TaskID: "3"}); err != errNotFound {
+		t.Errorf("Expected errNotFound, received %v", err)
+	}
+
+	allTasks, err := store.GetAllTasks(ctx)
+	if err != nil || len(allTasks) != 2 || allTasks[0].TaskID != "1" {
+		t.Errorf("Expected tasks 1 and 2, received %v, %v", allTasks, err)
+	}
+
+	if err = store.DeleteTask(ctx, "1"); err != nil {
+		t.Error(err)
+	}
+	if _, err = store.GetTask(ctx, "1"); err != errNotFound {
+		t.Errorf("Expected errNotFound, received %v", err)
+	}
+	if err = store.DeleteTask(ctx, "1"); err != errNotFound {
+		t.Errorf("Expected errNotFound, received %v", err)
+	}
+	store.DeleteTask(ctx, "2")
+}
+
+// testMigrateIDs checks that tracks with colliding random IDs get unique IDs, and that the old ID still works
+func testMigrateIDs(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	// The caller has written two tracks with the old random ID 57, which AddTrack would refuse
+	migrated, err := store.MigrateIDs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 2 {
+		t.Errorf("Expected 2 tracks migrated, received %d", migrated)
+	}
+
+	allTracks, _ := store.GetAllTracks(ctx)
+	if len(allTracks) != 2 || allTracks[0].UniqueID == allTracks[1].UniqueID {
+		t.Fatalf("Expected 2 tracks with different IDs, received %v", allTracks)
+	}
+
+	track, err := store.GetTrack(ctx, "57")
+	if err != nil || track.UniqueID != allTracks[0].UniqueID {
+		t.Errorf("Expected the old ID to find the first track, received %v, %v", track, err)
+	}
+
+	migrated, _ = store.MigrateIDs(ctx)
+	if migrated != 0 {
+		t.Errorf("Expected the migration to run only once, received %d", migrated)
+	}
+}
+
+func Test_memoryStore(t *testing.T) {
+	store := newMemoryStore()
+	testTrackStore(t, store)
+	testWebhookStore(t, store)
+	testCounterStore(t, store)
+	testFileStore(t, store)
+	testJobStore(t, store)
+	testTaskStore(t, store)
+}
+
+func Test_mongoStore(t *testing.T) {
+	store := mongoTestStore(t)
+	testTrackStore(t, store)
+	testWebhookStore(t, store)
+	testCounterStore(t, store)
+	testFileStore(t, store)
+
+	// There is no way to delete jobs, the jobs of the previous run are dropped here
+	if err := store.jobColl().Drop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testJobStore(t, store)
+	testTaskStore(t, store)
+}
+
+func Test_isDuplicateKeyOn(t *testing.T) {
+	hashErr := mongo.WriteErrors{{Code: 11000,
+		Message: `E11000 duplicate key error collection: paragliding.tracks index: contenthash_1 dup key: { : "ab12" }`}}
+	idErr := mongo.WriteErrors{{Code: 11000,
+		Message: `E11000 duplicate key error collection: paragliding.tracks index: uniqueid_1 dup key: { : "contenthash" }`}}
+
+	if !isDuplicateKeyOn(hashErr, hashIndex) {
+		t.Error("The duplicate content hash is not detected")
+	}
+	if isDuplicateKeyOn(idErr, hashIndex) || !isDuplicateKey(idErr) {
+		t.Error("The duplicate ID is taken for a duplicate content hash")
+	}
+	if isDuplicateKeyOn(mongo.WriteErrors{{Code: 121, Message: hashErr[0].Message}}, hashIndex) {
+		t.Error("An error that is not a duplicate key is taken for one")
+	}
+}
+
+func Test_boltStore(t *testing.T) {
+	store, err := newBoltStore(filepath.Join(t.TempDir(), "paragliding.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(context.Background())
+
+	testTrackStore(t, store)
+	testWebhookStore(t, store)
+	testCounterStore(t, store)
+	testFileStore(t, store)
+	testJobStore(t, store)
+	testTaskStore(t, store)
+}
+
+func Test_boltStore_MigrateIDs(t *testing.T) {
+	store, err := newBoltStore(filepath.Join(t.TempDir(), "paragliding.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(context.Background())
+
+	// Two tracks that got the same random ID before the migration
+	for _, val := range []tracks{tracks{UniqueID: "57", Pilot: "First"}, tracks{UniqueID: "57", Pilot: "Second"}} {
+		if _, err := store.insertUnique(trackBucket, val, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testMigrateIDs(t, store)
+}
+
+func Test_boltStore_Lookups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "paragliding.db")
+	store, err := newBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	store.AddTrack(ctx, tracks{UniqueID: "1000", URL: "http://a.igc", ContentHash: "a"})
+	store.AddWebhook(ctx, Webhook{WebhookID: "1000", WebhookURL: "http://hook"})
+	store.AddTask(ctx, compTask{TaskID: "1000"})
+
+	// A file written before the lookups existed
+	err = store.db.Update(func(tx *bolt.Tx) error { return tx.DeleteBucket(lookupBucket) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close(ctx)
+
+	store, err = newBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(ctx)
+
+	if track, err := store.GetTrackByURL(ctx, "http://a.igc"); err != nil || track.UniqueID != "1000" {
+		t.Errorf("Expected the track found by URL, received %v, %v", track, err)
+	}
+	if _, err := store.GetTrackByHash(ctx, "a"); err != nil {
+		t.Errorf("Expected the track found by hash, received %v", err)
+	}
+	if err := store.AddTrack(ctx, tracks{UniqueID: "1001", ContentHash: "a"}); err != errDuplicateContent {
+		t.Errorf("Expected errDuplicateContent, received %v", err)
+	}
+	if err := store.AddTrack(ctx, tracks{UniqueID: "1000"}); err != errDuplicateID {
+		t.Errorf("Expected errDuplicateID, received %v", err)
+	}
+	if _, err := store.GetWebhookByURL(ctx, "http://hook"); err != nil {
+		t.Errorf("Expected the webhook found by URL, received %v", err)
+	}
+
+	// A deleted document frees its unique values
+	if err := store.DeleteTask(ctx, "1000"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddTask(ctx, compTask{TaskID: "1000"}); err != nil {
+		t.Errorf("Expected the ID of the deleted task to be free, received %v", err)
+	}
+	store.DeleteAllTracks(ctx)
+	if err := store.AddTrack(ctx, tracks{UniqueID: "1000", ContentHash: "a"}); err != nil {
+		t.Errorf("Expected the ID and hash of the deleted tracks to be free, received %v", err)
+	}
+}
+
+func Test_boltStore_EachTrack(t *testing.T) {
+	store, err := newBoltStore(filepath.Join(t.TempDir(), "paragliding.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(context.Background())
+
+	// More than two batches, the last one not full
+	n := 2*eachTrackBatch + 10
+	for i := 0; i < n; i++ {
+		if err := store.AddTrack(context.Background(), tracks{UniqueID: strconv.Itoa(firstID + i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The store can be written to while iterating
+	count := 0
+	err = store.EachTrack(context.Background(), func(track tracks) error {
+		if track.UniqueID != strconv.Itoa(firstID+count) {
+			return fmt.Errorf("expected track %d, received %s", firstID+count, track.UniqueID)
+		}
+		count++
+		return store.PutFile(context.Background(), trackPoints, track.UniqueID, []byte("{}"))
+	})
+	if err != nil || count != n {
+		t.Errorf("Expected %d tracks in order, received %d, %v", n, count, err)
+	}
+}
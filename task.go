@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// *** COMPETITION TASKS *** //
+
+// Types of the turnpoints of a task, a turnpoint without type is only to be reached
+const (
+	tpTakeoff = "takeoff"
+	tpSSS     = "sss" // start of the speed section
+	tpESS     = "ess" // end of the speed section
+	tpGoal    = "goal"
+)
+
+// How the SSS cylinder is crossed to start
+const (
+	startExit  = "exit"
+	startEnter = "enter"
+)
+
+// turnpoint is a cylinder of the task
+type turnpoint struct {
+	Name   string  `json:"name"`
+	Lat    float64 `json:"lat"`
+	Lon    float64 `json:"lon"`
+	Radius float64 `json:"radius"`         // in meters
+	Type   string  `json:"type,omitempty"` // takeoff, sss, ess, goal or empty
+}
+
+// compTask is a competition task: turnpoints reached in order, with a timed speed section
+// It is also the task day, with the tracks of the pilots who flew it
+type compTask struct {
+	TaskID     string      `json:"id"`
+	Name       string      `json:"name"`
+	StartOpen  time.Time   `json:"start_open"` // starts before this time don't count, optional
+	StartType  string      `json:"start_type"` // exit (default) or enter the SSS cylinder
+	Turnpoints []turnpoint `json:"turnpoints"`
+	GAP        gapParams   `json:"gap"`    // parameters of the scoring of the day
+	TrackIDs   []string    `json:"tracks"` // the tracks scored in the day
+	Created    time.Time   `json:"created"`
+}
+
+// reachedTurnpoint tells if and when a turnpoint of the task was reached
+type reachedTurnpoint struct {
+	Name    string     `json:"name"`
+	Type    string     `json:"type,omitempty"`
+	Reached bool       `json:"reached"`
+	Time    *time.Time `json:"time,omitempty"`
+}
+
+// taskResult is the validation of a track against a task
+type taskResult struct {
+	TaskID           string             `json:"task_id"`
+	TrackID          string             `json:"track_id"`
+	Turnpoints       []reachedTurnpoint `json:"turnpoints"`
+	StartTime        *time.Time         `json:"start_time,omitempty"`
+	ESSTime          *time.Time         `json:"ess_time,omitempty"`
+	SpeedSectionTime int64              `json:"speed_section_time,omitempty"` // from the start to the ESS, in seconds
+	Goal             bool               `json:"goal"`
+	Distance         float64            `json:"distance"` // in km along the task, the whole task in goal
+}
+
+// turnpointIndex returns the position of the first turnpoint of the given type, or -1
+func (t compTask) turnpointIndex(kind string) int {
+	for key, val := range t.Turnpoints {
+		if val.Type == kind {
+			return key
+		}
+	}
+	return -1
+}
+
+// essIndex returns the position of the ESS, the goal if the task has none
+func (t compTask) essIndex() int {
+	if ess := t.turnpointIndex(tpESS); ess >= 0 {
+		return ess
+	}
+	return len(t.Turnpoints) - 1
+}
+
+// checkTask validates a new task and fills in the defaults:
+// an exit start, and the last turnpoint as goal
+func checkTask(t *compTask) error {
+	if t.StartType == "" {
+		t.StartType = startExit
+	}
+	if t.StartType != startExit && t.StartType != startEnter {
+		return fmt.Errorf("start_type must be %s or %s", startExit, startEnter)
+	}
+
+	last := len(t.Turnpoints) - 1
+	if last < 1 {
+		return fmt.Errorf("a task needs at least 2 turnpoints")
+	}
+	if t.Turnpoints[last].Type == "" {
+		t.Turnpoints[last].Type = tpGoal
+	}
+
+	count := map[string]int{}
+	for key, val := range t.Turnpoints {
+		if val.Radius <= 0 {
+			return fmt.Errorf("turnpoint %d: the radius must be positive", key+1)
+		}
+		if val.Lat < -90 || val.Lat > 90 || val.Lon < -180 || val.Lon > 180 {
+			return fmt.Errorf("turnpoint %d: invalid coordinates", key+1)
+		}
+		switch val.Type {
+		case "", tpSSS, tpESS:
+		case tpTakeoff:
+			if key != 0 {
+				return fmt.Errorf("turnpoint %d: only the first turnpoint can be the takeoff", key+1)
+			}
+		case tpGoal:
+			if key != last {
+				return fmt.Errorf("turnpoint %d: only the last turnpoint can be the goal", key+1)
+			}
+		default:
+			return fmt.Errorf("turnpoint %d: unknown type %q", key+1, val.Type)
+		}
+		count[val.Type]++
+	}
+
+	if count[tpSSS] != 1 {
+		return fmt.Errorf("a task needs exactly one sss turnpoint")
+	}
+	if count[tpESS] > 1 {
+		return fmt.Errorf("a task has at most one ess turnpoint")
+	}
+	if t.turnpointIndex(tpSSS) == last {
+		return fmt.Errorf("the sss can't be the goal")
+	}
+	if ess := t.turnpointIndex(tpESS); ess >= 0 && ess < t.turnpointIndex(tpSSS) {
+		return fmt.Errorf("the ess must come after the sss")
+	}
+	return checkGAP(t.GAP)
+}
+
+// tpFix returns the center of the turnpoint as a fix, to measure distances
+func tpFix(tp turnpoint) fix {
+	return fix{Lat: tp.Lat, Lon: tp.Lon}
+}
+
+// insideTurnpoint tells if the fix is in the cylinder of the turnpoint
+func insideTurnpoint(tp turnpoint, val fix) bool {
+	return fixDistance(val, tpFix(tp))*1000 <= tp.Radius
+}
+
+// routeDistance returns the distance in km through the centers of the turnpoints from i to j
+func (t compTask) routeDistance(i int, j int) float64 {
+	total := 0.0
+	for k := i + 1; k <= j; k++ {
+		total += fixDistance(tpFix(t.Turnpoints[k-1]), tpFix(t.Turnpoints[k]))
+	}
+	return total
+}
+
+// distanceLeft returns the distance in km from the fix to the center of the turnpoint last,
+// through the turnpoints from next on, or 0 if next is after last
+func (t compTask) distanceLeft(val fix, next int, last int) float64 {
+	if next > last {
+		return 0
+	}
+	return fixDistance(val, tpFix(t.Turnpoints[next])) + t.routeDistance(next, last)
+}
+
+// validateTask follows the fixes in flight through the turnpoints of the task, in order
+// The start is the last crossing of the SSS cylinder, after the start is open,
+// before the turnpoint after it is reached. Without ESS, the goal ends the speed section
+// The distance flown is the task distance less the shortest distance left to goal
+func validateTask(t compTask, fixes []fix) taskResult {
+	result := taskResult{TaskID: t.TaskID, Turnpoints: []reachedTurnpoint{}}
+
+	sss, ess, last := t.turnpointIndex(tpSSS), t.essIndex(), len(t.Turnpoints)-1
+	total := t.routeDistance(0, last)
+	bestLeft := total
+
+	times := make([]time.Time, len(t.Turnpoints))
+	next := 0
+	var previous *fix
+	for key := range fixes {
+		val := fixes[key]
+		if val.Ground {
+			previous = nil
+			continue
+		}
+
+		if previous != nil && (next == sss || next == sss+1) {
+			was, is := insideTurnpoint(t.Turnpoints[sss], *previous), insideTurnpoint(t.Turnpoints[sss], val)
+			crossed := was && !is
+			if t.StartType == startEnter {
+				crossed = !was && is
+			}
+			if crossed && !val.Time.Before(t.StartOpen) {
+				times[sss] = val.Time
+				next = sss + 1
+			}
+		}
+
+		for next < len(t.Turnpoints) && next != sss && insideTurnpoint(t.Turnpoints[next], val) {
+			times[next] = val.Time
+			next++
+		}
+		bestLeft = math.Min(bestLeft, t.distanceLeft(val, next, last))
+		previous = &fixes[key]
+	}
+
+	for key, val := range t.Turnpoints {
+		reached := reachedTurnpoint{Name: val.Name, Type: val.Type, Reached: key < next}
+		if reached.Reached {
+			reached.Time = &times[key]
+		}
+		result.Turnpoints = append(result.Turnpoints, reached)
+	}
+
+	if next > sss {
+		result.StartTime = &times[sss]
+	}
+	if next > ess {
+		result.ESSTime = &times[ess]
+		result.SpeedSectionTime = int64(times[ess].Sub(times[sss]) / time.Second)
+	}
+	result.Goal = next == len(t.Turnpoints)
+	result.Distance = total - bestLeft
+	return result
+}
+
+// requestTask returns the task with the given ID, or sends 404 to the user
+func (s *server) requestTask(w http.ResponseWriter, r *http.Request, id string) (compTask, bool) {
+	resTask, err := s.tasks.GetTask(r.Context(), id)
+	if err == errNotFound {
+		http.Error(w, "404 - The task with that id doesn't exist", http.StatusNotFound)
+		return compTask{}, false
+	}
+	if err != nil {
+		serverError(w, err)
+		return compTask{}, false
+	}
+	return resTask, true
+}
+
+// Handles path: /api/task
+// GET returns the IDs of every task, POST creates a task and returns its ID
+func (s *server) handlerTask(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+		allTasks, err := s.tasks.GetAllTasks(r.Context())
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
+		ids := []string{}
+		for _, val := range allTasks {
+			ids = append(ids, val.TaskID)
+		}
+		json.NewEncoder(w).Encode(ids)
+
+	case http.MethodPost:
+		// The GAP parameters missing from the request keep their default value
+		newTask := compTask{GAP: defaultGAP()}
+		if err := json.NewDecoder(r.Body).Decode(&newTask); err != nil {
+			http.Error(w, "400 - Bad Request, invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkTask(&newTask); err != nil {
+			http.Error(w, "400 - Bad Request, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		if newTask.TrackIDs, err = s.checkTrackIDs(r.Context(), newTask.TrackIDs); err != nil {
+			http.Error(w, "400 - Bad Request, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		newTask.TaskID, err = nextID(r.Context(), s.counters, "tasks")
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		newTask.Created = time.Now()
+
+		if err = s.tasks.AddTask(r.Context(), newTask); err != nil {
+			serverError(w, err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"id": newTask.TaskID})
+
+	default:
+		http.Error(w, "501 - Method not implemented", http.StatusNotImplemented)
+	}
+}
+
+// Handles path: /api/task/<id>
+// GET returns the task, DELETE removes it and returns it
+func (s *server) handlerTaskID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		http.Error(w, "501 - Method not implemented", http.StatusNotImplemented)
+		return
+	}
+
+	resTask, ok := s.requestTask(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := s.tasks.DeleteTask(r.Context(), resTask.TaskID); err != nil {
+			serverError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resTask)
+}
+
+// Handles path: GET /api/track/<id>/task/<task_id>
+// Returns the validation of the track against the task
+func (s *server) handlerTaskValidation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "501 - Method not implemented", http.StatusNotImplemented)
+		return
+	}
+
+	resTask, ok := s.requestTask(w, r, mux.Vars(r)["task_id"])
+	if !ok {
+		return
+	}
+
+	track, fixes, ok := s.requestFixes(w, r)
+	if !ok {
+		return
+	}
+
+	result := validateTask(resTask, fixes)
+	result.TrackID = track.UniqueID
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// triangleTask returns a task around the triangle of routeFixes, started by leaving a 2 km cylinder
+// on takeoff, with the ESS at the last corner and the goal back on takeoff
+func triangleTask() compTask {
+	return compTask{
+		TaskID: "1000",
+		GAP:    defaultGAP(),
+		Turnpoints: []turnpoint{
+			{Name: "Takeoff", Lat: pointA[0], Lon: pointA[1], Radius: 400, Type: tpTakeoff},
+			{Name: "Start", Lat: pointA[0], Lon: pointA[1], Radius: 2000, Type: tpSSS},
+			{Name: "B", Lat: pointB[0], Lon: pointB[1], Radius: 1000},
+			{Name: "C", Lat: pointC[0], Lon: pointC[1], Radius: 1000, Type: tpESS},
+			{Name: "Goal", Lat: pointA[0], Lon: pointA[1], Radius: 400, Type: tpGoal},
+		},
+	}
+}
+
+func Test_validateTask(t *testing.T) {
+	fixes := routeFixes([][2]float64{pointA, pointB, pointC, pointA})
+	takeoff := fixes[0].Time
+
+	result := validateTask(triangleTask(), fixes)
+	assert.True(t, result.Goal)
+	assert.Len(t, result.Turnpoints, 5)
+	for _, val := range result.Turnpoints {
+		assert.True(t, val.Reached, val.Name)
+	}
+
+	// 2 km out of 60 at 30 km/h: the start 4 minutes after takeoff, the ESS 2 minutes before the corner C
+	if assert.NotNil(t, result.StartTime) && assert.NotNil(t, result.ESSTime) {
+		assert.InDelta(t, 4*time.Minute, result.StartTime.Sub(takeoff), float64(10*time.Second))
+		assert.InDelta(t, 78*time.Minute, result.ESSTime.Sub(takeoff), float64(10*time.Second))
+		assert.InDelta(t, 74*60, result.SpeedSectionTime, 20)
+	}
+	assert.InDelta(t, 60, result.Distance, 0.5)
+}
+
+func Test_validateTask_NoGoal(t *testing.T) {
+	// Landing at the corner C
+	fixes := routeFixes([][2]float64{pointA, pointB, pointC})
+
+	result := validateTask(triangleTask(), fixes)
+	assert.False(t, result.Goal)
+	assert.NotNil(t, result.ESSTime)
+	assert.True(t, result.Turnpoints[3].Reached)
+	assert.False(t, result.Turnpoints[4].Reached)
+	assert.Nil(t, result.Turnpoints[4].Time)
+	// 20 km left from the corner C back to goal
+	assert.InDelta(t, 40, result.Distance, 1)
+}
+
+func Test_validateTask_StartOpen(t *testing.T) {
+	fixes := routeFixes([][2]float64{pointA, pointB, pointC, pointA})
+
+	// The start opens after the pilot left the start cylinder, and they never came back to it
+	task := triangleTask()
+	task.StartOpen = fixes[0].Time.Add(10 * time.Minute)
+
+	result := validateTask(task, fixes)
+	assert.False(t, result.Goal)
+	assert.Nil(t, result.StartTime)
+	assert.True(t, result.Turnpoints[0].Reached)
+	assert.False(t, result.Turnpoints[1].Reached)
+	assert.False(t, result.Turnpoints[2].Reached)
+}
+
+func Test_checkTask(t *testing.T) {
+	valid := triangleTask()
+	assert.Nil(t, checkTask(&valid))
+	assert.Equal(t, startExit, valid.StartType)
+
+	// The last turnpoint is the goal by default
+	noGoal := triangleTask()
+	noGoal.Turnpoints[4].Type = ""
+	assert.Nil(t, checkTask(&noGoal))
+	assert.Equal(t, tpGoal, noGoal.Turnpoints[4].Type)
+
+	invalid := map[string]func(*compTask){
+		"no sss":          func(t *compTask) { t.Turnpoints[1].Type = "" },
+		"two sss":         func(t *compTask) { t.Turnpoints[2].Type = tpSSS },
+		"ess before sss":  func(t *compTask) { t.Turnpoints[1].Type, t.Turnpoints[3].Type = tpESS, tpSSS },
+		"goal not last":   func(t *compTask) { t.Turnpoints[2].Type = tpGoal },
+		"no radius":       func(t *compTask) { t.Turnpoints[2].Radius = 0 },
+		"bad latitude":    func(t *compTask) { t.Turnpoints[2].Lat = 91 },
+		"unknown type":    func(t *compTask) { t.Turnpoints[2].Type = "cylinder" },
+		"bad start type":  func(t *compTask) { t.StartType = "line" },
+		"one turnpoint":   func(t *compTask) { t.Turnpoints = t.Turnpoints[1:2] },
+		"takeoff not one": func(t *compTask) { t.Turnpoints[2].Type = tpTakeoff },
+	}
+	for name, change := range invalid {
+		task := triangleTask()
+		change(&task)
+		assert.NotNil(t, checkTask(&task), name)
+	}
+}
+
+func Test_handlerTask(t *testing.T) {
+
+	s := newTestServer()
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+
+	// From the first to the last fix of the sample flight, about 5.6 km
+	body := `{"name": "Club task", "turnpoints": [
+		{"name": "Start", "lat": 45.88333, "lon": 6.25, "radius": 500, "type": "sss"},
+		{"name": "Goal", "lat": 45.925, "lon": 6.29167, "radius": 500}
+	]}`
+	resp, err := http.Post(ts.URL+"/paragliding/api/task", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error executing the POST request, %s", err)
+	}
+	assert.Equal(t, 200, resp.StatusCode)
+	var created map[string]string
+	json.NewDecoder(resp.Body).Decode(&created)
+	taskID := created["id"]
+	assert.NotEmpty(t, taskID)
+
+	resp, _ = http.Post(ts.URL+"/paragliding/api/task", "application/json", strings.NewReader(`{"turnpoints": []}`))
+	assert.Equal(t, 400, resp.StatusCode)
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/task")
+	var ids []string
+	json.NewDecoder(resp.Body).Decode(&ids)
+	assert.Equal(t, []string{taskID}, ids)
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/task/" + taskID)
+	var resTask compTask
+	json.NewDecoder(resp.Body).Decode(&resTask)
+	assert.Equal(t, "Club task", resTask.Name)
+	assert.Equal(t, tpGoal, resTask.Turnpoints[1].Type)
+
+	trackID := postTrackFile(t, ts, "sample.igc")
+
+	// The pilot leaves the start cylinder at the second fix and reaches goal at the last one
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/" + trackID + "/task/" + taskID)
+	assert.Equal(t, 200, resp.StatusCode)
+	var result taskResult
+	json.NewDecoder(resp.Body).Decode(&result)
+	assert.Equal(t, trackID, result.TrackID)
+	assert.True(t, result.Goal)
+	assert.Equal(t, int64(240), result.SpeedSectionTime)
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/" + trackID + "/task/999999")
+	assert.Equal(t, 404, resp.StatusCode)
+
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/paragliding/api/task/"+taskID, nil)
+	resp, _ = http.DefaultClient.Do(req)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/task/" + taskID)
+	assert.Equal(t, 404, resp.StatusCode)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+)
+
+// *** THERMAL DETECTION *** //
+
+const (
+	// circlingWindow is the time over which the turn rate is averaged
+	circlingWindow = 20 * time.Second
+	// circlingTurnRate is the average turn rate, in degrees per second, above which the glider is circling
+	// A paraglider turns a full circle in 20 to 40 seconds when thermalling, about 9 to 18 degrees per second
+	circlingTurnRate = 6.0
+	// minThermalTurn is the total turn, in degrees, of the shortest thermal: one full circle
+	minThermalTurn = 360.0
+)
+
+// thermal is a circling segment of a flight
+// Altitudes are in meters and the climb in m/s
+type thermal struct {
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	Duration      int64     `json:"duration"` // in seconds
+	EntryAltitude int64     `json:"entry_altitude"`
+	ExitAltitude  int64     `json:"exit_altitude"`
+	Climb         float64   `json:"climb"`     // average climb rate
+	Direction     string    `json:"direction"` // left or right
+	Turns         float64   `json:"turns"`     // number of full circles
+	Lat           float64   `json:"lat"`       // center of the thermal
+	Lon           float64   `json:"lon"`
+}
+
+// bearing returns the heading from a to b in degrees, from 0 (north) to 360, clockwise
+func bearing(a fix, b fix) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLon := (b.Lon - a.Lon) * math.Pi / 180
+
+	y := math.Sin(dLon) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLon)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
+
+// turn returns the heading change from h1 to h2, between -180 (left) and 180 (right)
+func turn(h1 float64, h2 float64) float64 {
+	return math.Mod(h2-h1+540, 360) - 180
+}
+
+// detectThermals returns the circling segments of the fixes in flight, in order
+func detectThermals(fixes []fix) []thermal {
+	n := len(fixes)
+	if n < 3 {
+		return []thermal{}
+	}
+
+	// turns[i] is the heading change at the fix i, from the leg before it to the leg after it
+	turns := make([]float64, n)
+	heading, known := 0.0, false
+	for i := 0; i < n-1; i++ {
+		if fixes[i].Ground || fixes[i+1].Ground || (fixes[i].Lat == fixes[i+1].Lat && fixes[i].Lon == fixes[i+1].Lon) {
+			continue
+		}
+		next := bearing(fixes[i], fixes[i+1])
+		if known {
+			turns[i] = turn(heading, next)
+		}
+		heading, known = next, true
+	}
+
+	// The glider circles at the fix i if the average turn rate around it is high enough
+	circling := make([]bool, n)
+	lo, hi, sum := 0, 0, 0.0
+	for i := 0; i < n; i++ {
+		for hi < n && fixes[hi].Time.Sub(fixes[i].Time) <= circlingWindow/2 {
+			sum += turns[hi]
+			hi++
+		}
+		for fixes[i].Time.Sub(fixes[lo].Time) > circlingWindow/2 {
+			sum -= turns[lo]
+			lo++
+		}
+		seconds := fixes[hi-1].Time.Sub(fixes[lo].Time).Seconds()
+		circling[i] = !fixes[i].Ground && seconds > 0 && math.Abs(sum)/seconds >= circlingTurnRate
+	}
+
+	thermals := []thermal{}
+	for start := 0; start < n; {
+		if !circling[start] {
+			start++
+			continue
+		}
+		end := start
+		for end+1 < n && circling[end+1] {
+			end++
+		}
+		next := end + 1
+
+		// The average turn rate spreads the thermal over the straight fixes around it, they are left out
+		straight := func(i int, j int) bool {
+			return math.Abs(turns[i]) < circlingTurnRate*math.Abs(fixes[j].Time.Sub(fixes[i].Time).Seconds())
+		}
+		for start < end && straight(start, start+1) {
+			start++
+		}
+		for end > start && straight(end, end-1) {
+			end--
+		}
+
+		if th, ok := newThermal(fixes[start:end+1], turns[start:end+1]); ok {
+			thermals = append(thermals, th)
+		}
+		start = next
+	}
+	return thermals
+}
+
+// newThermal returns the thermal made of the fixes, if the glider turned at least a full circle
+func newThermal(fixes []fix, turns []float64) (thermal, bool) {
+	total := 0.0
+	for _, val := range turns {
+		total += val
+	}
+	if math.Abs(total) < minThermalTurn {
+		return thermal{}, false
+	}
+
+	useGNSS := fixes[0].GNSSAltitude != 0
+	first, last := fixes[0], fixes[len(fixes)-1]
+
+	th := thermal{
+		Start:         first.Time,
+		End:           last.Time,
+		Duration:      int64(last.Time.Sub(first.Time) / time.Second),
+		EntryAltitude: fixAltitude(first, useGNSS),
+		ExitAltitude:  fixAltitude(last, useGNSS),
+		Direction:     "right",
+		Turns:         math.Abs(total) / 360,
+	}
+	if total < 0 {
+		th.Direction = "left"
+	}
+	if th.Duration > 0 {
+		th.Climb = float64(th.ExitAltitude-th.EntryAltitude) / float64(th.Duration)
+	}
+	for _, val := range fixes {
+		th.Lat += val.Lat / float64(len(fixes))
+		th.Lon += val.Lon / float64(len(fixes))
+	}
+	return th, true
+}
+
+// thermalTotals returns the percentage of the airtime spent circling,
+// and the average climb rate over every thermal
+func thermalTotals(thermals []thermal, airtime int64) (float64, float64) {
+	var circling, gain int64
+	for _, val := range thermals {
+		circling += val.Duration
+		gain += val.ExitAltitude - val.EntryAltitude
+	}
+
+	percent, climb := 0.0, 0.0
+	if airtime > 0 {
+		percent = float64(circling) / float64(airtime) * 100
+	}
+	if circling > 0 {
+		climb = float64(gain) / float64(circling)
+	}
+	return percent, climb
+}
+
+// Handles path: GET /api/track/<id>/thermals
+// Returns the thermals of the track, in order
+func (s *server) handlerThermals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "501 - Method not implemented", http.StatusNotImplemented)
+		return
+	}
+
+	_, fixes, ok := s.requestFixes(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detectThermals(fixes))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// circlingFixes returns a glide, a thermal turning right and climbing at 2 m/s, and another glide
+// with a fix every 2 seconds
+func circlingFixes() []fix {
+	fixes := []fix{}
+	t := time.Date(2018, 7, 2, 12, 0, 0, 0, time.UTC)
+	lat, lon, alt := 45.0, 6.0, 2000.0
+
+	add := func() {
+		fixes = append(fixes, fix{Time: t, Lat: lat, Lon: lon, PressureAltitude: int64(alt), GNSSAltitude: int64(alt)})
+		t = t.Add(2 * time.Second)
+	}
+
+	// Gliding north at 30 km/h, sinking at 1 m/s
+	glide := func() {
+		for i := 0; i < 60; i++ {
+			add()
+			lat += 30.0 / 1800 / 111
+			alt -= 2
+		}
+	}
+
+	glide()
+
+	// A circle of 40 m every 24 seconds, clockwise seen from above
+	centerLat, centerLon := lat-40.0/111000, lon
+	for i := 0; i < 90; i++ {
+		angle := float64(i) * 2 / 24 * 2 * math.Pi
+		lat = centerLat + 40.0/111000*math.Cos(angle)
+		lon = centerLon + 40.0/111000/math.Cos(centerLat*math.Pi/180)*math.Sin(angle)
+		add()
+		alt += 4
+	}
+
+	glide()
+	return fixes
+}
+
+func Test_detectThermals(t *testing.T) {
+	fixes := circlingFixes()
+
+	thermals := detectThermals(fixes)
+	if !assert.Len(t, thermals, 1) {
+		return
+	}
+
+	th := thermals[0]
+	assert.Equal(t, "right", th.Direction)
+	assert.InDelta(t, 2.0, th.Climb, 0.2)
+	assert.InDelta(t, 180, th.Duration, 20)
+	assert.InDelta(t, 7.5, th.Turns, 1)
+	assert.InDelta(t, 45.0, th.Lat, 0.01)
+
+	stats := computeStats(fixes, 10*time.Second)
+	assert.InDelta(t, 180.0/420*100, stats.CirclingPercent, 5)
+	assert.InDelta(t, 2.0, stats.AvgThermalClimb, 0.2)
+}
+
+func Test_detectThermals_Glide(t *testing.T) {
+	fixes := simulatedFixes(time.Now(), []leg{{10, 30}})
+	assert.Empty(t, detectThermals(fixes))
+}
+
+func Test_handlerThermals(t *testing.T) {
+
+	s := newTestServer()
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+
+	trackID := postTrackFile(t, ts, "sample.igc")
+
+	// The sample flight goes straight
+	resp, _ := http.Get(ts.URL + "/paragliding/api/track/" + trackID + "/thermals")
+	assert.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "[]\n", string(body))
+
+	resp, _ = http.Get(ts.URL + "/paragliding/api/track/999999/thermals")
+	assert.Equal(t, 404, resp.StatusCode)
+}
@@ -75,10 +75,7 @@ func oldestNewerTimestamp(inputTS string, resultTracks []tracks) time.Time {
 	return ts
 }
 
-func tickerTimestamps(inputTS string) Timestamps {
-	conn := mongoConnect()
-	resultTracks := getAllTracks(conn)
-
+func tickerTimestamps(inputTS string, resultTracks []tracks) Timestamps {
 	timestamps := Timestamps{}
 
 	timestamps.latestTimestamp = latestTimestamp(resultTracks)
@@ -88,11 +85,37 @@ func tickerTimestamps(inputTS string) Timestamps {
 	return timestamps
 }
 
-func handlerTickerLatest(w http.ResponseWriter, r *http.Request) {
+// Return track names
+// And also t_stop track
+func returnTracks(n int, resultTracks []tracks) (string, time.Time) {
+	var response string
+	var tStop time.Time
+
+	for key, val := range resultTracks { // Go through the slice
+		response += `"` + val.UniqueID + `",`
+		if key == n-1 || key == len(resultTracks)-1 {
+			tStop = val.TimeRecorded
+			break
+		}
+	}
+
+	// Get rid of that last `,` of JSON will freak out
+	response = strings.TrimRight(response, ",")
+
+	return response, tStop
+}
+
+func (s *server) handlerTickerLatest(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == http.MethodGet { // The request has to be of GET type
 
-		timestamps := tickerTimestamps("")
+		resultTracks, err := s.tracks.GetAllTracks(r.Context())
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
+		timestamps := tickerTimestamps("", resultTracks)
 		latestTimestamp := timestamps.latestTimestamp
 
 		if latestTimestamp.IsZero() { // If you dont assign a time to a time.Time variable, it's value is 0 date. We can check with IsZero() function
@@ -106,15 +129,21 @@ func handlerTickerLatest(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func handlerTicker(w http.ResponseWriter, r *http.Request) {
+func (s *server) handlerTicker(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == http.MethodGet { // The request has to be of GET type
 
 		processStart := time.Now() // Track when the process started
 
+		resultTracks, err := s.tracks.GetAllTracks(r.Context())
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
 		w.Header().Set("Content-Type", "application/json") // Set response content-type to JSON
 
-		timestamps := tickerTimestamps("")
+		timestamps := tickerTimestamps("", resultTracks)
 
 		oldestTS := timestamps.oldestTimestamp
 		latestTS := timestamps.latestTimestamp
@@ -137,15 +166,14 @@ func handlerTicker(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// returnTracks returns the last element and the n number of tracks
-		trackArray, tStop := returnTracks(5)
+		trackArray, tStop := returnTracks(s.cfg.PageSize, resultTracks)
 
 		// t_stop SHOULD BE ADDED HERE
 		response += `"t_stop": "` + tStop.Format("02.01.2006 15:04:05.000") + `",`
 
 		response += `"tracks":` + `[`
 
-		// THAT 5 SHOULD BE ABLE TO CHANGE DYNAMICALLY
-		response += trackArray // Maximum of 5 tracks
+		response += trackArray // Maximum of PageSize tracks
 
 		response += `],`
 		response += `"processing":` + `"` + strconv.FormatFloat(float64(time.Since(processStart))/float64(time.Millisecond), 'f', 2, 64) + `ms"`
@@ -156,7 +184,7 @@ func handlerTicker(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func handlerTickerTimestamp(w http.ResponseWriter, r *http.Request) {
+func (s *server) handlerTickerTimestamp(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == http.MethodGet { // The request has to be of GET type
 
@@ -172,7 +200,13 @@ func handlerTickerTimestamp(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		timestamps := tickerTimestamps(timestamp)
+		resultTracks, err := s.tracks.GetAllTracks(r.Context())
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
+		timestamps := tickerTimestamps(timestamp, resultTracks)
 
 		olderTS := timestamps.oldestNewerTimestamp
 		latestTS := timestamps.latestTimestamp
@@ -195,15 +229,14 @@ func handlerTickerTimestamp(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// returnTracks returns the last element and the n number of tracks
-		trackArray, tStop := returnTracks(5)
+		trackArray, tStop := returnTracks(s.cfg.PageSize, resultTracks)
 
 		// t_stop SHOULD BE ADDED HERE
 		response += `"t_stop": "` + tStop.Format("02.01.2006 15:04:05.000") + `",`
 
 		response += `"tracks":` + `[`
 
-		// THAT 5 SHOULD BE ABLE TO CHANGE DYNAMICALLY
-		response += trackArray // Maximum of 5 tracks
+		response += trackArray // Maximum of PageSize tracks
 
 		response += `],`
 
@@ -14,7 +14,7 @@ import (
 func Test_latestTimestamp(t *testing.T) {
 	igcTracks := []tracks{
 		tracks{TimeRecorded: time.Date(2018, 4, 25, 12, 32, 1, 0, time.UTC)},
-		tracks{TimeRecorded: time.Now()},
+		tracks{TimeRecorded: time.Date(2018, 10, 25, 12, 32, 1, 0, time.UTC)},
 		tracks{TimeRecorded: time.Date(2019, 4, 25, 12, 32, 1, 0, time.UTC)},
 	}
 
@@ -56,9 +56,8 @@ func Test_tickerTimestamps(t *testing.T) {
 		tracks{TimeRecorded: time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC)},
 	}
 
-	// No connection to the DB :(
-
-	tickerTS := tickerTimestamps("25.04.2018 12:34:30.314")
+	// No tracks in the DB
+	tickerTS := tickerTimestamps("25.04.2018 12:34:30.314", []tracks{})
 
 	if tickerTS.oldestTimestamp != igcTracks[0].TimeRecorded {
 		t.Error("Not the right timestamp")
@@ -73,7 +72,7 @@ func Test_tickerTimestamps(t *testing.T) {
 
 func Test_getAPITickerLatest(t *testing.T) {
 	// instantiate mock HTTP server (just for the purpose of testing
-	ts := httptest.NewServer(http.HandlerFunc(handlerTickerLatest))
+	ts := httptest.NewServer(http.HandlerFunc(newTestServer().handlerTickerLatest))
 	defer ts.Close()
 
 	//create a request to our mock HTTP server
@@ -115,7 +114,7 @@ func Test_getAPITickerLatest(t *testing.T) {
 
 func Test_getAPITicker(t *testing.T) {
 	// instantiate mock HTTP server (just for the purpose of testing
-	ts := httptest.NewServer(http.HandlerFunc(handlerTicker))
+	ts := httptest.NewServer(http.HandlerFunc(newTestServer().handlerTicker))
 	defer ts.Close()
 
 	//create a request to our mock HTTP server
@@ -157,7 +156,7 @@ func Test_getAPITicker(t *testing.T) {
 
 func Test_getAPITickerTimestamp(t *testing.T) {
 	// instantiate mock HTTP server (just for the purpose of testing
-	ts := httptest.NewServer(http.HandlerFunc(handlerTickerTimestamp))
+	ts := httptest.NewServer(http.HandlerFunc(newTestServer().handlerTickerTimestamp))
 	defer ts.Close()
 
 	//create a request to our mock HTTP server
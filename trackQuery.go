@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// *** TRACK LIST QUERIES *** //
+
+// maxTrackLimit is the biggest page of the track list
+const maxTrackLimit = 1000
+
+// trackField is a field of the tracks the list can be sorted on, or filtered on with min_ and max_ for the numbers
+type trackField struct {
+	bson   string               // path of the field in the Mongo documents
+	text   func(tracks) string  // the value of a text field
+	number func(tracks) float64 // or the value of a numeric field
+}
+
+// trackFields are the fields of the track list, by query parameter name
+// The statistics are named as in the JSON of flightStats
+var trackFields = map[string]trackField{
+	"pilot":     {bson: "pilot", text: func(t tracks) string { return t.Pilot }},
+	"glider":    {bson: "glider", text: func(t tracks) string { return t.Glider }},
+	"glider_id": {bson: "gliderid", text: func(t tracks) string { return t.GliderID }},
+	"date":      {bson: "hdate", text: func(t tracks) string { return t.Hdate }},
+	"length":    {bson: "tracklength", number: func(t tracks) float64 { return t.TrackLength }},
+
+	"airtime":               {bson: "stats.airtime", number: func(t tracks) float64 { return float64(t.Stats.Airtime) }},
+	"max_gnss_altitude":     {bson: "stats.maxgnssaltitude", number: func(t tracks) float64 { return float64(t.Stats.MaxGNSSAltitude) }},
+	"min_gnss_altitude":     {bson: "stats.mingnssaltitude", number: func(t tracks) float64 { return float64(t.Stats.MinGNSSAltitude) }},
+	"max_pressure_altitude": {bson: "stats.maxpressurealtitude", number: func(t tracks) float64 { return float64(t.Stats.MaxPressureAltitude) }},
+	"min_pressure_altitude": {bson: "stats.minpressurealtitude", number: func(t tracks) float64 { return float64(t.Stats.MinPressureAltitude) }},
+	"altitude_gain":         {bson: "stats.altitudegain", number: func(t tracks) float64 { return float64(t.Stats.AltitudeGain) }},
+	"max_climb":             {bson: "stats.maxclimb", number: func(t tracks) float64 { return t.Stats.MaxClimb }},
+	"max_sink":              {bson: "stats.maxsink", number: func(t tracks) float64 { return t.Stats.MaxSink }},
+	"avg_speed":             {bson: "stats.avgspeed", number: func(t tracks) float64 { return t.Stats.AvgSpeed }},
+	"max_speed":             {bson: "stats.maxspeed", number: func(t tracks) float64 { return t.Stats.MaxSpeed }},
+	"distance":              {bson: "stats.distance", number: func(t tracks) float64 { return t.Stats.Distance }},
+	"circling_percent":      {bson: "stats.circlingpercent", number: func(t tracks) float64 { return t.Stats.CirclingPercent }},
+	"avg_thermal_climb":     {bson: "stats.avgthermalclimb", number: func(t tracks) float64 { return t.Stats.AvgThermalClimb }},
+}
+
+// compare returns -1, 0 or 1 as the field of a is before, equal to or after the field of b
+func (f trackField) compare(a tracks, b tracks) int {
+	if f.text != nil {
+		return strings.Compare(f.text(a), f.text(b))
+	}
+	x, y := f.number(a), f.number(b)
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// trackBound is a min_ or max_ filter on a numeric field, both included
+type trackBound struct {
+	Field string
+	Max   bool
+	Value float64
+}
+
+// trackQuery selects a page of the track list
+// The tracks with the same sort value stay in the order they were added
+type trackQuery struct {
+	Pilot    string
+	Glider   string
+	GliderID string
+	// The IDs of the sites of the takeoff and the landing
+	TakeoffSite string
+	LandingSite string
+	// H_date is kept as "2018-07-02 00:00:00 +0000 UTC", so the order of the strings is the order of the dates
+	DateFrom   string // first H_date included
+	DateBefore string // first H_date left out
+	Bounds     []trackBound
+	BBox       *geoBox    // tracks with a point of their geometry in the box
+	Near       *geoCircle // or within the circle
+	GeoOn      string     // the geometry of the spatial filters, a name of geoFields
+	Sort       string     // a name of trackFields, empty for the order the tracks were added
+	Desc       bool
+	After      string // ID of the last track of the previous page
+	Limit      int    // 0 for every track
+}
+
+// parseTrackQuery reads the filters, the sort and the page of the track list from the query parameters
+func parseTrackQuery(query url.Values) (trackQuery, error) {
+	q := trackQuery{
+		Pilot:    query.Get("pilot"),
+		Glider:   query.Get("glider"),
+		GliderID: query.Get("glider_id"),
+		After:    query.Get("after"),
+
+		TakeoffSite: query.Get("takeoff_site"),
+		LandingSite: query.Get("landing_site"),
+	}
+
+	if val := query.Get("date_from"); val != "" {
+		day, err := time.Parse("2006-01-02", val)
+		if err != nil {
+			return q, fmt.Errorf("date_from must be a date like 2018-07-02")
+		}
+		q.DateFrom = day.Format("2006-01-02")
+	}
+	if val := query.Get("date_to"); val != "" {
+		day, err := time.Parse("2006-01-02", val)
+		if err != nil {
+			return q, fmt.Errorf("date_to must be a date like 2018-07-02")
+		}
+		q.DateBefore = day.AddDate(0, 0, 1).Format("2006-01-02")
+	}
+
+	// min_<field> and max_<field> for the numeric fields, sorted so the first error is always the same
+	keys := []string{}
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var name string
+		bound := trackBound{}
+		switch {
+		case strings.HasPrefix(key, "min_"):
+			name = strings.TrimPrefix(key, "min_")
+		case strings.HasPrefix(key, "max_"):
+			name, bound.Max = strings.TrimPrefix(key, "max_"), true
+		default:
+			continue
+		}
+
+		// max_speed is a statistic, its bounds are min_max_speed and max_max_speed
+		field, ok := trackFields[name]
+		if !ok || field.number == nil {
+			return q, fmt.Errorf("unknown filter %s", key)
+		}
+		value, err := strconv.ParseFloat(query.Get(key), 64)
+		if err != nil {
+			return q, fmt.Errorf("%s must be a number", key)
+		}
+		bound.Field, bound.Value = name, value
+		q.Bounds = append(q.Bounds, bound)
+	}
+
+	if err := parseGeoQuery(query, &q); err != nil {
+		return q, err
+	}
+
+	if val := query.Get("sort"); val != "" {
+		q.Desc = strings.HasPrefix(val, "-")
+		q.Sort = strings.TrimPrefix(val, "-")
+		if q.Sort == "id" {
+			q.Sort = ""
+		} else if _, ok := trackFields[q.Sort]; !ok {
+			return q, fmt.Errorf("unknown sort field %s", q.Sort)
+		}
+	}
+
+	if val := query.Get("limit"); val != "" {
+		limit, err := strconv.Atoi(val)
+		if err != nil || limit < 1 || limit > maxTrackLimit {
+			return q, fmt.Errorf("limit must be a number from 1 to %d", maxTrackLimit)
+		}
+		q.Limit = limit
+	}
+	return q, nil
+}
+
+// matches tells if the track passes the filters of the query
+func (q trackQuery) matches(t tracks) bool {
+	if (q.Pilot != "" && t.Pilot != q.Pilot) || (q.Glider != "" && t.Glider != q.Glider) ||
+		(q.GliderID != "" && t.GliderID != q.GliderID) || (q.TakeoffSite != "" && t.TakeoffSite != q.TakeoffSite) ||
+		(q.LandingSite != "" && t.LandingSite != q.LandingSite) {
+		return false
+	}
+	if (q.DateFrom != "" && t.Hdate < q.DateFrom) || (q.DateBefore != "" && t.Hdate >= q.DateBefore) {
+		return false
+	}
+	for _, val := range q.Bounds {
+		value := trackFields[val.Field].number(t)
+		if (val.Max && value > val.Value) || (!val.Max && value < val.Value) {
+			return false
+		}
+	}
+	return q.matchesGeo(t)
+}
+
+// selectTracks returns the page of the query from every track in the order they were added,
+// for the stores that scan all their tracks
+// It returns errNotFound if the track After doesn't exist
+func selectTracks(allTracks []tracks, q trackQuery) ([]tracks, error) {
+	sorted := make([]tracks, len(allTracks))
+	copy(sorted, allTracks)
+	if q.Sort != "" {
+		field := trackFields[q.Sort]
+		sort.SliceStable(sorted, func(i, j int) bool {
+			if q.Desc {
+				return field.compare(sorted[i], sorted[j]) > 0
+			}
+			return field.compare(sorted[i], sorted[j]) < 0
+		})
+	} else if q.Desc {
+		for i, j := 0, len(sorted)-1; i < j; i, j = i+1, j-1 {
+			sorted[i], sorted[j] = sorted[j], sorted[i]
+		}
+	}
+
+	start := 0
+	if q.After != "" {
+		start = -1
+		for key, val := range sorted {
+			if matchTrackID(val, q.After) {
+				start = key + 1
+				break
+			}
+		}
+		if start < 0 {
+			return nil, errNotFound
+		}
+	}
+
+	resTracks := []tracks{}
+	for _, val := range sorted[start:] {
+		if q.Limit > 0 && len(resTracks) == q.Limit {
+			break
+		}
+		if q.matches(val) {
+			resTracks = append(resTracks, val)
+		}
+	}
+	return resTracks, nil
+}
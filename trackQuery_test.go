@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func Test_parseTrackQuery(t *testing.T) {
+	query, _ := url.ParseQuery("pilot=Jane+Doe&date_from=2018-07-01&date_to=2018-07-02&min_length=10&max_max_speed=50&sort=-airtime&limit=20")
+	q, err := parseTrackQuery(query)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "Jane Doe", q.Pilot)
+	assert.Equal(t, "2018-07-01", q.DateFrom)
+	assert.Equal(t, "2018-07-03", q.DateBefore)
+	assert.Equal(t, []trackBound{{Field: "max_speed", Max: true, Value: 50}, {Field: "length", Value: 10}}, q.Bounds)
+	assert.Equal(t, "airtime", q.Sort)
+	assert.True(t, q.Desc)
+	assert.Equal(t, 20, q.Limit)
+
+	for _, val := range []string{"date_from=02-07-2018", "min_pilot=3", "max_speed=50", "min_length=x", "sort=url", "limit=0", "limit=5000"} {
+		query, _ := url.ParseQuery(val)
+		_, err := parseTrackQuery(query)
+		assert.NotNil(t, err, val)
+	}
+}
+
+func Test_handlerTrack_Query(t *testing.T) {
+
+	s := newTestServer()
+	ts := httptest.NewServer(newRouter(s))
+	defer ts.Close()
+
+	ctx := context.Background()
+	day := func(d int) string { return time.Date(2018, 7, d, 0, 0, 0, 0, time.UTC).String() }
+	for _, val := range []tracks{
+		{UniqueID: "1", Pilot: "Jane Doe", Hdate: day(1), TrackLength: 30, Stats: flightStats{Airtime: 3600}},
+		{UniqueID: "2", LegacyID: "5bc0d2a1", Pilot: "John Smith", Hdate: day(2), TrackLength: 80, Stats: flightStats{Airtime: 7200}},
+		{UniqueID: "3", Pilot: "Jane Doe", Hdate: day(3), TrackLength: 55, Stats: flightStats{Airtime: 3600}},
+		{UniqueID: "4", Pilot: "Jane Doe", Hdate: day(4), TrackLength: 10, Stats: flightStats{Airtime: 600}},
+	} {
+		val.TimeRecorded = time.Now()
+		if err := s.tracks.AddTrack(ctx, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get := func(query string) (*http.Response, string) {
+		resp, err := http.Get(ts.URL + "/paragliding/api/track" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	_, body := get("")
+	assert.Equal(t, idList("1", "2", "3", "4"), body)
+	_, body = get("?pilot=Jane+Doe&date_from=2018-07-02&date_to=2018-07-03")
+	assert.Equal(t, idList("3"), body)
+	_, body = get("?min_length=30&max_length=60")
+	assert.Equal(t, idList("1", "3"), body)
+	_, body = get("?sort=-id")
+	assert.Equal(t, idList("4", "3", "2", "1"), body)
+
+	// The tracks with the same airtime stay in the order they were added, on every page
+	resp, body := get("?sort=-airtime&limit=2")
+	assert.Equal(t, idList("2", "1"), body)
+	assert.Equal(t, `</paragliding/api/track?after=1&limit=2&sort=-airtime>; rel="next"`, resp.Header.Get("Link"))
+	resp, body = get("?after=1&limit=2&sort=-airtime")
+	assert.Equal(t, idList("3", "4"), body)
+	assert.Equal(t, "", resp.Header.Get("Link"))
+
+	// The page can start after the old ID of a track
+	_, body = get("?after=5bc0d2a1&limit=2&sort=-airtime")
+	assert.Equal(t, idList("1", "3"), body)
+
+	resp, _ = get("?after=99")
+	assert.Equal(t, 400, resp.StatusCode)
+	resp, _ = get("?sort=url")
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func Test_boltStore_FindTracks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "paragliding.db")
+	store, err := newBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tracks with many ties on every field, some with an old ID
+	ctx := context.Background()
+	pilots := []string{"Jane Doe", "John Smith", "Jane", ""}
+	allTracks := []tracks{}
+	for i := 0; i < 60; i++ {
+		track := tracks{
+			UniqueID:     counterID(int64(firstID + i)),
+			Pilot:        pilots[i%len(pilots)],
+			Glider:       "Glider " + strconv.Itoa(i%3),
+			Hdate:        time.Date(2018, 7, 1+i%5, 0, 0, 0, 0, time.UTC).String(),
+			TrackLength:  float64(i*37%11) - 3,
+			TakeoffSite:  []string{"", "1"}[i%2],
+			Stats:        flightStats{Airtime: int64(i * 7 % 4 * 600)},
+			TimeRecorded: time.Now(),
+		}
+		if i%10 == 0 {
+			track.LegacyID = "legacy" + strconv.Itoa(i)
+		}
+		if err := store.AddTrack(ctx, track); err != nil {
+			t.Fatal(err)
+		}
+		allTracks = append(allTracks, track)
+	}
+
+	// The indexes are built again for the files written before them
+	err = store.db.Update(func(tx *bolt.Tx) error { return tx.DeleteBucket(indexBucket) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close(ctx)
+	store, err = newBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(ctx)
+
+	queries := []trackQuery{
+		{},
+		{Desc: true},
+		{Pilot: "Jane"},
+		{Pilot: "Jane", Desc: true},
+		{TakeoffSite: "1", Glider: "Glider 2"},
+		{DateFrom: "2018-07-02", DateBefore: "2018-07-04"},
+		{DateFrom: "2018-07-03", Desc: true},
+		{Bounds: []trackBound{{Field: "length", Max: true, Value: 2}}},
+		{Bounds: []trackBound{{Field: "length", Value: -1}, {Field: "length", Max: true, Value: 5}}, Desc: true},
+		{Sort: "airtime"},
+		{Sort: "airtime", Desc: true},
+		{Sort: "length", Desc: true, Pilot: "Jane Doe"},
+		{Sort: "pilot"},
+		{Sort: "pilot", Desc: true},
+		{Sort: "date", Desc: true, DateBefore: "2018-07-03"},
+	}
+	for _, q := range queries {
+		want, _ := selectTracks(allTracks, q)
+
+		// Every page, each one after the last track of the page before
+		got := []tracks{}
+		page := q
+		page.Limit = 7
+		for {
+			tracks, err := store.FindTracks(ctx, page)
+			if !assert.Nil(t, err, "%+v", q) {
+				break
+			}
+			got = append(got, tracks...)
+			if len(tracks) < page.Limit {
+				break
+			}
+			page.After = tracks[len(tracks)-1].UniqueID
+		}
+		assert.Equal(t, trackIDs(want), trackIDs(got), "%+v", q)
+
+		// The page after an old ID
+		q.After, q.Limit = "legacy30", 5
+		want, _ = selectTracks(allTracks, q)
+		got, err = store.FindTracks(ctx, q)
+		assert.Nil(t, err, "%+v", q)
+		assert.Equal(t, trackIDs(want), trackIDs(got), "%+v", q)
+	}
+
+	_, err = store.FindTracks(ctx, trackQuery{After: "99"})
+	assert.Equal(t, errNotFound, err)
+
+	// The indexes are emptied with the tracks
+	store.DeleteAllTracks(ctx)
+	found, err := store.FindTracks(ctx, trackQuery{Sort: "airtime"})
+	assert.Nil(t, err)
+	assert.Empty(t, found)
+}
+
+// trackIDs returns the IDs of the tracks
+func trackIDs(found []tracks) []string {
+	ids := []string{}
+	for _, val := range found {
+		ids = append(ids, val.UniqueID)
+	}
+	return ids
+}
@@ -2,10 +2,10 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"log"
-	"math/rand"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -13,8 +13,6 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/mongodb/mongo-go-driver/bson"
-	"github.com/mongodb/mongo-go-driver/mongo"
 )
 
 // *** WEBHOOK API *** //
@@ -24,6 +22,7 @@ type Webhook struct {
 	WebhookURL      string `json:"webhookURL"`
 	MinTriggerValue int32  `json:"minTriggerValue"`
 	WebhookID       string `json:"webhook_id"`
+	LegacyID        string `json:"legacy_id,omitempty"` // old random ID, before the IDs were made unique
 }
 
 // WebhookContent keeps the webhook content to be send to Discord
@@ -38,7 +37,7 @@ type WebhookContent struct {
 // Returns the details about the registration. The response contains the ID of the created resource
 // The webhookURL is required parameter of the request.
 // MinTriggerValue indicates the frequency of updates - after how many new tracks the webhook should be called.
-func webhookNewTrack(w http.ResponseWriter, r *http.Request) {
+func (s *server) webhookNewTrack(w http.ResponseWriter, r *http.Request) {
 
 	// It only works with POST requests
 	if r.Method != "POST" {
@@ -57,57 +56,44 @@ func webhookNewTrack(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conn := mongoConnect()
-	db := conn.Database("igcfiles")   // igcFiles Database
-	coll := db.Collection("webhooks") // webhooks Collection
-
-	// Check if Webhook exists
-	cursor, err := coll.Find(context.Background(),
-		bson.NewDocument(bson.EC.String("webhookurl", webhook.WebhookURL)))
-	if err != nil {
-		log.Fatal(err)
+	// minTriggerValue is optional and defaults to 1 if omitted
+	if webhook.MinTriggerValue < 1 {
+		webhook.MinTriggerValue = 1
 	}
 
-	// 'Close' the cursor
-	defer cursor.Close(context.Background())
-
-	webhookInDB := Webhook{}
-
-	// Point the cursor at whatever is found
-	for cursor.Next(context.Background()) {
-		err = cursor.Decode(&webhookInDB)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		fmt.Fprintln(w, "The webhook you entered has been updated and has this ID: ", webhookInDB.WebhookID)
+	// Check if Webhook exists
+	webhookInDB, err := s.webhooks.GetWebhookByURL(r.Context(), webhook.WebhookURL)
+	if err == nil {
 
 		// If the webhook is already in the DB, then update the minTriggerValue because that one can be changed even after
 		// the webhook has been registered. But the ID doesn't change
-		_, err := coll.UpdateOne(context.Background(),
-			bson.NewDocument(
-				bson.EC.String("webhookurl", webhook.WebhookURL),
-			),
-			bson.NewDocument(
-				bson.EC.SubDocumentFromElements("$set", bson.EC.Int32("mintriggervalue", webhook.MinTriggerValue)),
-			),
-		)
+		err = s.webhooks.UpdateWebhook(r.Context(), webhook)
 		if err != nil {
-			log.Fatal(err)
+			serverError(w, err)
+			return
 		}
 
+		fmt.Fprintln(w, "The webhook you entered has been updated and has this ID: ", webhookInDB.WebhookID)
+
+		return
+	}
+	if err != errNotFound {
+		serverError(w, err)
 		return
 	}
 
 	// Create an ID for the new webhook
-	uniqueID := rand.Intn(1000)
-	webhook.WebhookID = strconv.Itoa(uniqueID)
+	webhook.WebhookID, err = nextID(r.Context(), s.counters, "webhooks")
+	if err != nil {
+		serverError(w, err)
+		return
+	}
 
 	// Insert the webhook if this one isn't in the Database
-	_, err = coll.InsertOne(context.Background(), webhook)
-
+	err = s.webhooks.AddWebhook(r.Context(), webhook)
 	if err != nil {
-		log.Fatal(err)
+		serverError(w, err)
+		return
 	}
 
 	// Encoding the ID of the track that was just added to DB
@@ -116,7 +102,7 @@ func webhookNewTrack(w http.ResponseWriter, r *http.Request) {
 }
 
 // Handles path: /api/webhook/new_track/<webhook_id>
-func webhookID(w http.ResponseWriter, r *http.Request) {
+func (s *server) webhookID(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 
@@ -126,37 +112,18 @@ func webhookID(w http.ResponseWriter, r *http.Request) {
 
 		urlVars := mux.Vars(r)
 
-		client := mongoConnect()
-
-		collection := client.Database("igcfiles").Collection("webhooks")
-
-		cursor, err := collection.Find(context.Background(),
-			bson.NewDocument(bson.EC.String("webhookid", urlVars["webhook_id"])))
-		if err != nil {
-			log.Fatal(err)
+		webhook, err := s.webhooks.GetWebhook(r.Context(), urlVars["webhook_id"])
+		if err == errNotFound {
+			// If the webhook with the requested ID doesn't exist in the collection, return an error
+			http.Error(w, "404 - The webhook with that ID doesn't exists in our Database", http.StatusNotFound)
+			return
 		}
-
-		// 'Close' the cursor
-		defer cursor.Close(context.Background())
-
-		webhook := Webhook{}
-
-		// Point the cursor at whatever is found
-		for cursor.Next(context.Background()) {
-			err = cursor.Decode(&webhook)
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			json.NewEncoder(w).Encode(webhook)
-
+		if err != nil {
+			serverError(w, err)
 			return
-
 		}
 
-		// If the webhook with the requested ID doesn't exist in the collection, return an error
-		http.Error(w, "404 - The webhook with that ID doesn't exists in our Database", http.StatusNotFound)
-		return
+		json.NewEncoder(w).Encode(webhook)
 
 		// If the request is of DELETE type, then delete the webhook with the specified ID
 	case "DELETE":
@@ -164,39 +131,25 @@ func webhookID(w http.ResponseWriter, r *http.Request) {
 
 		urlVars := mux.Vars(r)
 
-		client := mongoConnect()
-
-		collection := client.Database("igcfiles").Collection("webhooks")
-
-		cursor, err := collection.Find(context.Background(), bson.NewDocument(bson.EC.String("webhookid", urlVars["webhook_id"])))
+		webhook, err := s.webhooks.GetWebhook(r.Context(), urlVars["webhook_id"])
+		if err == errNotFound {
+			// If the webhook with the requested ID doesn't exist in the collection, return an error
+			http.Error(w, "404 - The webhook with that ID doesn't exists in our Database", http.StatusNotFound)
+			return
+		}
 		if err != nil {
-			log.Fatal(err)
+			serverError(w, err)
+			return
 		}
 
-		// 'Close' the cursor
-		defer cursor.Close(context.Background())
-
-		webhook := Webhook{}
-
-		// Point the cursor at whatever is found
-		for cursor.Next(context.Background()) {
-			err = cursor.Decode(&webhook)
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			json.NewEncoder(w).Encode(webhook)
-
-			// Delete the webhook that was found
-			deleteWebhook(client, webhook.WebhookID)
-
+		// Delete the webhook that was found
+		err = s.webhooks.DeleteWebhook(r.Context(), webhook.WebhookID)
+		if err != nil {
+			serverError(w, err)
 			return
-
 		}
 
-		// If the webhook with the requested ID doesn't exist in the collection, return an error
-		http.Error(w, "404 - The webhook with that ID doesn't exists in our Database", http.StatusNotFound)
-		return
+		json.NewEncoder(w).Encode(webhook)
 
 	default:
 		// For other methods except GET and DELETE, requested in this handler you get this error
@@ -209,63 +162,51 @@ func webhookID(w http.ResponseWriter, r *http.Request) {
 
 //////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
-// This function is called whenever a Track is registered in DB
+// This function is called whenever a Track is registered in DB, or once for a batch of added tracks
 // The frequency of this function to be triggered depends on the minTriggerValue, which
 // indicates the frequency of updates - after how many tracks the webhook should be called
-func triggerWhenTrackIsAdded() {
+func (s *server) triggerWhenTrackIsAdded(ctx context.Context, added int) {
 
-	// Connect to DB
-	clientDB := mongoConnect()
+	resultWebhooks, err := s.webhooks.GetAllWebhooks(ctx)
+	if err != nil {
+		log.Println("Error reading the webhooks, ", err)
+		return
+	}
+
+	allTracks, err := s.tracks.GetAllTracks(ctx)
+	if err != nil {
+		log.Println("Error reading the tracks, ", err)
+		return
+	}
 
-	resultWebhooks := getAllWebhooks(clientDB)
+	// Counting the number of track at the moment
+	trackCount := int32(len(allTracks))
 
 	for _, val := range resultWebhooks {
 
-		// Counting the number of track at the moment
-		trackCount := int32(countAllTracks(clientDB))
-
 		// Saving its minimal trigger value for later use
 		minTriggerValue := val.MinTriggerValue
 
-		// Check according to minTriggerValue when to trigger the webhook
-		if trackCount%minTriggerValue == 0 {
+		// Check according to minTriggerValue when to trigger the webhook,
+		// a batch triggers it once if it went past a multiple of minTriggerValue
+		if minTriggerValue > 0 && trackCount/minTriggerValue > (trackCount-int32(added))/minTriggerValue {
 
 			// Creating an instance of WebhookContent stuct
 			webhookInfo := &WebhookContent{}
 
 			processStart := time.Now() // Track when the process started
 
-			timestamps := tickerTimestamps("")
+			timestamps := tickerTimestamps("", allTracks)
 
 			// Saving the latest added timestamp of the entire collection
 			webhookInfo.TLatest = timestamps.latestTimestamp.String()
 
 			// Creating a slice where all the IDs of track in DB are going to be saved
-			WebhookInfoTrackIDs := make([]string, 0, 0)
-
-			collection := clientDB.Database("igcfiles").Collection("tracks")
-
-			// Find all the documents(tracks) in that collection
-			cursor, err := collection.Find(context.Background(), nil, nil)
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			// 'Close' the cursor
-			defer cursor.Close(context.Background())
-
-			track := tracks{}
-
-			// Point the cursor at whatever is found
-			for cursor.Next(context.Background()) {
-				err = cursor.Decode(&track)
-				if err != nil {
-					log.Fatal(err)
-				}
+			WebhookInfoTrackIDs := make([]string, 0, len(allTracks))
 
+			for _, track := range allTracks {
 				// Append all the IDs of tracks in our DB to this slice
 				WebhookInfoTrackIDs = append(WebhookInfoTrackIDs, track.UniqueID)
-
 			}
 
 			webhookInfo.Tracks = WebhookInfoTrackIDs
@@ -280,93 +221,101 @@ func triggerWhenTrackIsAdded() {
 			content += " \n\t\"processing\" : \"" + webhookInfo.Processing + "\" \n}\n"
 			content += "```"
 
-			// Adding the values to URL
-			data := url.Values{}
-			data.Set("username", "TrackAdded")
-			data.Add("content", content)
-
-			u, _ := url.ParseRequestURI(val.WebhookURL)
-			urlStr := u.String()
+			s.deliver(val.WebhookURL, "TrackAdded", content)
 
-			client := &http.Client{}
+		}
 
-			// Creating a new POST request to the webhook URL and sending the specified data to be printed in Discord
-			r, err := http.NewRequest("POST", urlStr, strings.NewReader(data.Encode())) // URL-encoded payload
-			if err != nil {
-				fmt.Println("Error constructing the POST request, ", err)
-			}
+	}
 
-			// Specifying the request header parameters to send the data as JSON
-			r.Header.Add("Authorization", "auth_token=\"XXXXXXX\"")
-			r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-			r.Header.Add("Content-Length", strconv.Itoa(len(data.Encode())))
+}
 
-			resp, err := client.Do(r)
-			if err != nil {
-				fmt.Println("Error executing the POST request, ", err)
-			}
+// deliver posts the content to the webhook in the background,
+// the pending deliveries are drained before the service shuts down
+func (s *server) deliver(webhookURL string, username string, content string) {
+	s.deliveries.Add(1)
 
-			defer resp.Body.Close()
+	go func() {
+		defer s.deliveries.Done()
 
+		if err := s.postWebhook(webhookURL, username, content); err != nil {
+			log.Println(err)
 		}
+	}()
+}
 
+// waitDeliveries waits for the pending webhook deliveries, or until the context is done
+func (s *server) waitDeliveries(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.deliveries.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-
 }
 
-// Delete webhook with the ID specified in function parameters
-func deleteWebhook(client *mongo.Client, webhookID string) {
-	db := client.Database("igcfiles")
-	collection := db.Collection("webhooks")
+// postWebhook sends the content to the webhook URL to be printed in Discord
+func (s *server) postWebhook(webhookURL string, username string, content string) error {
 
-	// Delete the webhook
-	collection.DeleteOne(context.Background(), bson.NewDocument(bson.EC.String("webhookid", webhookID)))
-}
+	// Adding the values to URL
+	data := url.Values{}
+	data.Set("username", username)
+	data.Add("content", content)
 
-// Get all webhooks
-func getAllWebhooks(client *mongo.Client) []Webhook {
-	db := client.Database("igcfiles")
-	collection := db.Collection("webhooks")
+	u, err := url.ParseRequestURI(webhookURL)
+	if err != nil {
+		return fmt.Errorf("Error parsing the webhook URL, %s", err)
+	}
+	urlStr := u.String()
 
-	var cursor mongo.Cursor
-	var err error
-	cursor, err = collection.Find(context.Background(), nil)
+	client := &http.Client{Timeout: time.Duration(s.cfg.WebhookTimeout)}
 
+	// Creating a new POST request to the webhook URL and sending the specified data to be printed in Discord
+	r, err := http.NewRequest("POST", urlStr, strings.NewReader(data.Encode())) // URL-encoded payload
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("Error constructing the POST request, %s", err)
 	}
 
-	defer cursor.Close(context.Background())
+	// Specifying the request header parameters to send the data as JSON
+	r.Header.Add("Authorization", "auth_token=\"XXXXXXX\"")
+	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Add("Content-Length", strconv.Itoa(len(data.Encode())))
 
-	resWebhooks := []Webhook{}
-	resWebhook := Webhook{}
-
-	for cursor.Next(context.Background()) {
-		err := cursor.Decode(&resWebhook)
-		if err != nil {
-			log.Fatal(err)
-		}
-		resWebhooks = append(resWebhooks, resWebhook) // Append each resTrack to resTracks slice
+	resp, err := client.Do(r)
+	if err != nil {
+		return fmt.Errorf("Error executing the POST request, %s", err)
 	}
 
-	return resWebhooks
+	return resp.Body.Close()
 }
 
-var latestTrackCounter = 1
-
-//
-func clockTrigger(w http.ResponseWriter, r *http.Request) {
-
-	clientDB := mongoConnect()
+// notifyNewTracks checks if the number of tracks differs from the previous check,
+// and if it does, it notifies all the registered webhooks
+func (s *server) notifyNewTracks(ctx context.Context) error {
+	// The in-process clock and the admin trigger can check at the same time
+	s.clockMu.Lock()
+	defer s.clockMu.Unlock()
 
-	currentTrackCount := int(countAllTracks(clientDB))
-
-	if latestTrackCounter != currentTrackCount {
+	currentTrackCount, err := s.tracks.CountTracks(ctx)
+	if err != nil {
+		return err
+	}
 
-		resultWebhooks := getAllWebhooks(clientDB)
-		allTracks := getAllTracks(clientDB)
+	if s.latestTrackCount != currentTrackCount {
 
-		allTracks = allTracks[latestTrackCounter-1:]
+		resultWebhooks, err := s.webhooks.GetAllWebhooks(ctx)
+		if err != nil {
+			return err
+		}
+		allTracks, err := s.tracks.GetAllTracks(ctx)
+		if err != nil {
+			return err
+		}
 
 		for _, val := range resultWebhooks {
 
@@ -374,32 +323,14 @@ func clockTrigger(w http.ResponseWriter, r *http.Request) {
 
 			processStart := time.Now() // Track when the process started
 
-			timestamps := tickerTimestamps("")
+			timestamps := tickerTimestamps("", allTracks)
 
 			webhookInfo.TLatest = timestamps.latestTimestamp.String()
 
-			WebhookInfoTrackIDs := make([]string, 0, 0)
-
-			collection := clientDB.Database("igcfiles").Collection("tracks")
+			WebhookInfoTrackIDs := make([]string, 0, len(allTracks))
 
-			cursor, err := collection.Find(context.Background(), nil, nil)
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			// 'Close' the cursor
-			defer cursor.Close(context.Background())
-
-			track := tracks{}
-
-			// Point the cursor at whatever is found
-			for cursor.Next(context.Background()) {
-				err = cursor.Decode(&track)
-				if err != nil {
-					log.Fatal(err)
-				}
+			for _, track := range allTracks {
 				WebhookInfoTrackIDs = append(WebhookInfoTrackIDs, track.UniqueID)
-
 			}
 
 			webhookInfo.Tracks = WebhookInfoTrackIDs
@@ -411,43 +342,37 @@ func clockTrigger(w http.ResponseWriter, r *http.Request) {
 			content += " \nNew tracks are: [ " + strings.Join(webhookInfo.Tracks, ", ") + " ] ."
 			content += " \nThe request took: " + webhookInfo.Processing + " time to process .\n"
 
-			data := url.Values{}
-			data.Set("username", "tracks")
-			data.Add("content", content)
-
-			u, _ := url.ParseRequestURI(val.WebhookURL)
-			urlStr := u.String()
+			s.deliver(val.WebhookURL, "tracks", content)
 
-			client := &http.Client{}
-			r, err = http.NewRequest("POST", urlStr, strings.NewReader(data.Encode())) // URL-encoded payload
-			if err != nil {
-				fmt.Fprintln(w, "Error constructing the POST request, ", err)
-			}
+		}
 
-			// Specifying the request header parameters to send the data as JSON
-			r.Header.Add("Authorization", "auth_token=\"XXXXXXX\"")
-			r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-			r.Header.Add("Content-Length", strconv.Itoa(len(data.Encode())))
+		s.latestTrackCount = currentTrackCount
 
-			resp, err := client.Do(r)
-			if err != nil {
-				fmt.Fprintln(w, "Error executing the POST request, ", err)
-			}
+	}
 
-			defer resp.Body.Close()
+	return nil
+}
 
+// runClock checks for new tracks on regular basis, when the clock trigger runs inside the service
+func (s *server) runClock(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.notifyNewTracks(context.Background()); err != nil {
+			log.Println("Clock trigger: ", err)
 		}
-
-		latestTrackCounter = currentTrackCount
-
 	}
+}
 
+// Handles path: GET /admin/api/webhooks, called by the Clock_Trigger
+func (s *server) clockTrigger(w http.ResponseWriter, r *http.Request) {
+	if err := s.notifyNewTracks(r.Context()); err != nil {
+		serverError(w, err)
+	}
 }
 
 /////////////////////////////////////////////////////////////
 // Handles path: GET /admin/api/tracks_count
 // Returns the current count of all tracks in the DB
-func adminAPITracksCount(w http.ResponseWriter, r *http.Request) {
+func (s *server) adminAPITracksCount(w http.ResponseWriter, r *http.Request) {
 
 	//w.Header().Set("Content-Type", "application/json")
 
@@ -456,14 +381,18 @@ func adminAPITracksCount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client := mongoConnect()
+	count, err := s.tracks.CountTracks(r.Context())
+	if err != nil {
+		serverError(w, err)
+		return
+	}
 
-	fmt.Fprintf(w, "Current count of the tracks in DB is: %d", countAllTracks(client))
+	fmt.Fprintf(w, "Current count of the tracks in DB is: %d", count)
 }
 
 // Handles path: DELETE /admin/api/track
 // It only works with DELETE method, and this handler deletes all tracks in the DB
-func adminAPITracks(w http.ResponseWriter, r *http.Request) {
+func (s *server) adminAPITracks(w http.ResponseWriter, r *http.Request) {
 
 	//w.Header().Set("Content-Type", "application/json")
 
@@ -472,20 +401,60 @@ func adminAPITracks(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client := mongoConnect()
+	// Deleting all the track in DB
+	count, err := s.tracks.DeleteAllTracks(r.Context())
+	if err != nil {
+		serverError(w, err)
+		return
+	}
 
-	// Notifying the admin first for the current count of the track
-	fmt.Fprintf(w, "Count of the tracks removed from DB is: %d", countAllTracks(client))
+	// The original IGC files and the fixes go with their tracks
+	for _, bucket := range []string{igcFiles, trackPoints} {
+		if err = s.files.DeleteFiles(r.Context(), bucket); err != nil {
+			serverError(w, err)
+			return
+		}
+	}
 
-	// Deleting all the track in DB
-	deleteAllTracks(client)
+	// Notifying the admin for the count of the tracks removed
+	fmt.Fprintf(w, "Count of the tracks removed from DB is: %d", count)
 
 }
 
-func adminAPIWebhookTrigger(w http.ResponseWriter, r *http.Request) {
+func (s *server) adminAPIWebhookTrigger(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
-		clockTrigger(w, r)
+		s.clockTrigger(w, r)
 	} else {
 		http.Error(w, "Method not implemented yet", http.StatusNotImplemented)
 	}
 }
+
+// Handles path: GET /admin/api/config
+// Returns the effective settings of the service, without the passwords
+func (s *server) adminAPIConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "501 - Method not implemented", http.StatusNotImplemented)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.cfg.redacted())
+}
+
+// adminOnly protects an admin handler with basic authentication,
+// if admin credentials are configured
+func (s *server) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.AdminUser != "" {
+			user, password, ok := r.BasicAuth()
+			if !ok ||
+				subtle.ConstantTimeCompare([]byte(user), []byte(s.cfg.AdminUser)) != 1 ||
+				subtle.ConstantTimeCompare([]byte(password), []byte(s.cfg.AdminPassword)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="paragliding admin"`)
+				http.Error(w, "401 - Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
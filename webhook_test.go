@@ -2,10 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -13,7 +15,7 @@ import (
 func Test_webhookNewTrack_NotImplemented(t *testing.T) {
 
 	// instantiate mock HTTP server (just for the purpose of testing
-	ts := httptest.NewServer(http.HandlerFunc(webhookNewTrack))
+	ts := httptest.NewServer(http.HandlerFunc(newTestServer().webhookNewTrack))
 	defer ts.Close()
 
 	//create a request to our mock HTTP server
@@ -38,7 +40,7 @@ func Test_webhookNewTrack_NotImplemented(t *testing.T) {
 }
 func Test_getNewWebhook(t *testing.T) {
 
-	ts := httptest.NewServer(http.HandlerFunc(webhookNewTrack))
+	ts := httptest.NewServer(http.HandlerFunc(newTestServer().webhookNewTrack))
 	defer ts.Close()
 
 	client := &http.Client{}
@@ -73,7 +75,7 @@ func Test_getNewWebhook(t *testing.T) {
 
 func Test_getNewWebhookID(t *testing.T) {
 
-	ts := httptest.NewServer(http.HandlerFunc(webhookNewTrack))
+	ts := httptest.NewServer(http.HandlerFunc(newTestServer().webhookNewTrack))
 	defer ts.Close()
 
 	client := &http.Client{}
@@ -103,7 +105,7 @@ func Test_getNewWebhookID(t *testing.T) {
 
 func Test_webhookNewTrack(t *testing.T) {
 	// instantiate mock HTTP server (just for the purpose of testing
-	ts := httptest.NewServer(http.HandlerFunc(webhookNewTrack))
+	ts := httptest.NewServer(http.HandlerFunc(newTestServer().webhookNewTrack))
 	defer ts.Close()
 
 	//create a request to our mock HTTP server
@@ -145,7 +147,7 @@ func Test_webhookNewTrack(t *testing.T) {
 
 func Test_webhookID(t *testing.T) {
 	// instantiate mock HTTP server (just for the purpose of testing
-	ts := httptest.NewServer(http.HandlerFunc(webhookID))
+	ts := httptest.NewServer(http.HandlerFunc(newTestServer().webhookID))
 	defer ts.Close()
 
 	//create a request to our mock HTTP server
@@ -172,3 +174,36 @@ func Test_webhookID(t *testing.T) {
 	}
 
 }
+
+func Test_triggerWhenTrackIsAdded(t *testing.T) {
+	received := make(chan string, 1)
+
+	// mock webhook receiver, like Discord
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		received <- r.PostForm.Get("content")
+	}))
+	defer hook.Close()
+
+	s := newTestServer()
+	ctx := context.Background()
+
+	s.webhooks.AddWebhook(ctx, Webhook{WebhookURL: hook.URL, MinTriggerValue: 1, WebhookID: "1"})
+	s.tracks.AddTrack(ctx, tracks{UniqueID: "42", TimeRecorded: time.Now()})
+
+	s.triggerWhenTrackIsAdded(ctx, 1)
+
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if err := s.waitDeliveries(waitCtx); err != nil {
+		t.Fatalf("Webhook delivery not drained, %s", err)
+	}
+
+	select {
+	case content := <-received:
+		assert.Contains(t, content, "42")
+	default:
+		t.Error("The webhook was not called")
+	}
+}